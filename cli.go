@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"mesh-drop/internal/audit"
+	"mesh-drop/internal/config"
+	"mesh-drop/internal/discovery"
+	"mesh-drop/internal/transfer"
+)
+
+// 命令行模式，用于 shell 管道：
+//
+//	tar c dir | mesh-drop send peer -
+//	mesh-drop receive --stdout | tar x
+//
+// 命令行模式不启动界面，使用与图形界面相同的配置与身份。
+// 图形界面运行时会占用发现服务的端口，此时 send 需要直接指定接收端 IP。
+
+const cliPort = 9989
+
+const cliUsage = `Usage:
+  mesh-drop send [--name NAME] [--wait DURATION] <peer> -
+      Send standard input to <peer> (name, ID or IP address).
+  mesh-drop receive --stdout [--from PEER] [--timeout DURATION]
+      Receive one stream from a trusted peer and write it to standard output.
+  mesh-drop audit verify [--file PATH]
+      Check the audit log for tampering. Exits with status 1 if a problem is found.
+`
+
+// runCLI 处理命令行子命令，返回 false 表示没有子命令，按图形界面启动
+func runCLI(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	switch args[0] {
+	case "send", "receive", "audit":
+	case "help", "-h", "--help":
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 0, true
+	default:
+		return 0, false
+	}
+
+	// 标准输出可能用于传输数据，日志写到标准错误
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	})))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	configDir := config.GetConfigDir()
+	conf := config.LoadFrom(configDir, config.WindowState{Width: 1024, Height: 768})
+	if args[0] == "audit" {
+		return cliAudit(args[1:], conf, configDir), true
+	}
+	openAuditLog(conf, configDir)
+	discoveryService := discovery.NewService(conf, nil, cliPort)
+	transferService := transfer.NewService(
+		conf,
+		configDir,
+		nil,
+		nil,
+		nil,
+		cliPort,
+		discoveryService,
+	)
+
+	if args[0] == "send" {
+		return cliSend(ctx, args[1:], discoveryService, transferService), true
+	}
+	return cliReceive(ctx, args[1:], conf, discoveryService, transferService), true
+}
+
+func cliSend(
+	ctx context.Context,
+	args []string,
+	discoveryService *discovery.Service,
+	transferService *transfer.Service,
+) int {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	name := fs.String("name", "", "file name shown to the receiver")
+	wait := fs.Duration("wait", 10*time.Second, "how long to wait for the peer to be discovered")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	if fs.Arg(1) != "-" {
+		fmt.Fprintln(os.Stderr, "only '-' (standard input) is supported")
+		return 2
+	}
+	if *name == "" {
+		*name = "stream-" + time.Now().Format("20060102-150405")
+	}
+
+	peer, ip, err := findPeer(ctx, discoveryService, fs.Arg(0), *wait)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	task, done := transferService.SendStream(peer, ip, *name, os.Stdin)
+	select {
+	case <-done:
+	case <-ctx.Done():
+		transferService.CancelTransfer(task.ID)
+		<-done
+	}
+	result := task.Snapshot()
+	if result.Status != transfer.TransferStatusCompleted {
+		fmt.Fprintf(os.Stderr, "send %s: %s\n", result.Status, result.ErrorMsg)
+		return 1
+	}
+	slog.Info("Stream sent", "bytes", result.FileSize, "peer", peer.Name)
+	return 0
+}
+
+func cliReceive(
+	ctx context.Context,
+	args []string,
+	conf *config.Config,
+	discoveryService *discovery.Service,
+	transferService *transfer.Service,
+) int {
+	fs := flag.NewFlagSet("receive", flag.ContinueOnError)
+	stdout := fs.Bool("stdout", false, "write the received stream to standard output")
+	from := fs.String("from", "", "only accept a stream from this peer (name or ID)")
+	timeout := fs.Duration("timeout", 0, "give up if no stream arrives in time (0 waits forever)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if !*stdout || fs.NArg() != 0 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	discoveryService.Start()
+	transferService.StartServer()
+
+	// 只接受受信任的节点，指定 --from 时还需要匹配节点
+	accept := func(sender discovery.Peer) bool {
+		if !conf.IsTrusted(sender.ID) || sender.TrustMismatch {
+			return false
+		}
+		return *from == "" || sender.ID == *from || strings.EqualFold(sender.Name, *from)
+	}
+	task, err := transferService.ReceiveStream(ctx, os.Stdout, accept)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if task.Status != transfer.TransferStatusCompleted {
+		fmt.Fprintf(os.Stderr, "receive %s: %s\n", task.Status, task.ErrorMsg)
+		return 1
+	}
+	slog.Info("Stream received", "bytes", task.FileSize, "peer", task.Sender.Name)
+	return 0
+}
+
+// findPeer 按名称、ID 或 IP 查找节点，等待发现服务最多 wait
+func findPeer(
+	ctx context.Context,
+	discoveryService *discovery.Service,
+	query string,
+	wait time.Duration,
+) (*discovery.Peer, string, error) {
+	// 直接指定 IP 时不需要发现服务
+	if ip := net.ParseIP(query); ip != nil {
+		return &discovery.Peer{Name: query, Port: cliPort}, query, nil
+	}
+
+	discoveryService.Start()
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		for _, peer := range discoveryService.GetPeers() {
+			if peer.ID != query && !strings.EqualFold(peer.Name, query) {
+				continue
+			}
+			var latest *discovery.RouteState
+			for _, route := range peer.Routes {
+				if latest == nil || route.LastSeen.After(latest.LastSeen) {
+					latest = route
+				}
+			}
+			if latest != nil {
+				return &peer, latest.IP, nil
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, "", fmt.Errorf("peer %q not found", query)
+		}
+	}
+}
+
+func cliAudit(args []string, conf *config.Config, configDir string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	file := fs.String(
+		"file",
+		filepath.Join(configDir, audit.FileName),
+		"audit log to verify, rotated files next to it are verified too",
+	)
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	report, err := audit.VerifyFile(*file, conf.GetPublicKey())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, problem := range report.Problems {
+		fmt.Fprintf(
+			os.Stderr,
+			"%s line %d (seq %d): %s\n",
+			filepath.Base(problem.File),
+			problem.Line,
+			problem.Seq,
+			problem.Reason,
+		)
+	}
+	if !report.Valid() {
+		fmt.Fprintf(
+			os.Stderr,
+			"audit log is NOT valid: %d problems in %d entries\n",
+			len(report.Problems),
+			report.Entries,
+		)
+		return 1
+	}
+	fmt.Fprintf(
+		os.Stderr,
+		"audit log is valid: %d entries, last sequence %d\n",
+		report.Entries,
+		report.LastSeq,
+	)
+	return 0
+}
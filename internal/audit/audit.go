@@ -0,0 +1,424 @@
+// Package audit 记录安全相关事件，用于事后核查
+//
+// 事件以 JSON Lines 追加写入配置目录下的 audit.jsonl。每条记录包含上一条记录的哈希，
+// 并使用本机的 Ed25519 私钥对自身的哈希签名。修改、删除或插入中间的记录都会使验证失败；
+// 截断文件末尾的记录无法通过哈希链发现，但序号会停在截断处。
+//
+// 图形界面与命令行可能同时写入，追加时对文件加排他锁，并先读取其他进程追加的记录。
+// 同一来源的同类事件每分钟最多写入 10 条，超出的只计数。文件超过 8 MiB 后轮转，
+// 哈希链在轮转文件之间延续，最多保留 3 个轮转文件，删除的最早记录无法再验证。
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"mesh-drop/internal/fsutil"
+	"mesh-drop/internal/security"
+)
+
+// Kind 事件类型
+type Kind string
+
+const (
+	KindTrustAdded         Kind = "trust_added"
+	KindTrustRemoved       Kind = "trust_removed"
+	KindTrustMismatch      Kind = "trust_mismatch"       // 节点公钥与信任列表不一致
+	KindZipSlip            Kind = "zip_slip"             // 文件夹中的条目指向保存目录之外
+	KindTokenMismatch      Kind = "token_mismatch"       // 上传使用了错误的凭证
+	KindControlTokenDenied Kind = "control_token_denied" // 本地控制接口的令牌错误
+	KindAskRejected        Kind = "ask_rejected"         // 传输请求被拒绝
+)
+
+// FileName 审计日志在配置目录下的文件名
+const FileName = "audit.jsonl"
+
+// recentLimit 内存中保留的最近事件数
+const recentLimit = 500
+
+const (
+	// rotateSize 文件超过该大小后轮转
+	rotateSize = 8 << 20
+	// rotateKeep 保留的轮转文件数，文件名为 audit.jsonl.1 到 audit.jsonl.3，数字越大越早
+	rotateKeep = 3
+)
+
+// rotatedPath 返回第 n 个轮转文件的路径
+func rotatedPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// Event 是调用方提供的事件内容
+type Event struct {
+	Kind     Kind
+	PeerID   string
+	PeerName string
+	IP       string
+	Message  string
+	Details  map[string]string
+}
+
+// Entry 是审计日志中的一条记录
+type Entry struct {
+	Seq      uint64            `json:"seq"`
+	Time     int64             `json:"time"` // 毫秒
+	Kind     Kind              `json:"kind"`
+	PeerID   string            `json:"peer_id,omitempty"`
+	PeerName string            `json:"peer_name,omitempty"`
+	IP       string            `json:"ip,omitempty"`
+	Message  string            `json:"message"`
+	Details  map[string]string `json:"details,omitempty"`
+	// PrevHash 上一条记录的 Hash，第一条记录为空
+	PrevHash string `json:"prev_hash"`
+	// Hash 是 Hash 与 Signature 为空时记录的 JSON 的 SHA-256 (hex)
+	Hash string `json:"hash"`
+	// Signature 是对 Hash 的 Ed25519 签名 (base64)
+	Signature string `json:"signature"`
+}
+
+// computeHash 计算记录的哈希，不包括 Hash 与 Signature
+func (e Entry) computeHash() (string, error) {
+	e.Hash = ""
+	e.Signature = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type Log struct {
+	path       string
+	privateKey string
+	publicKey  string
+
+	mu       sync.Mutex
+	file     *os.File
+	lastSeq  uint64
+	lastHash string
+	// offset 已经读取或写入到的文件位置，之后的内容由其他进程追加
+	offset int64
+	// firstSeq 当前文件第一条记录的序号，用于发现其他进程的轮转
+	firstSeq uint64
+	// recent 最近的事件，按时间升序
+	recent []Entry
+	// partial 文件以未写完的行结尾，追加前需要先换行
+	partial bool
+	limiter limiter
+}
+
+// Open 打开审计日志，读取最后一条记录以继续哈希链
+// privateKey 与 publicKey 是 base64 编码的本机密钥
+func Open(path, privateKey, publicKey string) (*Log, error) {
+	l := &Log{
+		path:       path,
+		privateKey: privateKey,
+		publicKey:  publicKey,
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	if err := l.lock(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	l.unlock()
+	return l, nil
+}
+
+// lock 锁定日志文件，并读取其他进程在此期间追加的记录，调用方持有 mu 或尚未共享 l
+// 图形界面与命令行可能同时写入同一个文件，每次追加前都需要从文件中获取哈希链的末尾
+func (l *Log) lock() error {
+	if err := fsutil.LockFile(l.file); err != nil && !errors.Is(err, fsutil.ErrUnsupported) {
+		return err
+	}
+	if err := l.catchUp(); err != nil {
+		l.unlock()
+		return err
+	}
+	return nil
+}
+
+func (l *Log) unlock() {
+	_ = fsutil.UnlockFile(l.file)
+}
+
+// catchUp 从 offset 开始读取记录，更新哈希链的末尾，调用方持有文件锁
+func (l *Log) catchUp() error {
+	info, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	rotated := size < l.offset
+	if !rotated && l.offset > 0 {
+		// 轮转后其他进程又追加了记录时，文件可能不小于 offset，需要比较第一条记录
+		seq, err := firstSeq(l.file, size)
+		if err != nil {
+			return err
+		}
+		rotated = seq != l.firstSeq
+	}
+	switch {
+	case rotated:
+		// 其他进程轮转了日志，轮转前追加的记录在上一个文件中
+		if err := l.readRotated(l.offset); err != nil {
+			return err
+		}
+		l.offset = 0
+	case size == 0 && l.lastHash == "":
+		// 日志刚轮转时，哈希链从上一个文件的最后一条记录继续
+		if err := l.readRotated(0); err != nil {
+			return err
+		}
+	}
+	if size == l.offset {
+		return nil
+	}
+	if l.offset == 0 {
+		if l.firstSeq, err = firstSeq(l.file, size); err != nil {
+			return err
+		}
+	}
+	if err := l.read(l.file, l.offset, size); err != nil {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := l.file.ReadAt(last, size-1); err != nil {
+		return err
+	}
+	l.partial = last[0] != '\n'
+	l.offset = size
+	return nil
+}
+
+// read 读取 r 中 [from, to) 之间的记录
+func (l *Log) read(r io.ReaderAt, from, to int64) error {
+	return readEntries(io.NewSectionReader(r, from, to-from), func(_ int, e Entry, err error) {
+		if err != nil {
+			return
+		}
+		l.lastSeq = e.Seq
+		l.lastHash = e.Hash
+		l.remember(e)
+	})
+}
+
+// firstSeq 返回文件第一条记录的序号，无法解析时返回 0
+func firstSeq(r io.ReaderAt, size int64) (uint64, error) {
+	line, err := bufio.NewReader(io.NewSectionReader(r, 0, size)).ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	var e Entry
+	if json.Unmarshal(line, &e) != nil {
+		return 0, nil
+	}
+	return e.Seq, nil
+}
+
+// readRotated 从 offset 开始读取最近的轮转文件，文件不存在时忽略
+func (l *Log) readRotated(offset int64) error {
+	file, err := os.Open(rotatedPath(l.path, 1))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < offset {
+		offset = 0
+	}
+	return l.read(file, offset, info.Size())
+}
+
+// rotate 将当前文件复制为第一个轮转文件后清空，较早的轮转文件依次后移，调用方持有文件锁
+// 使用复制与截断而不是重命名，其他进程已打开的文件仍然是当前文件
+func (l *Log) rotate() error {
+	for n := rotateKeep - 1; n >= 1; n-- {
+		err := os.Rename(rotatedPath(l.path, n), rotatedPath(l.path, n+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	dst, err := os.OpenFile(rotatedPath(l.path, 1), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, io.NewSectionReader(l.file, 0, l.offset))
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Truncate(l.path, 0); err != nil {
+		return err
+	}
+	l.offset = 0
+	l.firstSeq = 0
+	l.partial = false
+	return nil
+}
+
+// remember 保留最近的事件，调用方持有 mu 或尚未共享 l
+func (l *Log) remember(e Entry) {
+	l.recent = append(l.recent, e)
+	if len(l.recent) > recentLimit {
+		l.recent = slices.Delete(l.recent, 0, len(l.recent)-recentLimit)
+	}
+}
+
+// record 追加一条记录并立即写入磁盘
+func (l *Log) record(event Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.lock(); err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	now := time.Now()
+	suppressed, ok := l.limiter.allow(event, now)
+	if !ok {
+		return nil
+	}
+	if suppressed > 0 {
+		event.Details = withSuppressed(event.Details, suppressed)
+	}
+
+	entry := Entry{
+		Seq:      l.lastSeq + 1,
+		Time:     now.UnixMilli(),
+		Kind:     event.Kind,
+		PeerID:   event.PeerID,
+		PeerName: event.PeerName,
+		IP:       event.IP,
+		Message:  event.Message,
+		Details:  event.Details,
+		PrevHash: l.lastHash,
+	}
+	hash, err := entry.computeHash()
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	entry.Signature, err = security.Sign(l.privateKey, []byte(hash))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if l.partial {
+		data = append([]byte{'\n'}, data...)
+	}
+	if l.offset == 0 {
+		l.firstSeq = entry.Seq
+	}
+	n, err := l.file.Write(append(data, '\n'))
+	l.offset += int64(n)
+	if err != nil {
+		l.partial = l.partial || n > 0
+		return err
+	}
+	l.partial = false
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.lastSeq = entry.Seq
+	l.lastHash = entry.Hash
+	l.remember(entry)
+
+	if l.offset >= rotateSize {
+		if err := l.rotate(); err != nil {
+			slog.Warn("Failed to rotate audit log", "error", err, "component", "audit")
+		}
+	}
+	return nil
+}
+
+// Recent 返回最近的 limit 条事件，按时间降序排列，limit 不大于 0 时返回全部
+func (l *Log) Recent(limit int) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := slices.Clone(l.recent)
+	slices.Reverse(entries)
+	if limit > 0 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+// readEntries 逐行解析记录，line 从 1 开始，无法解析的行通过 err 返回
+func readEntries(r io.Reader, fn func(line int, e Entry, err error)) error {
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			var e Entry
+			err := json.Unmarshal(data, &e)
+			fn(line, e, err)
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var (
+	defaultMu  sync.RWMutex
+	defaultLog *Log
+)
+
+// SetDefault 设置 Record 写入的审计日志
+func SetDefault(l *Log) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultLog = l
+}
+
+// Default 返回 SetDefault 设置的审计日志，未设置时为 nil
+func Default() *Log {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultLog
+}
+
+// Record 写入一条事件，未设置审计日志时忽略
+func Record(event Event) {
+	l := Default()
+	if l == nil {
+		return
+	}
+	if err := l.record(event); err != nil {
+		slog.Error("Failed to write audit log", "kind", event.Kind, "error", err, "component", "audit")
+	}
+}
@@ -0,0 +1,78 @@
+package audit
+
+import (
+	"maps"
+	"strconv"
+	"time"
+)
+
+const (
+	// limitWindow 同一来源同类事件的计数周期
+	limitWindow = time.Minute
+	// limitBurst 每个周期内同一来源同类事件最多写入的条数，超出的只计数
+	limitBurst = 10
+	// limitMaxKeys 记录的来源数超过该值时清理已过期的计数
+	limitMaxKeys = 1024
+)
+
+// limitKey 按事件类型、节点与 IP 区分来源
+type limitKey struct {
+	kind Kind
+	peer string
+	ip   string
+}
+
+type limitState struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// limiter 限制同一来源写入的事件数，防止局域网中的节点或本机进程刷满审计日志
+// 被跳过的事件数记录在该来源下一条写入的事件的 suppressed 字段中
+type limiter struct {
+	states map[limitKey]*limitState
+}
+
+// allow 判断事件是否写入，允许时返回此前被跳过的事件数，调用方持有 Log.mu
+func (l *limiter) allow(event Event, now time.Time) (int, bool) {
+	if l.states == nil {
+		l.states = make(map[limitKey]*limitState)
+	}
+	if len(l.states) >= limitMaxKeys {
+		for key, state := range l.states {
+			if now.Sub(state.start) >= limitWindow && state.suppressed == 0 {
+				delete(l.states, key)
+			}
+		}
+	}
+
+	key := limitKey{kind: event.Kind, peer: event.PeerID, ip: event.IP}
+	state, ok := l.states[key]
+	if !ok {
+		state = &limitState{start: now}
+		l.states[key] = state
+	}
+	if now.Sub(state.start) >= limitWindow {
+		state.start = now
+		state.count = 0
+	}
+	if state.count >= limitBurst {
+		state.suppressed++
+		return 0, false
+	}
+	state.count++
+	suppressed := state.suppressed
+	state.suppressed = 0
+	return suppressed, true
+}
+
+// withSuppressed 在事件详情中记录被跳过的事件数，不修改调用方的 map
+func withSuppressed(details map[string]string, suppressed int) map[string]string {
+	merged := maps.Clone(details)
+	if merged == nil {
+		merged = make(map[string]string, 1)
+	}
+	merged["suppressed"] = strconv.Itoa(suppressed)
+	return merged
+}
@@ -0,0 +1,105 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+
+	"mesh-drop/internal/security"
+)
+
+// Problem 验证发现的一处问题
+type Problem struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Seq    uint64 `json:"seq"`
+	Reason string `json:"reason"`
+}
+
+// Report 审计日志的验证结果
+type Report struct {
+	Entries  int       `json:"entries"`
+	LastSeq  uint64    `json:"last_seq"`
+	Problems []Problem `json:"problems"`
+}
+
+// Valid 判断日志是否未被篡改
+func (r Report) Valid() bool {
+	return len(r.Problems) == 0
+}
+
+// VerifyFile 使用 publicKey (base64) 验证审计日志文件，以及之前的轮转文件
+// 出现问题后以该记录自身的哈希继续验证后续记录，以便发现多处篡改
+// 保留的轮转文件已满时，更早的记录已被删除，最早的轮转文件的第一条记录作为哈希链的起点
+func VerifyFile(path, publicKey string) (Report, error) {
+	report := Report{Problems: make([]Problem, 0)}
+	var files []string
+	for n := rotateKeep; n >= 1; n-- {
+		if _, err := os.Stat(rotatedPath(path, n)); err == nil {
+			files = append(files, rotatedPath(path, n))
+		}
+	}
+	files = append(files, path)
+	trimmed := files[0] == rotatedPath(path, rotateKeep)
+
+	var prev *Entry
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			return report, err
+		}
+		err = readEntries(file, func(line int, e Entry, err error) {
+			if err != nil {
+				report.Problems = append(report.Problems, Problem{
+					File:   name,
+					Line:   line,
+					Reason: fmt.Sprintf("invalid record: %v", err),
+				})
+				return
+			}
+			report.Entries++
+			report.LastSeq = e.Seq
+			problem := func(reason string) {
+				report.Problems = append(report.Problems, Problem{
+					File:   name,
+					Line:   line,
+					Seq:    e.Seq,
+					Reason: reason,
+				})
+			}
+
+			expectedSeq, expectedPrev := uint64(1), ""
+			if prev != nil {
+				expectedSeq, expectedPrev = prev.Seq+1, prev.Hash
+			} else if trimmed {
+				expectedSeq, expectedPrev = e.Seq, e.PrevHash
+			}
+			if e.Seq != expectedSeq {
+				problem(fmt.Sprintf("sequence %d, expected %d", e.Seq, expectedSeq))
+			}
+			if e.PrevHash != expectedPrev {
+				problem("previous hash does not match the preceding record")
+			}
+			hash, err := e.computeHash()
+			if err != nil || hash != e.Hash {
+				problem("hash does not match the record content")
+			}
+			ok, err := security.Verify(publicKey, []byte(e.Hash), e.Signature)
+			if err != nil || !ok {
+				problem("invalid signature")
+			}
+			prev = &e
+		})
+		_ = file.Close()
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// Verify 验证审计日志文件
+func (l *Log) Verify() (Report, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return VerifyFile(l.path, l.publicKey)
+}
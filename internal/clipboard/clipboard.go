@@ -0,0 +1,17 @@
+// Package clipboard 读写系统剪贴板中的图片 (PNG)
+// 文本剪贴板由 Wails 提供，这里只补充 Wails 不支持的图片格式
+package clipboard
+
+import "errors"
+
+var (
+	// ErrNoImage 表示剪贴板中没有图片
+	ErrNoImage = errors.New("clipboard does not contain an image")
+	// ErrUnsupported 表示当前平台或环境不支持图片剪贴板
+	ErrUnsupported = errors.New("image clipboard not supported on this platform")
+	// ErrTooLarge 表示剪贴板图片超过 MaxImageSize
+	ErrTooLarge = errors.New("clipboard image too large")
+)
+
+// MaxImageSize 读取剪贴板图片的大小上限
+const MaxImageSize = 32 << 20
@@ -0,0 +1,67 @@
+//go:build darwin
+
+package clipboard
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// macOS 上通过 osascript 以 PNGf 格式读写剪贴板，图片经由临时文件传递
+
+// ReadImage 读取剪贴板中的 PNG 图片
+func ReadImage(ctx context.Context) ([]byte, error) {
+	temp, err := os.CreateTemp("", "mesh-drop-clipboard-*.png")
+	if err != nil {
+		return nil, err
+	}
+	path := temp.Name()
+	_ = temp.Close()
+	defer os.Remove(path)
+
+	script := fmt.Sprintf(`set f to open for access POSIX file %q with write permission
+try
+	write (the clipboard as «class PNGf») to f
+	close access f
+on error
+	close access f
+	error number -1
+end try`, path)
+	// 剪贴板中没有图片时脚本报错
+	if err := exec.CommandContext(ctx, "osascript", "-e", script).Run(); err != nil {
+		return nil, ErrNoImage
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, ErrNoImage
+	}
+	if info.Size() > MaxImageSize {
+		return nil, ErrTooLarge
+	}
+	return os.ReadFile(path)
+}
+
+// WriteImage 将 PNG 图片写入剪贴板
+func WriteImage(ctx context.Context, png []byte) error {
+	temp, err := os.CreateTemp("", "mesh-drop-clipboard-*.png")
+	if err != nil {
+		return err
+	}
+	path := temp.Name()
+	defer os.Remove(path)
+	if _, err := temp.Write(png); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	script := fmt.Sprintf(`set the clipboard to (read (POSIX file %q) as «class PNGf»)`, path)
+	return exec.CommandContext(ctx, "osascript", "-e", script).Run()
+}
@@ -0,0 +1,75 @@
+//go:build linux
+
+package clipboard
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Linux 上通过 wl-clipboard (Wayland) 或 xclip (X11) 访问剪贴板
+
+func wayland() bool {
+	return os.Getenv("WAYLAND_DISPLAY") != ""
+}
+
+// ReadImage 读取剪贴板中的 PNG 图片
+func ReadImage(ctx context.Context) ([]byte, error) {
+	var list, read *exec.Cmd
+	if wayland() {
+		list = exec.CommandContext(ctx, "wl-paste", "--list-types")
+		read = exec.CommandContext(ctx, "wl-paste", "--no-newline", "--type", "image/png")
+	} else {
+		list = exec.CommandContext(ctx, "xclip", "-selection", "clipboard", "-t", "TARGETS", "-o")
+		read = exec.CommandContext(ctx, "xclip", "-selection", "clipboard", "-t", "image/png", "-o")
+	}
+	types, err := list.Output()
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ErrUnsupported
+		}
+		// 剪贴板为空时命令返回非零值
+		return nil, ErrNoImage
+	}
+	if !strings.Contains(string(types), "image/png") {
+		return nil, ErrNoImage
+	}
+	data, err := read.Output()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrNoImage
+	}
+	if len(data) > MaxImageSize {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
+
+// WriteImage 将 PNG 图片写入剪贴板
+// wl-copy 与 xclip 会在后台保持剪贴板内容，命令本身立即返回
+func WriteImage(ctx context.Context, png []byte) error {
+	var cmd *exec.Cmd
+	if wayland() {
+		cmd = exec.CommandContext(ctx, "wl-copy", "--type", "image/png")
+	} else {
+		cmd = exec.CommandContext(ctx, "xclip", "-selection", "clipboard", "-t", "image/png", "-i")
+	}
+	cmd.Stdin = bytes.NewReader(png)
+	if err := cmd.Run(); err != nil {
+		if isNotFound(err) {
+			return ErrUnsupported
+		}
+		return err
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, exec.ErrNotFound)
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !windows
+
+package clipboard
+
+import "context"
+
+// ReadImage 在当前平台上不支持
+func ReadImage(ctx context.Context) ([]byte, error) {
+	return nil, ErrUnsupported
+}
+
+// WriteImage 在当前平台上不支持
+func WriteImage(ctx context.Context, png []byte) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,87 @@
+//go:build windows
+
+package clipboard
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Windows 上通过 PowerShell 调用 System.Windows.Forms.Clipboard，图片经由临时文件传递
+// 剪贴板 API 要求 STA 线程
+
+func powershell(ctx context.Context, script string) error {
+	cmd := exec.CommandContext(
+		ctx,
+		"powershell",
+		"-NoProfile",
+		"-NonInteractive",
+		"-STA",
+		"-Command",
+		script,
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	return cmd.Run()
+}
+
+// psQuote 转义 PowerShell 单引号字符串
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// ReadImage 读取剪贴板中的 PNG 图片
+func ReadImage(ctx context.Context) ([]byte, error) {
+	temp, err := os.CreateTemp("", "mesh-drop-clipboard-*.png")
+	if err != nil {
+		return nil, err
+	}
+	path := temp.Name()
+	_ = temp.Close()
+	defer os.Remove(path)
+
+	script := "Add-Type -AssemblyName System.Windows.Forms, System.Drawing; " +
+		"$img = [System.Windows.Forms.Clipboard]::GetImage(); " +
+		"if ($img -eq $null) { exit 2 }; " +
+		"$img.Save(" + psQuote(path) + ", [System.Drawing.Imaging.ImageFormat]::Png)"
+	if err := powershell(ctx, script); err != nil {
+		return nil, ErrNoImage
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, ErrNoImage
+	}
+	if info.Size() > MaxImageSize {
+		return nil, ErrTooLarge
+	}
+	return os.ReadFile(path)
+}
+
+// WriteImage 将 PNG 图片写入剪贴板
+func WriteImage(ctx context.Context, png []byte) error {
+	temp, err := os.CreateTemp("", "mesh-drop-clipboard-*.png")
+	if err != nil {
+		return err
+	}
+	path := temp.Name()
+	defer os.Remove(path)
+	if _, err := temp.Write(png); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	// 先复制到内存中再释放文件，否则临时文件在进程退出前无法删除
+	script := "Add-Type -AssemblyName System.Windows.Forms, System.Drawing; " +
+		"$file = [System.Drawing.Image]::FromFile(" + psQuote(path) + "); " +
+		"$img = New-Object System.Drawing.Bitmap($file); $file.Dispose(); " +
+		"[System.Windows.Forms.Clipboard]::SetImage($img)"
+	return powershell(ctx, script)
+}
@@ -5,9 +5,12 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"mesh-drop/internal/audit"
 	"mesh-drop/internal/security"
 )
 
@@ -17,6 +20,181 @@ type WindowState struct {
 	Height int `json:"height"`
 }
 
+// FolderPolicy 定义接收文件夹时对元数据的还原策略
+type FolderPolicy struct {
+	Symlinks   bool `json:"symlinks"`   // 还原符号链接 (仅允许指向文件夹内部)
+	HardLinks  bool `json:"hard_links"` // 还原硬链接，关闭时复制为独立文件
+	ModTime    bool `json:"mod_time"`   // 还原修改时间
+	Executable bool `json:"executable"` // 还原可执行权限
+	Xattrs     bool `json:"xattrs"`     // 还原扩展属性 (仅 user 命名空间)
+}
+
+// FolderFilter 定义发送文件夹时的过滤规则
+// 规则使用 gitignore 语法，例如 "node_modules/"、"*.log"、"/build"
+type FolderFilter struct {
+	Include        []string `json:"include"`          // 只发送匹配的文件，为空表示全部发送
+	Exclude        []string `json:"exclude"`          // 排除匹配的文件或目录
+	UseIgnoreFiles bool     `json:"use_ignore_files"` // 遵循目录中的 .gitignore 与 .meshdropignore，并忽略 .git
+}
+
+// ConflictPolicy 定义接收时目标文件已存在的处理方式
+type ConflictPolicy string
+
+const (
+	ConflictPolicyRename    ConflictPolicy = "rename"    // 追加序号，如 "name (1).ext"
+	ConflictPolicyOverwrite ConflictPolicy = "overwrite" // 覆盖已有文件
+	ConflictPolicySkip      ConflictPolicy = "skip"      // 大小与哈希相同时跳过，否则重命名
+	ConflictPolicyAsk       ConflictPolicy = "ask"       // 存在冲突时交由用户决定
+)
+
+// DedupMode 定义接收端已有相同内容时在本地生成文件的方式
+type DedupMode string
+
+const (
+	DedupModeOff      DedupMode = "off"      // 不去重，总是通过网络传输
+	DedupModeCopy     DedupMode = "copy"     // 复制已有文件
+	DedupModeHardLink DedupMode = "hardlink" // 硬链接到已有文件，不占用额外空间
+	DedupModeReflink  DedupMode = "reflink"  // 写时复制，文件系统不支持时回退到复制
+)
+
+// RetryPolicy 定义发送失败后的自动重试策略
+// 第 n 次重试前等待 InitialDelay * 2^(n-1) 秒，最长 MaxDelay 秒
+type RetryPolicy struct {
+	MaxAttempts  int   `json:"max_attempts"`  // 包括首次发送在内的最大尝试次数，1 表示不重试
+	InitialDelay int64 `json:"initial_delay"` // 首次重试前的等待时间 (秒)
+	MaxDelay     int64 `json:"max_delay"`     // 最长等待时间 (秒)
+}
+
+// ClipboardPolicy 定义收到的剪贴板内容何时写入本机剪贴板
+type ClipboardPolicy string
+
+const (
+	ClipboardPolicyNever   ClipboardPolicy = "never"   // 只保存到剪贴板历史
+	ClipboardPolicyTrusted ClipboardPolicy = "trusted" // 来自受信任节点时写入
+	ClipboardPolicyAlways  ClipboardPolicy = "always"  // 总是写入
+)
+
+// ReceiveHook 定义接收完成后运行的命令
+// 命令直接执行，不经过 shell，需要 shell 时可以使用 sh -c
+type ReceiveHook struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	PeerID       string   `json:"peer_id"`       // 为空时匹配所有受信任节点
+	ContentTypes []string `json:"content_types"` // 为空时匹配所有内容类型
+	Pattern      string   `json:"pattern"`       // 文件名 glob，为空时匹配所有
+	Command      string   `json:"command"`
+	Args         []string `json:"args"`
+	Timeout      int      `json:"timeout"` // 秒，0 表示使用默认值
+	// AllowUntrusted 允许未信任或公钥不匹配的节点触发，PeerID 为空时才能设置
+	AllowUntrusted bool `json:"allow_untrusted"`
+}
+
+// AcceptAction 定义接收规则匹配后的处理方式
+type AcceptAction string
+
+const (
+	AcceptActionAccept AcceptAction = "accept" // 自动接收，SavePath 不为空时保存到该目录
+	AcceptActionReject AcceptAction = "reject" // 拒绝并回复 Message
+	AcceptActionAsk    AcceptAction = "ask"    // 询问用户
+)
+
+// AcceptTrust 定义接收规则对节点信任状态的要求
+type AcceptTrust string
+
+const (
+	AcceptTrustAny       AcceptTrust = ""
+	AcceptTrustTrusted   AcceptTrust = "trusted"   // 受信任且公钥匹配
+	AcceptTrustUntrusted AcceptTrust = "untrusted" // 未信任或公钥不匹配
+)
+
+// AcceptRule 定义一条接收规则，按顺序匹配，第一条满足所有条件的规则生效
+// 为空的条件匹配所有请求
+type AcceptRule struct {
+	ID           string      `json:"id"`
+	Name         string      `json:"name"`
+	PeerID       string      `json:"peer_id"` // 设置时 Trust 必须为 trusted
+	Trust        AcceptTrust `json:"trust"`
+	ContentTypes []string    `json:"content_types"`
+	Extensions   []string    `json:"extensions"` // 如 ".png"，不区分大小写
+	MinSize      int64       `json:"min_size"`   // 字节，0 表示不限制
+	MaxSize      int64       `json:"max_size"`   // 字节，0 表示不限制
+	TimeOfDay    *SendWindow `json:"time_of_day,omitempty"`
+	Interfaces   []string    `json:"interfaces"` // 收到请求的本机网卡名称，如 "eth0"
+
+	Action   AcceptAction `json:"action"`
+	SavePath string       `json:"save_path"` // Action 为 accept 时的保存目录，为空时使用默认目录
+	Message  string       `json:"message"`   // Action 为 reject 时回复发送端的消息
+}
+
+// ControlAPI 定义本地控制接口，供脚本与编辑器插件调用
+type ControlAPI struct {
+	Enabled bool `json:"enabled"` // 默认关闭
+	// Address 为空时监听配置目录下的 Unix 套接字，也可以是 127.0.0.1:port
+	Address string `json:"address"`
+}
+
+// SendWindow 定义允许向某个节点发送计划任务的每日时间段 (本地时间)
+// End 早于 Start 时表示跨越午夜，例如 22:00 - 06:00
+type SendWindow struct {
+	Start string `json:"start"` // 格式 15:04
+	End   string `json:"end"`   // 格式 15:04
+}
+
+// Contains 判断 t 是否在时间段内，格式错误时视为全天允许
+func (w SendWindow) Contains(t time.Time) bool {
+	start, err1 := time.Parse("15:04", w.Start)
+	end, err2 := time.Parse("15:04", w.End)
+	if err1 != nil || err2 != nil {
+		return true
+	}
+	minutes := t.Hour()*60 + t.Minute()
+	from := start.Hour()*60 + start.Minute()
+	to := end.Hour()*60 + end.Minute()
+	if from <= to {
+		return minutes >= from && minutes < to
+	}
+	return minutes >= from || minutes < to
+}
+
+// PeerSettings 定义针对单个受信任节点的接收设置
+type PeerSettings struct {
+	// ConflictPolicy 为空时使用全局设置
+	ConflictPolicy ConflictPolicy `json:"conflict_policy,omitempty"`
+	// MaxReceiveSize 单次接收的大小上限 (字节)，0 表示使用全局设置
+	MaxReceiveSize int64 `json:"max_receive_size,omitempty"`
+	// SavePath 该节点内容的默认保存目录，为空时使用全局设置
+	SavePath string `json:"save_path,omitempty"`
+	// SaveTemplate 保存目录下的子目录模板，为空时使用全局设置
+	SaveTemplate string `json:"save_template,omitempty"`
+}
+
+// SyncFolder 定义与受信任节点持续同步的文件夹
+type SyncFolder struct {
+	ID     string `json:"id"`      // 同步文件夹 ID，两端使用相同的 ID
+	Path   string `json:"path"`    // 本地文件夹路径
+	PeerID string `json:"peer_id"` // 同步的受信任节点 ID
+}
+
+// OutboxAction 定义自动发送成功后对源文件的处理方式
+type OutboxAction string
+
+const (
+	OutboxActionKeep   OutboxAction = "keep"   // 保留源文件
+	OutboxActionDelete OutboxAction = "delete" // 删除源文件
+	OutboxActionMove   OutboxAction = "move"   // 移动到 MoveTo 目录
+)
+
+// OutboxRule 定义监视文件夹，新文件会自动发送给指定节点
+type OutboxRule struct {
+	ID        string       `json:"id"`
+	Path      string       `json:"path"`       // 监视的文件夹
+	PeerID    string       `json:"peer_id"`    // 接收节点 ID
+	PublicKey string       `json:"public_key"` // 添加规则时接收节点的公钥，公钥不同时不发送
+	Pattern   string       `json:"pattern"`    // 文件名通配符，如 "*.png"，为空表示所有文件
+	AfterSend OutboxAction `json:"after_send"` // 发送成功后的处理方式
+	MoveTo    string       `json:"move_to"`    // AfterSend 为 move 时的目标目录，为空时使用 Path/sent
+}
+
 var Version = "next"
 
 type Language string
@@ -39,6 +217,36 @@ type configData struct {
 
 	Language       Language `json:"language"`
 	CloseToSystray bool     `json:"close_to_systray"`
+
+	FolderPolicy FolderPolicy `json:"folder_policy"`
+	FolderFilter FolderFilter `json:"folder_filter"`
+
+	// SaveTemplate 保存目录下的子目录模板，如 "{peer}/{yyyy-mm}/{type}"，为空时直接保存
+	SaveTemplate string `json:"save_template"`
+
+	ConflictPolicy ConflictPolicy          `json:"conflict_policy"`
+	PeerSettings   map[string]PeerSettings `json:"peer_settings"` // ID -> PeerSettings
+
+	MaxReceiveSize int64 `json:"max_receive_size"` // 单次接收的大小上限 (字节)，0 表示不限制
+	DailyQuota     int64 `json:"daily_quota"`      // 每日接收总量上限 (字节)，0 表示不限制
+
+	DedupMode DedupMode `json:"dedup_mode"` // 只对受信任节点生效，默认关闭
+
+	RetryPolicy RetryPolicy `json:"retry_policy"`
+
+	SendWindows map[string]SendWindow `json:"send_windows"` // ID -> SendWindow
+
+	ClipboardPolicy    ClipboardPolicy `json:"clipboard_policy"`
+	ClipboardSyncPeers []string        `json:"clipboard_sync_peers"` // 自动双向同步剪贴板的节点 ID
+
+	ControlAPI ControlAPI `json:"control_api"`
+
+	ReceiveHooks []ReceiveHook `json:"receive_hooks"`
+
+	AcceptRules []AcceptRule `json:"accept_rules"`
+
+	SyncFolders []SyncFolder `json:"sync_folders"`
+	OutboxRules []OutboxRule `json:"outbox_rules"`
 }
 
 type Config struct {
@@ -65,7 +273,11 @@ func GetUserHomeDir() string {
 
 // New 读取配置
 func Load(defaultState WindowState) *Config {
-	configDir := GetConfigDir()
+	return LoadFrom(GetConfigDir(), defaultState)
+}
+
+// LoadFrom 从 configDir 读取配置
+func LoadFrom(configDir string, defaultState WindowState) *Config {
 	_ = os.MkdirAll(configDir, 0o750)
 	configFile := filepath.Join(configDir, "config.json")
 
@@ -77,15 +289,31 @@ func Load(defaultState WindowState) *Config {
 	}
 
 	cfgData := configData{
-		WindowState:    defaultState,
-		SavePath:       defaultSavePath,
-		AutoAccept:     false,
-		SaveHistory:    true,
-		Language:       LanguageEnglish,
-		CloseToSystray: false,
-		ID:             uuid.New().String(),
-		HostName:       defaultHostName,
-		TrustedPeer:    make(map[string]string),
+		WindowState:     defaultState,
+		SavePath:        defaultSavePath,
+		AutoAccept:      false,
+		SaveHistory:     true,
+		Language:        LanguageEnglish,
+		CloseToSystray:  false,
+		ID:              uuid.New().String(),
+		HostName:        defaultHostName,
+		TrustedPeer:     make(map[string]string),
+		ConflictPolicy:  ConflictPolicyRename,
+		PeerSettings:    make(map[string]PeerSettings),
+		DedupMode:       DedupModeOff,
+		ClipboardPolicy: ClipboardPolicyTrusted,
+		RetryPolicy: RetryPolicy{
+			MaxAttempts:  5,
+			InitialDelay: 2,
+			MaxDelay:     300,
+		},
+		FolderPolicy: FolderPolicy{
+			Symlinks:   true,
+			HardLinks:  true,
+			ModTime:    true,
+			Executable: true,
+			Xattrs:     false,
+		},
 	}
 
 	fileBytes, err := os.ReadFile(
@@ -130,6 +358,10 @@ func Load(defaultState WindowState) *Config {
 		config.data.TrustedPeer = make(map[string]string)
 	}
 
+	if config.data.PeerSettings == nil {
+		config.data.PeerSettings = make(map[string]PeerSettings)
+	}
+
 	// 保存
 	if err := config.Save(); err != nil {
 		slog.Error("Failed to save config", "error", err)
@@ -193,6 +425,18 @@ func (c *Config) GetSavePath() string {
 	return c.data.SavePath
 }
 
+func (c *Config) SetSaveTemplate(template string) {
+	c.update(func() {
+		c.data.SaveTemplate = template
+	})
+}
+
+func (c *Config) GetSaveTemplate() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.data.SaveTemplate
+}
+
 func (c *Config) SetHostName(hostName string) {
 	c.update(func() {
 		c.data.HostName = hostName
@@ -258,6 +502,12 @@ func (c *Config) AddTrust(peerID string, publicKey string) {
 		}
 		c.data.TrustedPeer[peerID] = publicKey
 	})
+	audit.Record(audit.Event{
+		Kind:    audit.KindTrustAdded,
+		PeerID:  peerID,
+		Message: "Peer added to trusted list",
+		Details: map[string]string{"fingerprint": security.Fingerprint(publicKey)},
+	})
 }
 
 func (c *Config) GetTrusted() map[string]string {
@@ -267,9 +517,20 @@ func (c *Config) GetTrusted() map[string]string {
 }
 
 func (c *Config) RemoveTrust(peerID string) {
+	var publicKey string
+	var existed bool
 	c.update(func() {
+		publicKey, existed = c.data.TrustedPeer[peerID]
 		delete(c.data.TrustedPeer, peerID)
 	})
+	if existed {
+		audit.Record(audit.Event{
+			Kind:    audit.KindTrustRemoved,
+			PeerID:  peerID,
+			Message: "Peer removed from trusted list",
+			Details: map[string]string{"fingerprint": security.Fingerprint(publicKey)},
+		})
+	}
 }
 
 func (c *Config) IsTrusted(peerID string) bool {
@@ -314,3 +575,284 @@ func (c *Config) GetPublicKey() string {
 	defer c.mu.RUnlock()
 	return c.data.PublicKey
 }
+
+func (c *Config) SetFolderPolicy(policy FolderPolicy) {
+	c.update(func() {
+		c.data.FolderPolicy = policy
+	})
+}
+
+func (c *Config) GetFolderPolicy() FolderPolicy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.data.FolderPolicy
+}
+
+func (c *Config) SetFolderFilter(filter FolderFilter) {
+	c.update(func() {
+		c.data.FolderFilter = filter
+	})
+}
+
+func (c *Config) GetFolderFilter() FolderFilter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.data.FolderFilter
+}
+
+func (c *Config) SetConflictPolicy(policy ConflictPolicy) {
+	c.update(func() {
+		c.data.ConflictPolicy = policy
+	})
+}
+
+func (c *Config) GetConflictPolicy() ConflictPolicy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.data.ConflictPolicy
+}
+
+func (c *Config) SetPeerSettings(peerID string, settings PeerSettings) {
+	c.update(func() {
+		if c.data.PeerSettings == nil {
+			c.data.PeerSettings = make(map[string]PeerSettings)
+		}
+		c.data.PeerSettings[peerID] = settings
+	})
+}
+
+func (c *Config) GetPeerSettings(peerID string) (PeerSettings, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	settings, ok := c.data.PeerSettings[peerID]
+	return settings, ok
+}
+
+func (c *Config) RemovePeerSettings(peerID string) {
+	c.update(func() {
+		delete(c.data.PeerSettings, peerID)
+	})
+}
+
+func (c *Config) SetMaxReceiveSize(size int64) {
+	c.update(func() {
+		c.data.MaxReceiveSize = size
+	})
+}
+
+func (c *Config) GetMaxReceiveSize() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.data.MaxReceiveSize
+}
+
+func (c *Config) SetDailyQuota(quota int64) {
+	c.update(func() {
+		c.data.DailyQuota = quota
+	})
+}
+
+func (c *Config) GetDailyQuota() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.data.DailyQuota
+}
+
+func (c *Config) SetDedupMode(mode DedupMode) {
+	c.update(func() {
+		c.data.DedupMode = mode
+	})
+}
+
+func (c *Config) GetDedupMode() DedupMode {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.data.DedupMode
+}
+
+func (c *Config) SetRetryPolicy(policy RetryPolicy) {
+	c.update(func() {
+		c.data.RetryPolicy = policy
+	})
+}
+
+func (c *Config) GetRetryPolicy() RetryPolicy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.data.RetryPolicy
+}
+
+func (c *Config) SetSendWindow(peerID string, window SendWindow) {
+	c.update(func() {
+		if c.data.SendWindows == nil {
+			c.data.SendWindows = make(map[string]SendWindow)
+		}
+		c.data.SendWindows[peerID] = window
+	})
+}
+
+func (c *Config) GetSendWindow(peerID string) (SendWindow, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	window, ok := c.data.SendWindows[peerID]
+	return window, ok
+}
+
+func (c *Config) RemoveSendWindow(peerID string) {
+	c.update(func() {
+		delete(c.data.SendWindows, peerID)
+	})
+}
+
+func (c *Config) SetClipboardPolicy(policy ClipboardPolicy) {
+	c.update(func() {
+		c.data.ClipboardPolicy = policy
+	})
+}
+
+func (c *Config) GetClipboardPolicy() ClipboardPolicy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.data.ClipboardPolicy
+}
+
+// SetClipboardSync 开启或关闭与节点的剪贴板自动同步
+func (c *Config) SetClipboardSync(peerID string, enabled bool) {
+	c.update(func() {
+		c.data.ClipboardSyncPeers = slices.DeleteFunc(c.data.ClipboardSyncPeers, func(id string) bool {
+			return id == peerID
+		})
+		if enabled {
+			c.data.ClipboardSyncPeers = append(c.data.ClipboardSyncPeers, peerID)
+		}
+	})
+}
+
+func (c *Config) GetClipboardSyncPeers() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Clone(c.data.ClipboardSyncPeers)
+}
+
+func (c *Config) IsClipboardSync(peerID string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Contains(c.data.ClipboardSyncPeers, peerID)
+}
+
+func (c *Config) SetControlAPI(api ControlAPI) {
+	c.update(func() {
+		c.data.ControlAPI = api
+	})
+}
+
+func (c *Config) GetControlAPI() ControlAPI {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.data.ControlAPI
+}
+
+// SetReceiveHook 添加或更新接收后命令
+func (c *Config) SetReceiveHook(hook ReceiveHook) {
+	c.update(func() {
+		for i, h := range c.data.ReceiveHooks {
+			if h.ID == hook.ID {
+				c.data.ReceiveHooks[i] = hook
+				return
+			}
+		}
+		c.data.ReceiveHooks = append(c.data.ReceiveHooks, hook)
+	})
+}
+
+func (c *Config) GetReceiveHooks() []ReceiveHook {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Clone(c.data.ReceiveHooks)
+}
+
+func (c *Config) RemoveReceiveHook(id string) {
+	c.update(func() {
+		c.data.ReceiveHooks = slices.DeleteFunc(c.data.ReceiveHooks, func(h ReceiveHook) bool {
+			return h.ID == id
+		})
+	})
+}
+
+// SetAcceptRules 替换全部接收规则，规则按列表顺序匹配
+func (c *Config) SetAcceptRules(rules []AcceptRule) {
+	c.update(func() {
+		c.data.AcceptRules = slices.Clone(rules)
+	})
+}
+
+func (c *Config) GetAcceptRules() []AcceptRule {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Clone(c.data.AcceptRules)
+}
+
+// SetSyncFolder 添加或更新同步文件夹
+func (c *Config) SetSyncFolder(folder SyncFolder) {
+	c.update(func() {
+		for i, f := range c.data.SyncFolders {
+			if f.ID == folder.ID {
+				c.data.SyncFolders[i] = folder
+				return
+			}
+		}
+		c.data.SyncFolders = append(c.data.SyncFolders, folder)
+	})
+}
+
+func (c *Config) GetSyncFolders() []SyncFolder {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Clone(c.data.SyncFolders)
+}
+
+func (c *Config) GetSyncFolder(id string) (SyncFolder, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, f := range c.data.SyncFolders {
+		if f.ID == id {
+			return f, true
+		}
+	}
+	return SyncFolder{}, false
+}
+
+func (c *Config) RemoveSyncFolder(id string) {
+	c.update(func() {
+		c.data.SyncFolders = slices.DeleteFunc(c.data.SyncFolders, func(f SyncFolder) bool {
+			return f.ID == id
+		})
+	})
+}
+
+// SetOutboxRule 添加或更新监视文件夹规则
+func (c *Config) SetOutboxRule(rule OutboxRule) {
+	c.update(func() {
+		for i, r := range c.data.OutboxRules {
+			if r.ID == rule.ID {
+				c.data.OutboxRules[i] = rule
+				return
+			}
+		}
+		c.data.OutboxRules = append(c.data.OutboxRules, rule)
+	})
+}
+
+func (c *Config) GetOutboxRules() []OutboxRule {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Clone(c.data.OutboxRules)
+}
+
+func (c *Config) RemoveOutboxRule(id string) {
+	c.update(func() {
+		c.data.OutboxRules = slices.DeleteFunc(c.data.OutboxRules, func(r OutboxRule) bool {
+			return r.ID == id
+		})
+	})
+}
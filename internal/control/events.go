@@ -0,0 +1,121 @@
+package control
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type eventKind int
+
+const (
+	eventPeers eventKind = iota
+	eventTransfers
+)
+
+// eventKeepAlive 事件流的心跳间隔，避免空闲连接被代理或客户端断开
+const eventKeepAlive = 30 * time.Second
+
+// eventClient 是一个事件流连接
+// 每类事件使用容量为 1 的通道，发送较慢时多次变化合并为一次，发送时总是读取最新状态
+type eventClient struct {
+	peers     chan struct{}
+	transfers chan struct{}
+	done      chan struct{}
+}
+
+type eventHub struct {
+	mu      sync.Mutex
+	clients map[*eventClient]struct{}
+	closed  bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{clients: make(map[*eventClient]struct{})}
+}
+
+func (h *eventHub) subscribe() *eventClient {
+	client := &eventClient{
+		peers:     make(chan struct{}, 1),
+		transfers: make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(client.done)
+		return client
+	}
+	h.clients[client] = struct{}{}
+	return client
+}
+
+func (h *eventHub) unsubscribe(client *eventClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, client)
+}
+
+func (h *eventHub) publish(kind eventKind) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		ch := client.peers
+		if kind == eventTransfers {
+			ch = client.transfers
+		}
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// close 结束所有事件流
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for client := range h.clients {
+		close(client.done)
+		delete(h.clients, client)
+	}
+}
+
+// handleEvents 以 server-sent events 推送节点列表与传输列表
+// 连接后立即发送一次当前状态，之后每次变化发送完整列表
+func (s *Server) handleEvents(c *gin.Context) {
+	client := s.events.subscribe()
+	defer s.events.unsubscribe(client)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	c.SSEvent("peers", s.discovery.GetPeers())
+	c.SSEvent("transfers", s.transfer.GetTransferList())
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-client.done:
+			return
+		case <-client.peers:
+			c.SSEvent("peers", s.discovery.GetPeers())
+		case <-client.transfers:
+			c.SSEvent("transfers", s.transfer.GetTransferList())
+		case <-ticker.C:
+			if _, err := c.Writer.WriteString(": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
@@ -0,0 +1,448 @@
+// Package control 提供仅限本机访问的控制接口，供脚本与编辑器插件调用
+//
+// 默认监听配置目录下的 Unix 套接字，也可以配置为 127.0.0.1 上的端口。
+// 所有请求需要携带配置目录下 control_token 文件中的令牌：
+//
+//	Authorization: Bearer <token>
+//
+// 无法设置请求头的客户端 (如 EventSource) 订阅 /v1/events 时可以使用 ?token=<token>。
+// 控制接口默认关闭，需要在设置中启用。
+package control
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"mesh-drop/internal/audit"
+	"mesh-drop/internal/config"
+	"mesh-drop/internal/discovery"
+	"mesh-drop/internal/platform"
+	"mesh-drop/internal/transfer"
+)
+
+type Server struct {
+	config *config.Config
+	// configDir 是令牌与套接字文件所在的目录
+	configDir string
+	bus       platform.EventBus
+	discovery *discovery.Service
+	transfer  *transfer.Service
+
+	token  string
+	server *http.Server
+	socket string // 监听 Unix 套接字时的路径，关闭时删除
+	events *eventHub
+	// listeners 用于取消订阅界面事件
+	listeners []func()
+}
+
+// errorResponse 请求失败时的回应
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// sendRequest /v1/send 的请求
+type sendRequest struct {
+	PeerID string `json:"peer_id" binding:"required"`
+	// ContentType 为空时根据 Value 指向的路径判断是文件还是文件夹
+	ContentType transfer.ContentType `json:"content_type"`
+	Value       string               `json:"value"`
+}
+
+// resolveRequest /v1/transfers/:id/resolve 的请求
+type resolveRequest struct {
+	Accept         bool                  `json:"accept"`
+	SavePath       string                `json:"save_path"`
+	ConflictPolicy config.ConflictPolicy `json:"conflict_policy"`
+}
+
+func NewServer(
+	config *config.Config,
+	configDir string,
+	bus platform.EventBus,
+	discoveryService *discovery.Service,
+	transferService *transfer.Service,
+) *Server {
+	return &Server{
+		config:    config,
+		configDir: configDir,
+		bus:       bus,
+		discovery: discoveryService,
+		transfer:  transferService,
+		events:    newEventHub(),
+	}
+}
+
+func (s *Server) tokenPath() string {
+	return filepath.Join(s.configDir, "control_token")
+}
+
+func (s *Server) socketPath() string {
+	return filepath.Join(s.configDir, "control.sock")
+}
+
+// loadToken 读取令牌，不存在时生成新的令牌
+func (s *Server) loadToken() (string, error) {
+	data, err := os.ReadFile(s.tokenPath())
+	if err == nil {
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.WriteFile(s.tokenPath(), []byte(token+"\n"), 0o600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// listen 按配置监听 Unix 套接字或本机回环地址，拒绝其他地址
+func (s *Server) listen(address string) (net.Listener, error) {
+	if address == "" {
+		path := s.socketPath()
+		// 清理上次运行遗留的套接字
+		_ = os.Remove(path)
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0o600); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+		s.socket = path
+		return listener, nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("control API must listen on a loopback address, got %s", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// Start 按配置启动控制接口，未启用时直接返回
+func (s *Server) Start() error {
+	api := s.config.GetControlAPI()
+	if !api.Enabled {
+		return nil
+	}
+
+	token, err := s.loadToken()
+	if err != nil {
+		return err
+	}
+	s.token = token
+
+	listener, err := s.listen(api.Address)
+	if err != nil {
+		return err
+	}
+
+	r := gin.New()
+	r.Use(gin.Recovery())
+	v1 := r.Group("/v1", s.requireToken)
+	{
+		v1.GET("/peers", s.handlePeers)
+		v1.POST("/send", s.handleSend)
+		v1.GET("/transfers", s.handleTransfers)
+		v1.GET("/transfers/:id", s.handleTransfer)
+		v1.GET("/history", s.handleHistory)
+		v1.GET("/history/export", s.handleExportHistory)
+		v1.POST("/history/import", s.handleImportHistory)
+		v1.POST("/transfers/:id/cancel", s.handleCancel)
+		v1.POST("/transfers/:id/resolve", s.handleResolve)
+		v1.GET("/trust", s.handleTrusted)
+		v1.PUT("/trust/:id", s.handleTrust)
+		v1.DELETE("/trust/:id", s.handleUntrust)
+		v1.GET("/events", s.handleEvents)
+		v1.GET("/audit", s.handleAudit)
+	}
+
+	// 转发界面事件到事件流
+	s.listeners = append(s.listeners,
+		s.bus.On("peers:update", func(any) {
+			s.events.publish(eventPeers)
+		}),
+		s.bus.On("transfer:refreshList", func(any) {
+			s.events.publish(eventTransfers)
+		}),
+	)
+
+	s.server = &http.Server{
+		Handler:           r,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Control API error", "error", err, "component", "control")
+		}
+	}()
+	slog.Info("Control API listening", "address", listener.Addr().String(), "component", "control")
+	return nil
+}
+
+// Stop 关闭控制接口与所有事件流
+func (s *Server) Stop() {
+	for _, unsubscribe := range s.listeners {
+		unsubscribe()
+	}
+	s.listeners = nil
+	if s.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.events.close()
+	_ = s.server.Shutdown(ctx)
+	if s.socket != "" {
+		_ = os.Remove(s.socket)
+	}
+}
+
+func (s *Server) requireToken(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	// 只有事件流允许在查询参数中携带令牌，其他请求的 URL 可能出现在日志与历史记录中
+	if token == "" && c.FullPath() == "/v1/events" {
+		token = c.Query("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		audit.Record(audit.Event{
+			Kind:    audit.KindControlTokenDenied,
+			IP:      c.ClientIP(),
+			Message: "Control API request with invalid token",
+			Details: map[string]string{"path": c.Request.URL.Path},
+		})
+		c.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse{Error: "invalid token"})
+		return
+	}
+	c.Next()
+}
+
+func (s *Server) handlePeers(c *gin.Context) {
+	c.JSON(http.StatusOK, s.discovery.GetPeers())
+}
+
+func (s *Server) handleSend(c *gin.Context) {
+	var req sendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	if req.ContentType == "" {
+		info, err := os.Stat(req.Value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		req.ContentType = transfer.ContentTypeFile
+		if info.IsDir() {
+			req.ContentType = transfer.ContentTypeFolder
+		}
+	}
+
+	task, err := s.transfer.SendTo(req.PeerID, req.ContentType, req.Value)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, task)
+}
+
+func (s *Server) handleTransfers(c *gin.Context) {
+	c.JSON(http.StatusOK, s.transfer.GetTransferList())
+}
+
+// handleHistory 按条件分页查询传输列表
+// 参数: peer, status, type (可重复), since, until (毫秒), q, offset, limit
+func (s *Server) handleHistory(c *gin.Context) {
+	query, err := parseTransferQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s.transfer.QueryTransfers(query))
+}
+
+// handleExportHistory 导出满足条件的传输记录，format 为 csv、jsonl 或 html
+func (s *Server) handleExportHistory(c *gin.Context) {
+	query, err := parseTransferQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	format := transfer.HistoryFormat(c.DefaultQuery("format", string(transfer.HistoryFormatJSONL)))
+	contentType, ok := map[transfer.HistoryFormat]string{
+		transfer.HistoryFormatCSV:   "text/csv; charset=utf-8",
+		transfer.HistoryFormatJSONL: "application/x-ndjson",
+		transfer.HistoryFormatHTML:  "text/html; charset=utf-8",
+	}[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, errorResponse{Error: "unsupported format"})
+		return
+	}
+	c.Header("Content-Type", contentType)
+	c.Status(http.StatusOK)
+	if err := s.transfer.WriteHistory(c.Writer, format, query); err != nil {
+		slog.Error("Failed to export history", "error", err, "component", "control")
+	}
+}
+
+// handleImportHistory 导入请求体中的历史，format 为 csv 或 jsonl
+func (s *Server) handleImportHistory(c *gin.Context) {
+	format := transfer.HistoryFormat(c.DefaultQuery("format", string(transfer.HistoryFormatJSONL)))
+	n, err := s.transfer.ReadHistory(c.Request.Body, format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"imported": n})
+}
+
+// parseTransferQuery 读取查询参数
+func parseTransferQuery(c *gin.Context) (transfer.TransferQuery, error) {
+	query := transfer.TransferQuery{
+		PeerID: c.Query("peer"),
+		Search: c.Query("q"),
+	}
+	for _, status := range c.QueryArray("status") {
+		query.Statuses = append(query.Statuses, transfer.TransferStatus(status))
+	}
+	for _, contentType := range c.QueryArray("type") {
+		query.ContentTypes = append(query.ContentTypes, transfer.ContentType(contentType))
+	}
+	var offset, limit int64
+	for key, dest := range map[string]*int64{
+		"since":  &query.Since,
+		"until":  &query.Until,
+		"offset": &offset,
+		"limit":  &limit,
+	} {
+		n, err := queryInt(c, key)
+		if err != nil {
+			return transfer.TransferQuery{}, err
+		}
+		*dest = n
+	}
+	query.Offset, query.Limit = int(offset), int(limit)
+	return query, nil
+}
+
+// queryInt 读取整数参数，未提供时返回 0
+func queryInt(c *gin.Context, key string) (int64, error) {
+	value := c.Query(key)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %q", key, value)
+	}
+	return n, nil
+}
+
+func (s *Server) handleTransfer(c *gin.Context) {
+	task, ok := s.transfer.GetTransfer(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, errorResponse{Error: "transfer not found"})
+		return
+	}
+	c.JSON(http.StatusOK, task)
+}
+
+func (s *Server) handleCancel(c *gin.Context) {
+	if _, ok := s.transfer.GetTransfer(c.Param("id")); !ok {
+		c.JSON(http.StatusNotFound, errorResponse{Error: "transfer not found"})
+		return
+	}
+	s.transfer.CancelTransfer(c.Param("id"))
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) handleResolve(c *gin.Context) {
+	var req resolveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	task, ok := s.transfer.GetTransfer(c.Param("id"))
+	if !ok || task.Type != transfer.TransferTypeReceive ||
+		task.Status != transfer.TransferStatusPending {
+		c.JSON(http.StatusNotFound, errorResponse{Error: "no pending request with this id"})
+		return
+	}
+	resolved := s.transfer.ResolvePendingDecision(transfer.Decision{
+		ID:             task.ID,
+		Accepted:       req.Accept,
+		SavePath:       req.SavePath,
+		ConflictPolicy: req.ConflictPolicy,
+	})
+	if !resolved {
+		c.JSON(http.StatusConflict, errorResponse{Error: "request already resolved"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) handleTrusted(c *gin.Context) {
+	c.JSON(http.StatusOK, maps.Clone(s.config.GetTrusted()))
+}
+
+// handleTrust 信任在线节点当前的公钥
+func (s *Server) handleTrust(c *gin.Context) {
+	peer, ok := s.discovery.GetPeerByID(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, errorResponse{Error: "peer not found"})
+		return
+	}
+	s.config.AddTrust(peer.ID, peer.PublicKey)
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) handleUntrust(c *gin.Context) {
+	s.config.RemoveTrust(c.Param("id"))
+	c.Status(http.StatusNoContent)
+}
+
+// handleAudit 返回最近的安全事件，limit 默认为 100
+func (s *Server) handleAudit(c *gin.Context) {
+	limit, err := queryInt(c, "limit")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	if limit == 0 {
+		limit = 100
+	}
+	log := audit.Default()
+	if log == nil {
+		c.JSON(http.StatusOK, []audit.Entry{})
+		return
+	}
+	c.JSON(http.StatusOK, log.Recent(int(limit)))
+}
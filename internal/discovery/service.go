@@ -10,8 +10,9 @@ import (
 	"sync"
 	"time"
 
-	"github.com/wailsapp/wails/v3/pkg/application"
+	"mesh-drop/internal/audit"
 	"mesh-drop/internal/config"
+	"mesh-drop/internal/platform"
 	"mesh-drop/internal/security"
 )
 
@@ -22,7 +23,8 @@ const (
 )
 
 type Service struct {
-	app *application.App
+	// events 为 nil 时不发送界面事件
+	events platform.EventBus
 
 	ID             string
 	config         *config.Config
@@ -33,11 +35,15 @@ type Service struct {
 	peersMutex sync.RWMutex
 
 	self Peer
+
+	// peerSeenHandlers 在每次收到节点心跳后调用
+	peerSeenHandlers []func(Peer)
+	handlersMutex    sync.RWMutex
 }
 
-func NewService(config *config.Config, app *application.App, port int) *Service {
+func NewService(config *config.Config, events platform.EventBus, port int) *Service {
 	return &Service{
-		app:            app,
+		events:         events,
 		ID:             config.GetID(),
 		config:         config,
 		FileServerPort: port,
@@ -274,6 +280,8 @@ func (s *Service) handleHeartbeat(pkt PresencePacket, ip string, trustMismatch b
 	s.peersMutex.Lock()
 
 	peer, exists := s.peers[pkt.ID]
+	// 只在首次发现不匹配时写入审计日志，之后的心跳不再重复记录
+	newMismatch := trustMismatch && (!exists || !peer.TrustMismatch)
 	if !exists {
 		// 发现新节点
 		peer = &Peer{
@@ -308,10 +316,47 @@ func (s *Service) handleHeartbeat(pkt PresencePacket, ip string, trustMismatch b
 		peer.TrustMismatch = peer.TrustMismatch || trustMismatch
 	}
 
+	seen := *peer.DeepCopy()
 	s.peersMutex.Unlock()
 
+	if newMismatch {
+		audit.Record(audit.Event{
+			Kind:     audit.KindTrustMismatch,
+			PeerID:   pkt.ID,
+			PeerName: pkt.Name,
+			IP:       ip,
+			Message:  "Peer public key does not match the trusted key",
+			Details: map[string]string{
+				"known_fingerprint":    security.Fingerprint(s.config.GetTrusted()[pkt.ID]),
+				"received_fingerprint": security.Fingerprint(pkt.PublicKey),
+			},
+		})
+	}
+
 	// 触发前端更新 (防抖逻辑可以之后加，这里每次变动都推)
-	s.app.Event.Emit("peers:update", s.GetPeers())
+	s.notifyPeersUpdate()
+
+	s.handlersMutex.RLock()
+	for _, handler := range s.peerSeenHandlers {
+		handler(seen)
+	}
+	s.handlersMutex.RUnlock()
+}
+
+func (s *Service) notifyPeersUpdate() {
+	// 命令行模式下没有界面
+	if s.events == nil {
+		return
+	}
+	s.events.Emit("peers:update", s.GetPeers())
+}
+
+// OnPeerSeen 注册节点心跳回调，每次收到心跳都会调用
+// 回调在监听协程中执行，不能阻塞
+func (s *Service) OnPeerSeen(handler func(Peer)) {
+	s.handlersMutex.Lock()
+	defer s.handlersMutex.Unlock()
+	s.peerSeenHandlers = append(s.peerSeenHandlers, handler)
 }
 
 // 3. 掉线清理协程
@@ -340,7 +385,7 @@ func (s *Service) startCleanup() {
 		s.peersMutex.Unlock()
 
 		if changed {
-			s.app.Event.Emit("peers:update", s.GetPeers())
+			s.notifyPeersUpdate()
 		}
 	}
 }
@@ -0,0 +1,26 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// FreeSpace 返回 path 所在文件系统中当前用户可用的字节数
+// path 不存在时使用最近的已存在的上级目录
+func FreeSpace(path string) (uint64, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			break
+		}
+		path = parent
+	}
+	return freeSpace(path)
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package fsutil
+
+import "golang.org/x/sys/unix"
+
+func freeSpace(path string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	//nolint:unconvert // 字段类型因平台而异
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package fsutil
+
+import "os"
+
+// FileID 在不支持 inode 的平台上始终返回 false
+func FileID(info os.FileInfo) (FileKey, uint64, bool) {
+	return FileKey{}, 0, false
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package fsutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// FileID 返回文件的设备号、inode 以及硬链接数
+// 用于在遍历目录时识别指向同一份数据的硬链接
+func FileID(info os.FileInfo) (FileKey, uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileKey{}, 0, false
+	}
+	//nolint:unconvert // 字段类型因平台而异
+	return FileKey{Dev: uint64(st.Dev), Ino: uint64(st.Ino)}, uint64(st.Nlink), true
+}
@@ -0,0 +1,13 @@
+// Package fsutil 封装与平台相关的文件系统操作
+package fsutil
+
+import "errors"
+
+// ErrUnsupported 表示当前平台不支持该操作
+var ErrUnsupported = errors.New("operation not supported on this platform")
+
+// FileKey 唯一标识一个文件系统对象 (设备号 + inode)
+type FileKey struct {
+	Dev uint64
+	Ino uint64
+}
@@ -0,0 +1,15 @@
+//go:build !unix && !windows
+
+package fsutil
+
+import "os"
+
+// LockFile 在当前平台上不支持
+func LockFile(f *os.File) error {
+	return ErrUnsupported
+}
+
+// UnlockFile 在当前平台上不支持
+func UnlockFile(f *os.File) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package fsutil
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// LockFile 对文件加排他锁，其他进程持有锁时阻塞
+// 锁只在进程之间互斥，同一进程内需要另外加锁
+func LockFile(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_EX) //nolint:gosec
+}
+
+// UnlockFile 释放 LockFile 加的锁
+func UnlockFile(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_UN) //nolint:gosec
+}
@@ -0,0 +1,34 @@
+//go:build windows
+
+package fsutil
+
+import (
+	"math"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// LockFile 对文件加排他锁，其他进程持有锁时阻塞
+// 锁只在进程之间互斥，同一进程内需要另外加锁
+func LockFile(f *os.File) error {
+	return windows.LockFileEx(
+		windows.Handle(f.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK,
+		0,
+		math.MaxUint32,
+		math.MaxUint32,
+		new(windows.Overlapped),
+	)
+}
+
+// UnlockFile 释放 LockFile 加的锁
+func UnlockFile(f *os.File) error {
+	return windows.UnlockFileEx(
+		windows.Handle(f.Fd()),
+		0,
+		math.MaxUint32,
+		math.MaxUint32,
+		new(windows.Overlapped),
+	)
+}
@@ -0,0 +1,10 @@
+//go:build darwin
+
+package fsutil
+
+import "golang.org/x/sys/unix"
+
+// Reflink 使用 clonefile 创建与 src 共享数据块的副本 dst (APFS)
+func Reflink(src, dst string) error {
+	return unix.Clonefile(src, dst, 0)
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package fsutil
+
+// Reflink 在当前平台上不支持
+func Reflink(src, dst string) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package fsutil
+
+import "os"
+
+// SyncDir 将目录项落盘，使目录中新建、重命名的文件在崩溃后仍然存在
+func SyncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
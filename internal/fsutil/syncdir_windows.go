@@ -0,0 +1,8 @@
+//go:build windows
+
+package fsutil
+
+// SyncDir 在 Windows 上不需要，NTFS 的元数据由日志保证
+func SyncDir(path string) error {
+	return nil
+}
@@ -0,0 +1,59 @@
+//go:build linux
+
+package fsutil
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrPrefix 只处理 user 命名空间，其他命名空间需要特权且与安全策略相关
+const xattrPrefix = "user."
+
+// ListXattrs 读取文件 (不跟随符号链接) 的 user 命名空间扩展属性
+func ListXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string]string)
+	for name := range bytes.SplitSeq(buf[:size], []byte{0}) {
+		if len(name) == 0 || !strings.HasPrefix(string(name), xattrPrefix) {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(path, string(name), nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, vsize)
+		vsize, err = unix.Lgetxattr(path, string(name), value)
+		if err != nil {
+			continue
+		}
+		attrs[string(name)] = string(value[:vsize])
+	}
+	return attrs, nil
+}
+
+// SetXattr 设置文件 (不跟随符号链接) 的扩展属性，只允许 user 命名空间
+func SetXattr(path string, name string, value string) error {
+	if !strings.HasPrefix(name, xattrPrefix) {
+		return ErrUnsupported
+	}
+	return unix.Lsetxattr(path, name, []byte(value), 0)
+}
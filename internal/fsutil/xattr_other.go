@@ -0,0 +1,13 @@
+//go:build !linux
+
+package fsutil
+
+// ListXattrs 在非 Linux 平台上不读取扩展属性
+func ListXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+// SetXattr 在非 Linux 平台上不支持
+func SetXattr(path string, name string, value string) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,33 @@
+// Package platform 定义服务依赖的桌面环境功能
+//
+// 图形界面模式下由 Wails 实现，服务本身不依赖 Wails，
+// 命令行模式下这些依赖为 nil，测试中可以使用内存中的实现。
+package platform
+
+// EventBus 向界面发送事件，并订阅其他服务发送的事件
+type EventBus interface {
+	Emit(name string, data ...any)
+	// On 订阅事件，返回的函数用于取消订阅
+	On(name string, handler func(data any)) func()
+}
+
+// Notification 系统通知的内容
+type Notification struct {
+	ID       string
+	Title    string
+	Subtitle string
+	Body     string
+	Data     map[string]any
+}
+
+// Notifier 发送系统通知
+type Notifier interface {
+	SendNotification(notification Notification) error
+}
+
+// Desktop 剪贴板文本与浏览器
+type Desktop interface {
+	ClipboardText() (string, bool)
+	SetClipboardText(text string) bool
+	OpenURL(url string) error
+}
@@ -3,7 +3,9 @@ package security
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 )
 
@@ -54,3 +56,14 @@ func Verify(pubKeyStr string, data []byte, sigStr string) (bool, error) {
 
 	return ed25519.Verify(ed25519.PublicKey(pubKeyBytes), data, sigBytes), nil
 }
+
+// Fingerprint 返回公钥的 SHA-256 指纹 (hex)，用于人工核对身份
+// pubKeyStr: base64 编码的公钥，无效时返回空字符串
+func Fingerprint(pubKeyStr string) string {
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(pubKeyStr)
+	if err != nil || len(pubKeyBytes) != ed25519.PublicKeySize {
+		return ""
+	}
+	sum := sha256.Sum256(pubKeyBytes)
+	return hex.EncodeToString(sum[:])
+}
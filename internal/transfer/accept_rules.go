@@ -0,0 +1,189 @@
+package transfer
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"mesh-drop/internal/config"
+)
+
+// 接收规则
+//
+// 规则按顺序匹配，第一条满足所有条件的规则决定如何处理请求。
+// 没有规则匹配时沿用 AutoAccept 开关：开启或来自受信任节点时自动接收，否则询问用户。
+
+// ruleRejectMessage 拒绝规则未设置消息时回复的原因
+const ruleRejectMessage = "Transfer rejected by receiver"
+
+// SetAcceptRules 校验并替换全部接收规则，ID 为空的规则生成新的 ID
+func (s *Service) SetAcceptRules(rules []config.AcceptRule) ([]config.AcceptRule, error) {
+	rules = slices.Clone(rules)
+	for i := range rules {
+		rule := &rules[i]
+		switch rule.Action {
+		case config.AcceptActionAccept, config.AcceptActionReject, config.AcceptActionAsk:
+		default:
+			return nil, fmt.Errorf("rule %d: unknown action %q", i+1, rule.Action)
+		}
+		switch rule.Trust {
+		case config.AcceptTrustAny, config.AcceptTrustTrusted, config.AcceptTrustUntrusted:
+		default:
+			return nil, fmt.Errorf("rule %d: unknown trust %q", i+1, rule.Trust)
+		}
+		// 只有受信任节点的公钥是固定的，其他节点随时可以换用新的 ID 与密钥
+		if rule.PeerID != "" && rule.Trust != config.AcceptTrustTrusted {
+			return nil, fmt.Errorf("rule %d: a rule for a peer must require a trusted peer", i+1)
+		}
+		if rule.MinSize < 0 || rule.MaxSize < 0 {
+			return nil, fmt.Errorf("rule %d: size must not be negative", i+1)
+		}
+		if rule.MaxSize > 0 && rule.MinSize > rule.MaxSize {
+			return nil, fmt.Errorf("rule %d: min size is larger than max size", i+1)
+		}
+		if w := rule.TimeOfDay; w != nil {
+			if _, err := time.Parse("15:04", w.Start); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid start time %q", i+1, w.Start)
+			}
+			if _, err := time.Parse("15:04", w.End); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid end time %q", i+1, w.End)
+			}
+		}
+		if rule.SavePath != "" && !filepath.IsAbs(rule.SavePath) {
+			return nil, fmt.Errorf("rule %d: save path must be absolute", i+1)
+		}
+		rule.Extensions = slices.Clone(rule.Extensions)
+		for j, ext := range rule.Extensions {
+			rule.Extensions[j] = normalizeExt(ext)
+		}
+		if rule.ID == "" {
+			rule.ID = uuid.New().String()
+		}
+	}
+	s.config.SetAcceptRules(rules)
+	return rules, nil
+}
+
+func (s *Service) GetAcceptRules() []config.AcceptRule {
+	return s.config.GetAcceptRules()
+}
+
+// normalizeExt 统一为小写并带前导点，如 "PNG" -> ".png"
+func normalizeExt(ext string) string {
+	ext = strings.ToLower(strings.TrimSpace(ext))
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// matchAcceptRule 返回第一条匹配的规则
+// peerID 为通过请求签名验证的发送端，localAddr 为收到请求的本机地址，用于匹配网卡
+func (s *Service) matchAcceptRule(
+	task *Transfer,
+	peerID string,
+	localAddr net.Addr,
+) (config.AcceptRule, bool) {
+	rules := s.config.GetAcceptRules()
+	if len(rules) == 0 {
+		return config.AcceptRule{}, false
+	}
+	// 受信任节点的签名使用信任时固定的公钥验证，未验证的请求按不受信任处理
+	trusted := peerID != "" && s.config.IsTrusted(peerID) && !task.Sender.TrustMismatch
+	now := time.Now()
+	// 网卡名称只在有规则需要时查询
+	var iface *string
+	for _, rule := range rules {
+		if !acceptRuleMatches(rule, task, peerID, trusted, now) {
+			continue
+		}
+		if len(rule.Interfaces) > 0 {
+			if iface == nil {
+				name := interfaceName(localAddr)
+				iface = &name
+			}
+			if *iface == "" || !slices.Contains(rule.Interfaces, *iface) {
+				continue
+			}
+		}
+		return rule, true
+	}
+	return config.AcceptRule{}, false
+}
+
+// acceptRuleMatches 判断除网卡外的条件是否都满足
+func acceptRuleMatches(
+	rule config.AcceptRule,
+	task *Transfer,
+	peerID string,
+	trusted bool,
+	now time.Time,
+) bool {
+	// 指定节点的规则只匹配公钥已固定的受信任节点，包括此前保存的未要求信任的规则
+	if rule.PeerID != "" && (rule.PeerID != peerID || !trusted) {
+		return false
+	}
+	switch rule.Trust {
+	case config.AcceptTrustTrusted:
+		if !trusted {
+			return false
+		}
+	case config.AcceptTrustUntrusted:
+		if trusted {
+			return false
+		}
+	}
+	if len(rule.ContentTypes) > 0 && !slices.Contains(rule.ContentTypes, string(task.ContentType)) {
+		return false
+	}
+	if len(rule.Extensions) > 0 {
+		if !isFileContent(task.ContentType) {
+			return false
+		}
+		ext := normalizeExt(filepath.Ext(task.FileName))
+		if !slices.ContainsFunc(rule.Extensions, func(e string) bool {
+			return normalizeExt(e) == ext
+		}) {
+			return false
+		}
+	}
+	// 长度未知的数据流不满足大小条件
+	if rule.MinSize > 0 && (task.FileSize < 0 || task.FileSize < rule.MinSize) {
+		return false
+	}
+	if rule.MaxSize > 0 && (task.FileSize < 0 || task.FileSize > rule.MaxSize) {
+		return false
+	}
+	if rule.TimeOfDay != nil && !rule.TimeOfDay.Contains(now) {
+		return false
+	}
+	return true
+}
+
+// interfaceName 查找 addr 所在的本机网卡，找不到时返回空字符串
+func interfaceName(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(tcpAddr.IP) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+package transfer
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"mesh-drop/internal/security"
+)
+
+// 节点请求签名使用的请求头
+const (
+	headerPeerID    = "X-MeshDrop-Peer"
+	headerTimestamp = "X-MeshDrop-Timestamp"
+	headerSignature = "X-MeshDrop-Signature"
+)
+
+// requestMaxSkew 允许的请求时间偏差，超出视为重放
+const requestMaxSkew = 5 * time.Minute
+
+// contextKeyPeerID 是通过验证的节点 ID 在 gin.Context 中的 key
+const contextKeyPeerID = "peer_id"
+
+// requestSignPayload 生成用于签名的确定性数据
+// 格式: method|uri|timestamp|peerID
+func requestSignPayload(method, uri, timestamp, peerID string) []byte {
+	return fmt.Appendf(nil, "%s|%s|%s|%s", method, uri, timestamp, peerID)
+}
+
+// signRequest 使用本机私钥为请求签名，接收端据此确认请求来自哪个节点
+func (s *Service) signRequest(req *http.Request) error {
+	timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	peerID := s.config.GetID()
+	sig, err := security.Sign(
+		s.config.GetPrivateKey(),
+		requestSignPayload(req.Method, req.URL.RequestURI(), timestamp, peerID),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(headerPeerID, peerID)
+	req.Header.Set(headerTimestamp, timestamp)
+	req.Header.Set(headerSignature, sig)
+	return nil
+}
+
+// peerPublicKey 返回用于验证签名的公钥
+// 受信任节点使用固定的公钥，其他节点使用发现服务中的公钥
+func (s *Service) peerPublicKey(peerID string) (string, bool) {
+	if key, ok := s.config.GetTrusted()[peerID]; ok {
+		return key, true
+	}
+	peer, ok := s.discoveryService.GetPeerByID(peerID)
+	if !ok || peer.TrustMismatch {
+		return "", false
+	}
+	return peer.PublicKey, true
+}
+
+// verifyPeerRequest 校验请求签名，返回发起请求的节点 ID
+func (s *Service) verifyPeerRequest(req *http.Request) (string, bool) {
+	peerID := req.Header.Get(headerPeerID)
+	timestamp := req.Header.Get(headerTimestamp)
+	sig := req.Header.Get(headerSignature)
+	if peerID == "" || timestamp == "" || sig == "" {
+		return "", false
+	}
+
+	ms, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	skew := time.Since(time.UnixMilli(ms))
+	if skew > requestMaxSkew || skew < -requestMaxSkew {
+		return "", false
+	}
+
+	publicKey, ok := s.peerPublicKey(peerID)
+	if !ok {
+		return "", false
+	}
+	valid, err := security.Verify(
+		publicKey,
+		requestSignPayload(req.Method, req.URL.RequestURI(), timestamp, peerID),
+		sig,
+	)
+	if err != nil || !valid {
+		return "", false
+	}
+	return peerID, true
+}
+
+// requirePeerAuth 要求请求带有有效的节点签名
+func (s *Service) requirePeerAuth(c *gin.Context) {
+	peerID, ok := s.verifyPeerRequest(c.Request)
+	if !ok {
+		slog.Warn(
+			"Rejected unauthenticated peer request",
+			"path",
+			c.Request.URL.Path,
+			"ip",
+			c.ClientIP(),
+			"component",
+			"transfer",
+		)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Invalid peer signature"})
+		return
+	}
+	c.Set(contextKeyPeerID, peerID)
+	c.Next()
+}
@@ -16,9 +16,64 @@ import (
 	"path/filepath"
 
 	"github.com/google/uuid"
+	"mesh-drop/internal/config"
 	"mesh-drop/internal/discovery"
+	"mesh-drop/internal/fsutil"
 )
 
+// SendTo 按内容类型向节点发送，返回创建时任务的副本，供本地控制接口等调用
+// value 为文件、图片或文件夹的路径，文本内容或链接，内容类型为 clipboard 时忽略
+func (s *Service) SendTo(peerID string, contentType ContentType, value string) (*Transfer, error) {
+	peer, ok := s.discoveryService.GetPeerByID(peerID)
+	if !ok {
+		return nil, errors.New("peer not found")
+	}
+	ip, ok := latestRouteIP(peer)
+	if !ok {
+		return nil, errors.New("peer not reachable")
+	}
+
+	var task *Transfer
+	switch contentType {
+	case ContentTypeFile:
+		task, _ = s.sendFile(peer, ip, value)
+	case ContentTypeImage:
+		thumb, width, height, err := makeThumbnail(value)
+		if err != nil {
+			return nil, err
+		}
+		task, _ = s.sendFile(
+			peer,
+			ip,
+			value,
+			WithContentType(ContentTypeImage),
+			WithThumbnail(thumb, width, height),
+		)
+	case ContentTypeFolder:
+		task, _ = s.sendFolder(peer, ip, value, s.config.GetFolderFilter())
+	case ContentTypeText:
+		task, _ = s.sendText(peer, ip, value)
+	case ContentTypeURL:
+		u, err := parseLinkURL(value)
+		if err != nil {
+			return nil, err
+		}
+		task, _ = s.sendURL(peer, ip, u.String())
+	case ContentTypeClipboard:
+		content, err := s.readClipboard(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		task, _ = s.sendClipboard(peer, ip, content, false)
+	default:
+		return nil, fmt.Errorf("unsupported content type: %s", contentType)
+	}
+	if task == nil {
+		return nil, fmt.Errorf("failed to read %s", value)
+	}
+	return task.Snapshot(), nil
+}
+
 func (s *Service) SendFiles(target *discovery.Peer, targetIP string, filePaths []string) {
 	for _, filePath := range filePaths {
 		s.SendFile(target, targetIP, filePath)
@@ -26,6 +81,17 @@ func (s *Service) SendFiles(target *discovery.Peer, targetIP string, filePaths [
 }
 
 func (s *Service) SendFile(target *discovery.Peer, targetIP string, filePath string) {
+	s.sendFile(target, targetIP, filePath)
+}
+
+// sendFile 在后台发送文件，返回的通道在任务结束后关闭
+// 打开文件失败时返回 nil
+func (s *Service) sendFile(
+	target *discovery.Peer,
+	targetIP string,
+	filePath string,
+	opts ...TransferOption,
+) (*Transfer, <-chan struct{}) {
 	taskID := uuid.New().String()
 	ctx, cancel := context.WithCancel(context.Background())
 	s.cancelMap.Store(taskID, cancel)
@@ -41,26 +107,36 @@ func (s *Service) SendFile(target *discovery.Peer, targetIP string, filePath str
 			"component",
 			"transfer-client",
 		)
-		return
+		cancel()
+		s.cancelMap.Delete(taskID)
+		return nil, nil
 	}
 
 	stat, err := file.Stat()
 	if err != nil {
-		return
+		_ = file.Close()
+		cancel()
+		s.cancelMap.Delete(taskID)
+		return nil, nil
 	}
 
 	task := NewTransfer(
 		taskID,
 		s.discoveryService.GetSelf(),
-		WithFileName(filepath.Base(filePath)),
-		WithFileSize(stat.Size()),
-		WithType(TransferTypeSend),
-		WithContentType(ContentTypeFile),
+		append([]TransferOption{
+			WithFileName(filepath.Base(filePath)),
+			WithFileSize(stat.Size()),
+			WithType(TransferTypeSend),
+			WithContentType(ContentTypeFile),
+		}, opts...)...,
 	)
+	task.Delta = true
 
 	s.StoreTransferToList(task)
 
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		defer file.Close()
 		// 任务结束后清理 ctx
 		defer func() {
@@ -69,46 +145,73 @@ func (s *Service) SendFile(target *discovery.Peer, targetIP string, filePath str
 			s.NotifyTransferListUpdate()
 		}()
 
-		askResp, err := s.ask(ctx, target, targetIP, task)
-		if err != nil {
-			if errors.Is(err, context.Canceled) {
-				task.Status = TransferStatusCanceled
+		s.sendWithRetry(ctx, task, target, targetIP, func(target *discovery.Peer, targetIP string) {
+			// 重试时从头读取文件
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				task.transition(TransferStatusError, fmt.Sprintf("Failed to read file: %v", err))
+				return
+			}
+			askResp, err := s.ask(ctx, target, targetIP, task)
+			if err == nil && askResp.HashRequired {
+				askResp, err = s.sendHash(ctx, target, targetIP, task, askResp, filePath)
+			}
+			if err != nil {
+				setAskError(task, err)
+				return
+			}
+			if askResp.Skipped {
+				// 接收方已有相同文件
+				task.update(func() {
+					task.Skipped = true
+					task.Deduplicated = askResp.Deduplicated
+				})
+				task.complete()
+				return
+			}
+			if askResp.Accepted {
+				s.processTransfer(ctx, askResp, target, targetIP, task, file)
 			} else {
-				// 如果请求发送失败，更新状态为 Error
-				if errors.Is(err, io.EOF) {
-					// 接收方离线
-					task.Status = TransferStatusCanceled
-					return
-				}
-				task.Status = TransferStatusError
-				task.ErrorMsg = fmt.Sprintf("Failed to connect to receiver: %v", err)
+				// 接收方拒绝
+				task.transition(TransferStatusRejected, askResp.Message)
 			}
-			return
-		}
-		if askResp.Accepted {
-			s.processTransfer(ctx, askResp, target, targetIP, task, file)
-		} else {
-			// 接收方拒绝
-			task.Status = TransferStatusRejected
-			return
-		}
+		})
 	}()
+	return task, done
 }
 
+// SendFolder 使用配置中的默认过滤规则发送文件夹
 func (s *Service) SendFolder(target *discovery.Peer, targetIP string, folderPath string) {
+	s.SendFolderWithFilter(target, targetIP, folderPath, s.config.GetFolderFilter())
+}
+
+// SendFolderWithFilter 发送文件夹，只发送未被 filter 排除的条目
+func (s *Service) SendFolderWithFilter(
+	target *discovery.Peer,
+	targetIP string,
+	folderPath string,
+	filter config.FolderFilter,
+) {
+	if _, done := s.sendFolder(target, targetIP, folderPath, filter); done != nil {
+		<-done
+	}
+}
+
+// sendFolder 在后台发送文件夹，返回的通道在任务结束后关闭
+// 计算大小失败时返回 nil
+func (s *Service) sendFolder(
+	target *discovery.Peer,
+	targetIP string,
+	folderPath string,
+	filter config.FolderFilter,
+) (*Transfer, <-chan struct{}) {
 	taskID := uuid.New().String()
 	ctx, cancel := context.WithCancel(context.Background())
 	s.cancelMap.Store(taskID, cancel)
 
-	// 任务结束后清理 ctx
-	defer func() {
-		s.cancelMap.Delete(taskID)
-		cancel()
-		s.NotifyTransferListUpdate()
-	}()
-
-	size, err := calculateTarSize(ctx, folderPath)
+	size, err := calculateTarSize(ctx, folderPath, filter)
 	if err != nil {
+		cancel()
+		s.cancelMap.Delete(taskID)
 		slog.Error(
 			"Failed to calculate folder size",
 			"path",
@@ -118,7 +221,7 @@ func (s *Service) SendFolder(target *discovery.Peer, targetIP string, folderPath
 			"component",
 			"transfer-client",
 		)
-		return
+		return nil, nil
 	}
 
 	task := NewTransfer(
@@ -132,50 +235,63 @@ func (s *Service) SendFolder(target *discovery.Peer, targetIP string, folderPath
 
 	s.StoreTransferToList(task)
 
-	askResp, err := s.ask(ctx, target, targetIP, task)
-	if err != nil {
-		if errors.Is(err, context.Canceled) {
-			task.Status = TransferStatusCanceled
-		} else {
-			// 如果请求发送失败，更新状态为 Error
-			if errors.Is(err, io.EOF) {
-				// 接收方离线
-				task.Status = TransferStatusCanceled
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// 任务结束后清理 ctx
+		defer func() {
+			s.cancelMap.Delete(taskID)
+			cancel()
+			s.NotifyTransferListUpdate()
+		}()
+		s.sendWithRetry(ctx, task, target, targetIP, func(target *discovery.Peer, targetIP string) {
+			askResp, err := s.ask(ctx, target, targetIP, task)
+			if err != nil {
+				setAskError(task, err)
 				return
 			}
-			task.Status = TransferStatusError
-			task.ErrorMsg = fmt.Sprintf("Failed to connect to receiver: %v", err)
-		}
-		return
-	}
-	if askResp.Accepted {
-		r, w := io.Pipe()
-		go func(ctx context.Context) {
-			defer w.Close()
-			if err := streamFolderToTar(ctx, w, folderPath); err != nil {
-				slog.Error(
-					"Failed to stream folder to tar",
-					"error",
-					err,
-					"component",
-					"transfer-client",
-				)
-				w.CloseWithError(err)
+			if !askResp.Accepted {
+				// 接收方拒绝
+				task.transition(TransferStatusRejected, askResp.Message)
+				return
 			}
-		}(ctx)
-		s.processTransfer(ctx, askResp, target, targetIP, task, r)
-	} else {
-		// 接收方拒绝
-		task.Status = TransferStatusRejected
-	}
+
+			r, w := io.Pipe()
+			// 上传提前结束时关闭管道，避免打包协程阻塞
+			defer r.Close()
+			go func(ctx context.Context) {
+				defer w.Close()
+				if err := streamFolderToTar(ctx, w, folderPath, filter); err != nil {
+					slog.Error(
+						"Failed to stream folder to tar",
+						"error",
+						err,
+						"component",
+						"transfer-client",
+					)
+					w.CloseWithError(err)
+				}
+			}(ctx)
+			s.processTransfer(ctx, askResp, target, targetIP, task, r)
+		})
+	}()
+	return task, done
 }
 
 func (s *Service) SendText(target *discovery.Peer, targetIP string, text string) {
+	s.sendText(target, targetIP, text)
+}
+
+// sendText 在后台发送文本，返回的通道在任务结束后关闭
+func (s *Service) sendText(
+	target *discovery.Peer,
+	targetIP string,
+	text string,
+) (*Transfer, <-chan struct{}) {
 	taskID := uuid.New().String()
 	ctx, cancel := context.WithCancel(context.Background())
 	s.cancelMap.Store(taskID, cancel)
 
-	r := bytes.NewReader([]byte(text))
 	task := NewTransfer(
 		taskID,
 		s.discoveryService.GetSelf(),
@@ -186,7 +302,9 @@ func (s *Service) SendText(target *discovery.Peer, targetIP string, text string)
 
 	s.StoreTransferToList(task)
 
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		// 任务结束后清理 ctx
 		defer func() {
 			s.cancelMap.Delete(taskID)
@@ -194,30 +312,123 @@ func (s *Service) SendText(target *discovery.Peer, targetIP string, text string)
 			s.NotifyTransferListUpdate()
 		}()
 
-		askResp, err := s.ask(ctx, target, targetIP, task)
-		if err != nil {
-			if errors.Is(err, context.Canceled) {
-				task.Status = TransferStatusCanceled
+		s.sendWithRetry(ctx, task, target, targetIP, func(target *discovery.Peer, targetIP string) {
+			askResp, err := s.ask(ctx, target, targetIP, task)
+			if err != nil {
+				setAskError(task, err)
+				return
+			}
+			if askResp.Accepted {
+				r := bytes.NewReader([]byte(text))
+				s.processTransfer(ctx, askResp, target, targetIP, task, r)
 			} else {
-				// 如果请求发送失败，更新状态为 Error
-				if errors.Is(err, io.EOF) {
-					// 接收方离线
-					task.Status = TransferStatusCanceled
-					return
-				}
-				task.Status = TransferStatusError
-				task.ErrorMsg = fmt.Sprintf("Failed to connect to receiver: %v", err)
+				// 接收方拒绝
+				task.transition(TransferStatusRejected, askResp.Message)
 			}
-			return
-		}
-		if askResp.Accepted {
-			s.processTransfer(ctx, askResp, target, targetIP, task, r)
-		} else {
-			// 接收方拒绝
-			task.Status = TransferStatusRejected
-			return
-		}
+		})
 	}()
+	return task, done
+}
+
+// SendImage 发送图片，握手中附带缩略图供接收端预览
+// 无法解码的图片按普通文件发送
+func (s *Service) SendImage(target *discovery.Peer, targetIP string, imagePath string) {
+	thumb, width, height, err := makeThumbnail(imagePath)
+	if err != nil {
+		slog.Warn(
+			"Failed to create thumbnail, sending as file",
+			"path",
+			imagePath,
+			"error",
+			err,
+			"component",
+			"transfer-client",
+		)
+		s.sendFile(target, targetIP, imagePath)
+		return
+	}
+	s.sendFile(
+		target,
+		targetIP,
+		imagePath,
+		WithContentType(ContentTypeImage),
+		WithThumbnail(thumb, width, height),
+	)
+}
+
+// SendURL 发送链接，接收端可以直接打开
+func (s *Service) SendURL(target *discovery.Peer, targetIP string, link string) error {
+	u, err := parseLinkURL(link)
+	if err != nil {
+		return err
+	}
+	s.sendURL(target, targetIP, u.String())
+	return nil
+}
+
+// sendURL 在后台获取网页标题并发送链接，返回的通道在任务结束后关闭
+func (s *Service) sendURL(
+	target *discovery.Peer,
+	targetIP string,
+	link string,
+) (*Transfer, <-chan struct{}) {
+	taskID := uuid.New().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancelMap.Store(taskID, cancel)
+
+	task := NewTransfer(
+		taskID,
+		s.discoveryService.GetSelf(),
+		WithType(TransferTypeSend),
+		WithContentType(ContentTypeURL),
+		WithURL(link, ""),
+	)
+
+	s.StoreTransferToList(task)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// 任务结束后清理 ctx
+		defer func() {
+			s.cancelMap.Delete(taskID)
+			cancel()
+			s.NotifyTransferListUpdate()
+		}()
+
+		title := fetchLinkTitle(ctx, link)
+		task.update(func() { task.LinkTitle = title })
+
+		s.sendWithRetry(ctx, task, target, targetIP, func(target *discovery.Peer, targetIP string) {
+			askResp, err := s.ask(ctx, target, targetIP, task)
+			if err != nil {
+				setAskError(task, err)
+				return
+			}
+			if askResp.Accepted {
+				// 链接随握手发送，接受即完成
+				task.complete()
+			} else {
+				// 接收方拒绝
+				task.transition(TransferStatusRejected, askResp.Message)
+			}
+		})
+	}()
+	return task, done
+}
+
+// latestRouteIP 返回节点最近一次响应的 IP
+func latestRouteIP(peer *discovery.Peer) (string, bool) {
+	var latest *discovery.RouteState
+	for _, route := range peer.Routes {
+		if latest == nil || route.LastSeen.After(latest.LastSeen) {
+			latest = route
+		}
+	}
+	if latest == nil {
+		return "", false
+	}
+	return latest.IP, true
 }
 
 // ask 向接收端发送传输请求
@@ -231,16 +442,27 @@ func (s *Service) ask(
 		return TransferAskResponse{}, err
 	}
 
+	// 记录接收节点，用于按节点查询历史
+	task.update(func() {
+		if task.TargetID == "" {
+			task.TargetID = target.ID
+			task.TargetName = target.Name
+		}
+	})
+
 	// 发送请求
-	askBody, _ := json.Marshal(task)
+	askBody, _ := json.Marshal(task.Snapshot())
 
 	askUrl := fmt.Sprintf("https://%s:%d/transfer/ask", targetIP, target.Port)
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, askUrl, bytes.NewReader(askBody))
-	req.Header.Set("Content-Type", "application/json")
 	if err != nil {
 		return TransferAskResponse{}, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := s.signRequest(req); err != nil {
+		return TransferAskResponse{}, err
+	}
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
 		return TransferAskResponse{}, err
@@ -258,6 +480,67 @@ func (s *Service) ask(
 	return askResp, nil
 }
 
+// sendHash 接收端需要文件哈希时计算并提交，回复与 ask 相同
+// 哈希只计算一次，重试时复用；计算失败时直接上传
+func (s *Service) sendHash(
+	ctx context.Context,
+	target *discovery.Peer,
+	targetIP string,
+	task *Transfer,
+	askResp TransferAskResponse,
+	filePath string,
+) (TransferAskResponse, error) {
+	hash := task.Snapshot().FileHash
+	if hash == "" {
+		var err error
+		hash, err = hashFile(ctx, filePath)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return TransferAskResponse{}, err
+			}
+			slog.Warn("Failed to hash file", "path", filePath, "error", err)
+			return askResp, nil
+		}
+		task.update(func() { task.FileHash = hash })
+	}
+
+	hashUrl, _ := url.Parse(
+		fmt.Sprintf("https://%s:%d/transfer/hash/%s", targetIP, target.Port, task.ID),
+	)
+	query := hashUrl.Query()
+	query.Add("token", askResp.Token)
+	hashUrl.RawQuery = query.Encode()
+
+	body, _ := json.Marshal(TransferHashRequest{FileHash: hash})
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		hashUrl.String(),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return TransferAskResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := s.signRequest(req); err != nil {
+		return TransferAskResponse{}, err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return TransferAskResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var hashResp TransferAskResponse
+	if err := json.NewDecoder(resp.Body).Decode(&hashResp); err != nil {
+		return TransferAskResponse{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return TransferAskResponse{}, errors.New(hashResp.Message)
+	}
+	return hashResp, nil
+}
+
 // processTransfer 传输数据
 func (s *Service) processTransfer(
 	ctx context.Context,
@@ -285,30 +568,46 @@ func (s *Service) processTransfer(
 		Reader: payload,
 		total:  task.FileSize,
 		callback: func(current, total int64, speed float64) {
-			task.Progress = Progress{
+			task.setProgress(Progress{
 				Current: current,
 				Total:   total,
 				Speed:   speed,
-			}
-			task.Status = TransferStatusActive
+			})
 			s.NotifyTransferListUpdate()
 		},
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPut, uploadUrl.String(), reader)
+	// 接收端返回了基准文件签名时只上传变化的部分，进度按已读取的源文件计算
+	var body io.Reader = reader
+	contentLength := task.FileSize
+	contentType := "application/octet-stream"
+	task.update(func() { task.Delta = askResp.Delta != nil })
+	if askResp.Delta != nil {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			pw.CloseWithError(writeDelta(pw, reader, askResp.Delta))
+		}()
+		body, contentLength, contentType = pr, -1, deltaContentType
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, uploadUrl.String(), body)
 	if err != nil {
 		return
 	}
-	req.ContentLength = task.FileSize
-	req.Header.Set("Content-Type", "application/octet-stream")
+	req.ContentLength = contentLength
+	req.Header.Set("Content-Type", contentType)
+	if err := s.signRequest(req); err != nil {
+		task.transition(TransferStatusError, fmt.Sprintf("Failed to sign request: %v", err))
+		return
+	}
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
-			task.Status = TransferStatusCanceled
+			task.transition(TransferStatusCanceled, "")
 		} else {
-			task.Status = TransferStatusError
-			task.ErrorMsg = fmt.Sprintf("Failed to upload file: %v", err)
+			task.transition(TransferStatusError, fmt.Sprintf("Failed to upload file: %v", err))
 			slog.Error(
 				"Failed to upload file",
 				"url",
@@ -329,20 +628,22 @@ func (s *Service) processTransfer(
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		task.Status = TransferStatusError
-		task.ErrorMsg = uploadResp.Message
+		task.transition(TransferStatusError, uploadResp.Message)
 		return
 	}
 
 	// 判断任务完成还是被接收端取消
 	if uploadResp.Status == TransferStatusCanceled {
-		task.Status = TransferStatusCanceled
-		task.ErrorMsg = uploadResp.Message
+		task.transition(TransferStatusCanceled, uploadResp.Message)
 		return
 	}
 
+	// 长度未知的数据流在发送完成后记录实际大小
+	if task.FileSize < 0 {
+		task.update(func() { task.FileSize = reader.currentLen })
+	}
 	// 传输成功，任务结束
-	task.Status = TransferStatusCompleted
+	task.complete()
 }
 
 type countWriter struct {
@@ -354,35 +655,104 @@ func (w *countWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
-func calculateTarSize(ctx context.Context, srcPath string) (int64, error) {
-	var size int64
-	err := filepath.Walk(srcPath, func(path string, info os.FileInfo, err error) error {
+// tarEntryBuilder 为文件夹中的条目生成 tar header
+// calculateTarSize 与 streamFolderToTar 必须使用同一个 builder 逻辑，否则进度会不准确
+type tarEntryBuilder struct {
+	srcPath string
+	// links 记录已经写入过的硬链接源
+	// Key: 设备号 + inode, Value: tar 内路径
+	links map[fsutil.FileKey]string
+}
+
+func newTarEntryBuilder(srcPath string) *tarEntryBuilder {
+	return &tarEntryBuilder{
+		srcPath: srcPath,
+		links:   make(map[fsutil.FileKey]string),
+	}
+}
+
+// header 生成条目的 tar header，返回 nil 表示跳过该条目
+func (b *tarEntryBuilder) header(path string, info os.FileInfo) (*tar.Header, error) {
+	// 计算相对路径
+	relPath, err := filepath.Rel(b.srcPath, path)
+	if err != nil {
+		return nil, err
+	}
+	if relPath == "." {
+		return nil, nil
+	}
+
+	mode := info.Mode()
+	// 套接字、管道和设备文件无法传输
+	if mode&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice|os.ModeIrregular) != 0 {
+		slog.Debug("Skipping special file", "path", path, "component", "transfer-client")
+		return nil, nil
+	}
+
+	// 符号链接记录链接目标
+	link := ""
+	if mode&os.ModeSymlink != 0 {
+		link, err = os.Readlink(path)
 		if err != nil {
-			return err
-		}
-		if ctx.Err() != nil {
-			return ctx.Err()
+			return nil, err
 		}
+		link = filepath.ToSlash(link)
+	}
 
-		// 计算相对路径
-		relPath, err := filepath.Rel(srcPath, path)
-		if err != nil {
-			return err
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+
+	// tar 文件名使用正斜杠
+	header.Name = filepath.ToSlash(relPath)
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	// 同一 inode 第二次出现时写成硬链接，不重复传输内容
+	if mode.IsRegular() {
+		if key, nlink, ok := fsutil.FileID(info); ok && nlink > 1 {
+			if first, seen := b.links[key]; seen {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+			} else {
+				b.links[key] = header.Name
+			}
 		}
-		if relPath == "." {
-			return nil
+	}
+
+	// 扩展属性使用 PAX 记录传输，由接收端决定是否还原
+	attrs, err := fsutil.ListXattrs(path)
+	if err != nil {
+		slog.Debug("Failed to read xattrs", "path", path, "error", err)
+	}
+	if len(attrs) > 0 {
+		header.PAXRecords = make(map[string]string, len(attrs))
+		for name, value := range attrs {
+			header.PAXRecords[paxXattrPrefix+name] = value
 		}
+	}
 
-		// 使用 tar.FileInfoHeader 计算 header
-		header, err := tar.FileInfoHeader(info, "")
+	return header, nil
+}
+
+func calculateTarSize(
+	ctx context.Context,
+	srcPath string,
+	filter config.FolderFilter,
+) (int64, error) {
+	var size int64
+	builder := newTarEntryBuilder(srcPath)
+	walker := newFolderWalker(srcPath, filter)
+	err := walker.walk(ctx, func(path string, info os.FileInfo, err error) error {
+		header, err := builder.header(path, info)
 		if err != nil {
 			return err
 		}
-
-		// 保持与 streamFolderToTar 一致
-		header.Name = filepath.ToSlash(relPath)
-		if info.IsDir() {
-			header.Name += "/"
+		if header == nil {
+			return nil
 		}
 
 		cw := &countWriter{}
@@ -393,10 +763,9 @@ func calculateTarSize(ctx context.Context, srcPath string) (int64, error) {
 		// tw.WriteHeader 写入 header blocks（包括扩展头）
 		size += cw.n
 
-		if !info.IsDir() {
+		if header.Typeflag == tar.TypeReg {
 			// 文件内容大小 + 填充
-			fileSize := info.Size()
-			blocks := math.Ceil(float64(fileSize) / 512)
+			blocks := math.Ceil(float64(header.Size) / 512)
 			size += int64(blocks) * 512
 		}
 
@@ -409,51 +778,40 @@ func calculateTarSize(ctx context.Context, srcPath string) (int64, error) {
 	return size, err
 }
 
-func streamFolderToTar(ctx context.Context, w io.Writer, srcPath string) error {
+func streamFolderToTar(
+	ctx context.Context,
+	w io.Writer,
+	srcPath string,
+	filter config.FolderFilter,
+) error {
 	tw := tar.NewWriter(w)
 	defer tw.Close()
 
-	return filepath.Walk(srcPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if ctx.Err() != nil {
-			return ctx.Err()
-		}
-
-		relPath, err := filepath.Rel(srcPath, path)
+	builder := newTarEntryBuilder(srcPath)
+	walker := newFolderWalker(srcPath, filter)
+	return walker.walk(ctx, func(path string, info os.FileInfo, err error) error {
+		header, err := builder.header(path, info)
 		if err != nil {
 			return err
 		}
-		if relPath == "." {
+		if header == nil {
 			return nil
 		}
 		slog.Debug(
 			"Processing file",
 			"path",
 			path,
-			"relPath",
-			relPath,
+			"name",
+			header.Name,
 			"component",
 			"transfer-client",
 		)
 
-		header, err := tar.FileInfoHeader(info, "")
-		if err != nil {
-			return err
-		}
-
-		// tar 文件名使用正斜杠
-		header.Name = filepath.ToSlash(relPath)
-		if info.IsDir() {
-			header.Name += "/"
-		}
-
 		if err := tw.WriteHeader(header); err != nil {
 			return err
 		}
 
-		if !info.IsDir() {
+		if header.Typeflag == tar.TypeReg {
 			file, err := os.Open(path)
 			if err != nil {
 				return err
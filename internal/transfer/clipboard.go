@@ -0,0 +1,464 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"mesh-drop/internal/clipboard"
+	"mesh-drop/internal/config"
+	"mesh-drop/internal/discovery"
+)
+
+const (
+	MimeTypeText = "text/plain"
+	MimeTypePNG  = "image/png"
+)
+
+const (
+	// clipboardHistoryLimit 剪贴板历史保留的条数
+	clipboardHistoryLimit = 50
+	// clipboardPollInterval 自动同步时检查本机剪贴板的间隔
+	clipboardPollInterval = time.Second
+)
+
+// ClipboardItem 是一条剪贴板传输记录
+type ClipboardItem struct {
+	ID        string       `json:"id"` // 传输会话 ID
+	PeerID    string       `json:"peer_id"`
+	PeerName  string       `json:"peer_name"`
+	Type      TransferType `json:"type"` // send 或 receive
+	MimeType  string       `json:"mime_type"`
+	Text      string       `json:"text,omitempty"`
+	ImagePath string       `json:"image_path,omitempty"` // 图片保存在配置目录下
+	Size      int64        `json:"size"`
+	Time      int64        `json:"time"`
+	Applied   bool         `json:"applied"` // 已写入本机剪贴板
+	Sync      bool         `json:"sync"`    // 由自动同步产生
+}
+
+// clipboardContent 是剪贴板中的一项内容
+type clipboardContent struct {
+	mimeType string
+	data     []byte
+}
+
+func (c clipboardContent) hash() string {
+	sum := sha256.Sum256(append([]byte(c.mimeType+"\n"), c.data...))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Service) clipboardDir() string {
+	return filepath.Join(s.configDir, "clipboard")
+}
+
+// clipboardHistory 保存最近的剪贴板传输，图片单独保存为文件
+type clipboardHistory struct {
+	mu    sync.Mutex
+	dir   string
+	items []ClipboardItem // 按时间降序
+}
+
+func newClipboardHistory(dir string) *clipboardHistory {
+	h := &clipboardHistory{dir: dir}
+	data, err := os.ReadFile(filepath.Join(dir, "history.json"))
+	if err == nil {
+		if err := json.Unmarshal(data, &h.items); err != nil {
+			slog.Warn("Failed to parse clipboard history", "error", err, "component", "clipboard")
+		}
+	}
+	return h
+}
+
+// add 记录一条传输，图片内容写入 dir/<id>.png
+func (h *clipboardHistory) add(item ClipboardItem, content clipboardContent) ClipboardItem {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	item.Size = int64(len(content.data))
+	item.MimeType = content.mimeType
+	switch content.mimeType {
+	case MimeTypeText:
+		item.Text = string(content.data)
+	case MimeTypePNG:
+		_ = os.MkdirAll(h.dir, 0o750)
+		path := filepath.Join(h.dir, item.ID+".png")
+		if err := os.WriteFile(path, content.data, 0o600); err != nil {
+			slog.Warn("Failed to save clipboard image", "error", err, "component", "clipboard")
+		} else {
+			item.ImagePath = path
+		}
+	}
+
+	h.items = append([]ClipboardItem{item}, h.items...)
+	for _, old := range h.items[min(len(h.items), clipboardHistoryLimit):] {
+		if old.ImagePath != "" {
+			_ = os.Remove(old.ImagePath)
+		}
+	}
+	h.items = h.items[:min(len(h.items), clipboardHistoryLimit)]
+	h.save()
+	return item
+}
+
+func (h *clipboardHistory) get(id string) (ClipboardItem, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, item := range h.items {
+		if item.ID == id {
+			return item, true
+		}
+	}
+	return ClipboardItem{}, false
+}
+
+func (h *clipboardHistory) setApplied(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range h.items {
+		if h.items[i].ID == id {
+			h.items[i].Applied = true
+			h.save()
+			return
+		}
+	}
+}
+
+func (h *clipboardHistory) list() []ClipboardItem {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	items := make([]ClipboardItem, len(h.items))
+	copy(items, h.items)
+	return items
+}
+
+func (h *clipboardHistory) clear() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, item := range h.items {
+		if item.ImagePath != "" {
+			_ = os.Remove(item.ImagePath)
+		}
+	}
+	h.items = nil
+	h.save()
+}
+
+// save 需要在持有 mu 时调用
+func (h *clipboardHistory) save() {
+	data, err := json.Marshal(h.items)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(h.dir, 0o750); err != nil {
+		return
+	}
+	path := filepath.Join(h.dir, "history.json")
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0o600); err != nil {
+		slog.Warn("Failed to write clipboard history", "error", err, "component", "clipboard")
+		return
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		_ = os.Remove(tempPath)
+	}
+}
+
+// readClipboard 读取本机剪贴板，文本优先，没有文本时读取图片
+func (s *Service) readClipboard(ctx context.Context) (clipboardContent, error) {
+	if s.desktop == nil {
+		return clipboardContent{}, errors.New("no clipboard available")
+	}
+	if text, ok := s.desktop.ClipboardText(); ok && text != "" {
+		return clipboardContent{mimeType: MimeTypeText, data: []byte(text)}, nil
+	}
+	data, err := clipboard.ReadImage(ctx)
+	if err != nil {
+		return clipboardContent{}, err
+	}
+	return clipboardContent{mimeType: MimeTypePNG, data: data}, nil
+}
+
+// writeClipboard 写入本机剪贴板，并记录内容避免自动同步再发送回去
+func (s *Service) writeClipboard(ctx context.Context, content clipboardContent) error {
+	s.clipMu.Lock()
+	defer s.clipMu.Unlock()
+	switch content.mimeType {
+	case MimeTypeText:
+		if s.desktop == nil || !s.desktop.SetClipboardText(string(content.data)) {
+			return errors.New("failed to set clipboard text")
+		}
+	case MimeTypePNG:
+		if err := clipboard.WriteImage(ctx, content.data); err != nil {
+			return err
+		}
+	default:
+		return errors.New("unsupported clipboard content")
+	}
+	s.clipLast = content.hash()
+	return nil
+}
+
+// PushClipboard 将本机剪贴板的当前内容发送给节点
+func (s *Service) PushClipboard(target *discovery.Peer, targetIP string) error {
+	content, err := s.readClipboard(context.Background())
+	if err != nil {
+		if errors.Is(err, clipboard.ErrNoImage) {
+			return errors.New("clipboard is empty")
+		}
+		return err
+	}
+	s.sendClipboard(target, targetIP, content, false)
+	return nil
+}
+
+// sendClipboard 在后台发送剪贴板内容，返回的通道在任务结束后关闭
+func (s *Service) sendClipboard(
+	target *discovery.Peer,
+	targetIP string,
+	content clipboardContent,
+	auto bool,
+) (*Transfer, <-chan struct{}) {
+	taskID := uuid.New().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancelMap.Store(taskID, cancel)
+
+	task := NewTransfer(
+		taskID,
+		s.discoveryService.GetSelf(),
+		WithFileSize(int64(len(content.data))),
+		WithType(TransferTypeSend),
+		WithContentType(ContentTypeClipboard),
+		WithMimeType(content.mimeType),
+	)
+	task.ClipboardSync = auto
+
+	s.StoreTransferToList(task)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// 任务结束后清理 ctx
+		defer func() {
+			s.cancelMap.Delete(taskID)
+			cancel()
+			s.NotifyTransferListUpdate()
+		}()
+
+		s.sendWithRetry(ctx, task, target, targetIP, func(target *discovery.Peer, targetIP string) {
+			askResp, err := s.ask(ctx, target, targetIP, task)
+			if err != nil {
+				setAskError(task, err)
+				return
+			}
+			if askResp.Accepted {
+				r := bytes.NewReader(content.data)
+				s.processTransfer(ctx, askResp, target, targetIP, task, r)
+			} else {
+				// 接收方拒绝
+				task.transition(TransferStatusRejected, askResp.Message)
+			}
+		})
+
+		if task.status() == TransferStatusCompleted {
+			if content.mimeType == MimeTypeText {
+				task.update(func() { task.Text = string(content.data) })
+			}
+			s.clipHistory.add(ClipboardItem{
+				ID:       task.ID,
+				PeerID:   target.ID,
+				PeerName: target.Name,
+				Type:     TransferTypeSend,
+				Time:     time.Now().UnixMilli(),
+				Sync:     auto,
+			}, content)
+			s.notifyClipboardHistoryUpdate()
+			// 自动同步的记录只保留在剪贴板历史中
+			if auto {
+				s.transfers.Delete(task.ID)
+			}
+		}
+	}()
+	return task, done
+}
+
+// checkClipboardAsk 检查剪贴板请求，返回不为空时拒绝
+func (s *Service) checkClipboardAsk(task *Transfer) string {
+	if task.MimeType != MimeTypeText && task.MimeType != MimeTypePNG {
+		return "Unsupported clipboard content"
+	}
+	if task.FileSize > clipboard.MaxImageSize {
+		return "Clipboard content too large"
+	}
+	// 只接受本机也开启了同步的受信任节点的自动同步
+	if task.ClipboardSync && !s.clipboardSyncAllowed(task.Sender) {
+		return "Clipboard sync not enabled"
+	}
+	return ""
+}
+
+// clipboardSyncAllowed 判断是否接受 peer 的自动同步
+// peer 来自通过签名验证的请求，ID 不能被其他节点冒用
+func (s *Service) clipboardSyncAllowed(peer discovery.Peer) bool {
+	return s.config.IsClipboardSync(peer.ID) && s.isTrusted(peer)
+}
+
+// onClipboardReceived 记录收到的剪贴板内容，策略允许时写入本机剪贴板
+func (s *Service) onClipboardReceived(task *Transfer, data []byte) {
+	content := clipboardContent{mimeType: task.MimeType, data: data}
+	if content.mimeType == MimeTypeText {
+		task.update(func() { task.Text = string(data) })
+	}
+	item := s.clipHistory.add(ClipboardItem{
+		ID:       task.ID,
+		PeerID:   task.Sender.ID,
+		PeerName: task.Sender.Name,
+		Type:     TransferTypeReceive,
+		Time:     time.Now().UnixMilli(),
+		Sync:     task.ClipboardSync,
+	}, content)
+
+	var apply bool
+	switch s.config.GetClipboardPolicy() {
+	case config.ClipboardPolicyAlways:
+		apply = true
+	case config.ClipboardPolicyTrusted:
+		apply = s.isTrusted(task.Sender)
+	}
+	// 开启同步即表示允许写入，除非策略为 never
+	// 接收期间可能取消了信任或同步，写入前再次检查
+	if task.ClipboardSync && s.config.GetClipboardPolicy() != config.ClipboardPolicyNever &&
+		s.clipboardSyncAllowed(task.Sender) {
+		apply = true
+	}
+	if apply {
+		if err := s.writeClipboard(context.Background(), content); err != nil {
+			slog.Warn(
+				"Failed to apply received clipboard",
+				"id",
+				task.ID,
+				"error",
+				err,
+				"component",
+				"clipboard",
+			)
+		} else {
+			s.clipHistory.setApplied(item.ID)
+		}
+	}
+	s.notifyClipboardHistoryUpdate()
+
+	if task.ClipboardSync {
+		s.transfers.Delete(task.ID)
+	}
+}
+
+// ApplyClipboardItem 将剪贴板历史中的一项写入本机剪贴板
+func (s *Service) ApplyClipboardItem(id string) error {
+	item, ok := s.clipHistory.get(id)
+	if !ok {
+		return errors.New("clipboard item not found")
+	}
+	content := clipboardContent{mimeType: item.MimeType, data: []byte(item.Text)}
+	if item.MimeType == MimeTypePNG {
+		data, err := os.ReadFile(item.ImagePath)
+		if err != nil {
+			return err
+		}
+		content.data = data
+	}
+	if err := s.writeClipboard(context.Background(), content); err != nil {
+		return err
+	}
+	s.clipHistory.setApplied(id)
+	s.notifyClipboardHistoryUpdate()
+	return nil
+}
+
+func (s *Service) GetClipboardHistory() []ClipboardItem {
+	return s.clipHistory.list()
+}
+
+func (s *Service) ClearClipboardHistory() {
+	s.clipHistory.clear()
+	s.notifyClipboardHistoryUpdate()
+}
+
+func (s *Service) notifyClipboardHistoryUpdate() {
+	if s.events == nil {
+		return
+	}
+	s.events.Emit("clipboard:refreshHistory")
+}
+
+// SetClipboardSync 开启或关闭与节点的剪贴板自动同步，只能与受信任节点同步
+func (s *Service) SetClipboardSync(peerID string, enabled bool) error {
+	if enabled && !s.config.IsTrusted(peerID) {
+		return errors.New("clipboard sync requires a trusted peer")
+	}
+	s.config.SetClipboardSync(peerID, enabled)
+	return nil
+}
+
+// runClipboardSync 定期检查本机剪贴板，变化时发送给开启同步的节点
+func (s *Service) runClipboardSync() {
+	ticker := time.NewTicker(clipboardPollInterval)
+	defer ticker.Stop()
+
+	// 启动时的剪贴板内容不发送
+	initialized := false
+	// Key: PeerID, Value: 仍在发送中的上一次同步
+	inflight := make(map[string]*Transfer)
+
+	for range ticker.C {
+		peerIDs := s.config.GetClipboardSyncPeers()
+		if len(peerIDs) == 0 {
+			initialized = false
+			continue
+		}
+
+		content, err := s.readClipboard(context.Background())
+		if err != nil {
+			continue
+		}
+		hash := content.hash()
+		s.clipMu.Lock()
+		changed := hash != s.clipLast
+		s.clipLast = hash
+		s.clipMu.Unlock()
+		if !initialized {
+			initialized = true
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		for _, peerID := range peerIDs {
+			peer, ok := s.discoveryService.GetPeerByID(peerID)
+			if !ok || !s.config.IsTrusted(peerID) || peer.TrustMismatch {
+				continue
+			}
+			ip, ok := latestRouteIP(peer)
+			if !ok {
+				continue
+			}
+			// 新内容覆盖尚未送达的旧内容
+			if prev, ok := inflight[peerID]; ok {
+				s.CancelTransfer(prev.ID)
+			}
+			task, _ := s.sendClipboard(peer, ip, content, true)
+			inflight[peerID] = task
+		}
+		slog.Debug("Clipboard changed, syncing", "mime", content.mimeType, "component", "clipboard")
+	}
+}
@@ -0,0 +1,129 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"mesh-drop/internal/config"
+	"mesh-drop/internal/discovery"
+)
+
+// conflictPolicyFor 计算接收 sender 内容时使用的冲突策略
+// 优先级: 受信任节点的单独设置 > 全局设置
+func (s *Service) conflictPolicyFor(sender discovery.Peer) config.ConflictPolicy {
+	if settings, ok := s.peerSettingsFor(sender); ok && settings.ConflictPolicy != "" {
+		return settings.ConflictPolicy
+	}
+	if policy := s.config.GetConflictPolicy(); policy != "" {
+		return policy
+	}
+	return config.ConflictPolicyRename
+}
+
+// uniquePath 在 dir 下为 name 生成不存在的路径
+// 文件形如 "name (1).ext"，文件夹形如 "name (1)"
+func uniquePath(dir, name string, isDir bool) string {
+	base, ext := name, ""
+	if !isDir {
+		ext = filepath.Ext(name)
+		base = strings.TrimSuffix(name, ext)
+	}
+	destPath := filepath.Join(dir, name)
+	_, err := os.Lstat(destPath)
+	for counter := 1; err == nil; counter++ {
+		destPath = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, counter, ext))
+		_, err = os.Lstat(destPath)
+	}
+	return destPath
+}
+
+// resolveFileDest 按冲突策略计算文件的保存路径
+// skip 为 true 表示目标位置已存在相同文件，无需写入
+func resolveFileDest(
+	ctx context.Context,
+	dir, name string,
+	policy config.ConflictPolicy,
+	size int64,
+	hash string,
+) (destPath string, skip bool) {
+	destPath = filepath.Join(dir, name)
+	if _, err := os.Lstat(destPath); err != nil {
+		return destPath, false
+	}
+
+	switch policy {
+	case config.ConflictPolicyOverwrite:
+		return destPath, false
+	case config.ConflictPolicySkip:
+		if sameFile(ctx, destPath, size, hash) {
+			return destPath, true
+		}
+	}
+	// rename，以及 ask 在未得到用户选择时都按 rename 处理
+	return uniquePath(dir, name, false), false
+}
+
+// resolveFolderDest 按冲突策略计算文件夹的保存路径
+// merge 为 true 表示写入已有文件夹，其中的文件按同一策略逐个处理
+func resolveFolderDest(
+	dir, name string,
+	policy config.ConflictPolicy,
+) (destPath string, merge bool) {
+	destPath = filepath.Join(dir, name)
+	info, err := os.Lstat(destPath)
+	if err != nil {
+		return destPath, false
+	}
+
+	if info.IsDir() &&
+		(policy == config.ConflictPolicyOverwrite || policy == config.ConflictPolicySkip) {
+		return destPath, true
+	}
+	return uniquePath(dir, name, true), false
+}
+
+// sameFile 判断 path 的大小与 SHA-256 是否与给定值一致
+func sameFile(ctx context.Context, path string, size int64, hash string) bool {
+	if hash == "" {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != size {
+		return false
+	}
+	localHash, err := hashFile(ctx, path)
+	if err != nil {
+		return false
+	}
+	return localHash == hash
+}
+
+// hashFile 计算文件的 SHA-256 (hex)
+func hashFile(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, &ContextReader{ctx: ctx, r: f}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// validFileHash 判断 hash 是否为 SHA-256 (hex)
+func validFileHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
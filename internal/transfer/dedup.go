@@ -0,0 +1,345 @@
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"mesh-drop/internal/config"
+	"mesh-drop/internal/discovery"
+	"mesh-drop/internal/fsutil"
+)
+
+// hashIndexEntry 是哈希索引中的一个本地文件
+type hashIndexEntry struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"` // 毫秒，文件变化后该记录失效
+}
+
+// hashIndex 记录本地已有文件的内容哈希，用于接收时去重
+// 包括接收到的文件以及保存路径下扫描到的文件
+// 每个保存路径只完整扫描一次，之后随接收增量更新，失效的记录在查找时清理
+type hashIndex struct {
+	mu    sync.Mutex
+	path  string
+	items map[string][]hashIndexEntry // Key: sha256
+	// roots 已完成扫描的目录
+	roots map[string]bool
+	// scanning 正在扫描的目录
+	scanning map[string]bool
+}
+
+// hashIndexFile 是索引文件的格式
+type hashIndexFile struct {
+	Roots []string                    `json:"roots"`
+	Items map[string][]hashIndexEntry `json:"items"`
+}
+
+func (s *Service) hashIndexPath() string {
+	return filepath.Join(s.configDir, "hash_index.json")
+}
+
+func newHashIndex(path string) *hashIndex {
+	x := &hashIndex{
+		path:     path,
+		items:    make(map[string][]hashIndexEntry),
+		roots:    make(map[string]bool),
+		scanning: make(map[string]bool),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return x
+	}
+	var file hashIndexFile
+	if err := json.Unmarshal(data, &file); err != nil || file.Items == nil {
+		// 旧版本的索引文件只有哈希表，其中的目录需要重新扫描
+		file = hashIndexFile{}
+		if err := json.Unmarshal(data, &file.Items); err != nil {
+			slog.Warn("Failed to parse hash index", "error", err, "component", "transfer")
+			return x
+		}
+	}
+	if file.Items != nil {
+		x.items = file.Items
+	}
+	for _, root := range file.Roots {
+		x.roots[root] = true
+	}
+	return x
+}
+
+// add 记录 path 的哈希并保存索引
+func (x *hashIndex) add(hash, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.put(hash, path, info)
+	x.save()
+}
+
+// put 需要在持有 mu 时调用
+func (x *hashIndex) put(hash, path string, info os.FileInfo) {
+	entries := x.items[hash]
+	for i, entry := range entries {
+		if entry.Path == path {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	x.items[hash] = append(entries, hashIndexEntry{
+		Path:    path,
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixMilli(),
+	})
+}
+
+// save 需要在持有 mu 时调用
+func (x *hashIndex) save() {
+	file := hashIndexFile{Items: x.items}
+	for root := range x.roots {
+		file.Roots = append(file.Roots, root)
+	}
+	sort.Strings(file.Roots)
+	data, err := json.Marshal(file)
+	if err != nil {
+		return
+	}
+	tempPath := x.path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0o600); err != nil {
+		slog.Warn("Failed to write hash index", "error", err, "component", "transfer")
+		return
+	}
+	if err := os.Rename(tempPath, x.path); err != nil {
+		_ = os.Remove(tempPath)
+	}
+}
+
+// lookup 查找内容相同且自记录以来未被修改的本地文件，同时清理失效的记录
+func (x *hashIndex) lookup(hash string, size int64) (string, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	entries := x.items[hash]
+	valid := entries[:0]
+	found := ""
+	for _, entry := range entries {
+		info, err := os.Stat(entry.Path)
+		if err != nil || !info.Mode().IsRegular() ||
+			info.Size() != entry.Size || info.ModTime().UnixMilli() != entry.ModTime {
+			continue
+		}
+		valid = append(valid, entry)
+		if found == "" && entry.Size == size {
+			found = entry.Path
+		}
+	}
+	if len(valid) != len(entries) {
+		if len(valid) == 0 {
+			delete(x.items, hash)
+		} else {
+			x.items[hash] = valid
+		}
+		x.save()
+	}
+	return found, found != ""
+}
+
+// scanOnce 在后台扫描尚未扫描过的 root，已扫描或正在扫描时直接返回
+func (x *hashIndex) scanOnce(ctx context.Context, root string) {
+	if root == "" {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.roots[root] || x.scanning[root] {
+		return
+	}
+	x.scanning[root] = true
+	go x.scan(ctx, root)
+}
+
+// scan 为 root 下尚未记录或已变化的文件计算哈希，完成后记录 root
+func (x *hashIndex) scan(ctx context.Context, root string) {
+	defer func() {
+		x.mu.Lock()
+		delete(x.scanning, root)
+		x.mu.Unlock()
+	}()
+
+	x.mu.Lock()
+	known := make(map[string]hashIndexEntry)
+	for _, entries := range x.items {
+		for _, entry := range entries {
+			known[entry.Path] = entry
+		}
+	}
+	x.mu.Unlock()
+
+	added := 0
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if isPartialName(d.Name()) || !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() == 0 {
+			return nil
+		}
+		if entry, ok := known[p]; ok &&
+			entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixMilli() {
+			return nil
+		}
+		hash, err := hashFile(ctx, p)
+		if err != nil {
+			return nil
+		}
+		x.mu.Lock()
+		x.put(hash, p, info)
+		x.mu.Unlock()
+		added++
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	x.mu.Lock()
+	x.roots[root] = true
+	x.save()
+	x.mu.Unlock()
+	slog.Info("Hash index updated", "root", root, "added", added, "component", "transfer")
+}
+
+// dedupModeFor 计算接收 sender 内容时的去重方式
+// 去重的结果会告诉发送端接收端是否已有相同内容，只对受信任节点使用
+func (s *Service) dedupModeFor(sender discovery.Peer) config.DedupMode {
+	mode := s.config.GetDedupMode()
+	if mode == "" || !s.isTrusted(sender) {
+		return config.DedupModeOff
+	}
+	return mode
+}
+
+// dedupFile 接收端已有相同内容的文件时直接在本地生成，不再通过网络传输
+// 返回 true 表示已完成接收
+func (s *Service) dedupFile(ctx context.Context, task *Transfer, savePath string) bool {
+	mode := s.dedupModeFor(task.Sender)
+	if mode == config.DedupModeOff || task.FileHash == "" {
+		return false
+	}
+	// 保存路径尚未建立索引时在后台扫描，本次按未命中处理
+	s.hashIndex.scanOnce(context.Background(), s.config.GetSavePath())
+	src, ok := s.hashIndex.lookup(task.FileHash, task.FileSize)
+	if !ok {
+		return false
+	}
+
+	dest, skip := resolveFileDest(
+		ctx,
+		savePath,
+		task.FileName,
+		task.ConflictPolicy,
+		task.FileSize,
+		task.FileHash,
+	)
+	if !skip && dest != src {
+		if err := s.placeLocalCopy(ctx, mode, src, dest, task.ID); err != nil {
+			slog.Warn("Failed to deduplicate file", "src", src, "dest", dest, "error", err)
+			return false
+		}
+	}
+
+	slog.Info(
+		"File deduplicated from local copy",
+		"id",
+		task.ID,
+		"src",
+		src,
+		"dest",
+		dest,
+		"mode",
+		mode,
+		"component",
+		"transfer",
+	)
+	task.update(func() {
+		task.Deduplicated = true
+		task.FilePath = dest
+	})
+	task.complete()
+	s.onReceiveCompleted(task)
+	return true
+}
+
+// placeLocalCopy 按 mode 将 src 复制或链接到 dest
+// 先生成同目录下的临时文件再重命名，硬链接与写时复制失败时回退到普通复制
+func (s *Service) placeLocalCopy(
+	ctx context.Context,
+	mode config.DedupMode,
+	src, dest, id string,
+) error {
+	tempPath := filepath.Join(filepath.Dir(dest), partFileName(id, filepath.Base(dest)))
+	s.partials.add(tempPath, partialKindFile)
+	defer s.partials.remove(tempPath)
+
+	var err error
+	switch mode {
+	case config.DedupModeHardLink:
+		err = os.Link(src, tempPath)
+	case config.DedupModeReflink:
+		err = fsutil.Reflink(src, tempPath)
+	default:
+		err = errors.ErrUnsupported
+	}
+	if err != nil {
+		if mode != config.DedupModeCopy {
+			slog.Debug("Falling back to copy", "mode", mode, "error", err)
+		}
+		if err := copyFile(ctx, src, tempPath); err != nil {
+			_ = os.Remove(tempPath)
+			return err
+		}
+	}
+	if err := os.Rename(tempPath, dest); err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// copyFile 复制文件内容到新建的 dst
+func copyFile(ctx context.Context, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o666) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, &ContextReader{ctx: ctx, r: in}); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
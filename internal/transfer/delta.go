@@ -0,0 +1,343 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// 增量传输
+//
+// 接收端在 ask 回应中返回目标路径已有文件 (基准文件) 的分块签名，
+// 发送端使用滚动校验和在新文件中查找相同的块，只发送变化的数据。
+// 上传内容为一系列指令：
+//
+//	'C' + uint32 块序号             复制基准文件中的块
+//	'L' + uint32 长度 + 数据        写入新数据
+//	'E'                             结束
+//
+// 接收端还原后校验整个文件的哈希，与 ask 中的 FileHash 不一致时传输失败。
+
+const deltaContentType = "application/x-meshdrop-delta"
+
+const (
+	deltaOpCopy    byte = 'C'
+	deltaOpLiteral byte = 'L'
+	deltaOpEnd     byte = 'E'
+)
+
+const (
+	deltaMinBlockSize = 2 << 10
+	deltaMaxBlockSize = 1 << 20
+	// deltaMaxLiteral 单条新数据指令的最大长度
+	deltaMaxLiteral = 64 << 10
+	// deltaMaxBasisSize 基准文件的大小上限
+	// 签名在回复 ask 前计算，更大的文件会让发送端等待太久，直接完整传输
+	deltaMaxBasisSize = 1 << 30
+)
+
+// DeltaSignature 基准文件的分块签名
+type DeltaSignature struct {
+	BlockSize int          `json:"block_size"`
+	Blocks    []DeltaBlock `json:"blocks"`
+}
+
+// DeltaBlock 单个块的签名
+type DeltaBlock struct {
+	Weak   uint32 `json:"w"` // 滚动校验和
+	Strong string `json:"s"` // sha256 前 16 字节
+}
+
+// deltaBlockSize 根据基准文件大小选择块大小，约为文件大小的平方根
+func deltaBlockSize(size int64) int {
+	b := int(math.Sqrt(float64(size)))
+	b = (b + 1023) &^ 1023
+	return min(max(b, deltaMinBlockSize), deltaMaxBlockSize)
+}
+
+// rollingChecksum 是 rsync 使用的弱校验和，可以在窗口滑动时以 O(1) 更新
+type rollingChecksum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingChecksum(p []byte) rollingChecksum {
+	var r rollingChecksum
+	r.n = uint32(len(p)) //nolint:gosec
+	for i, c := range p {
+		r.a += uint32(c)
+		r.b += (r.n - uint32(i)) * uint32(c) //nolint:gosec
+	}
+	return r
+}
+
+func (r rollingChecksum) sum() uint32 {
+	return (r.a & 0xffff) | (r.b&0xffff)<<16
+}
+
+// roll 移出窗口首字节 out 并在末尾加入 in
+func (r *rollingChecksum) roll(out, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.n*uint32(out) + r.a
+}
+
+// shrink 移出窗口首字节 out，用于文件末尾不足一个块的部分
+func (r *rollingChecksum) shrink(out byte) {
+	r.a -= uint32(out)
+	r.b -= r.n * uint32(out)
+	r.n--
+}
+
+func strongSum(p []byte) string {
+	sum := sha256.Sum256(p)
+	return hex.EncodeToString(sum[:16])
+}
+
+// computeDeltaSignature 计算基准文件的分块签名
+func computeDeltaSignature(ctx context.Context, path string) (*DeltaSignature, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	sig := &DeltaSignature{BlockSize: deltaBlockSize(info.Size())}
+	r := bufio.NewReaderSize(&ContextReader{ctx: ctx, r: file}, deltaMaxBlockSize)
+	buf := make([]byte, sig.BlockSize)
+	for {
+		// 发送端放弃时尽快停止
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, DeltaBlock{
+				Weak:   newRollingChecksum(buf[:n]).sum(),
+				Strong: strongSum(buf[:n]),
+			})
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// deltaWriter 编码增量指令
+type deltaWriter struct {
+	w       *bufio.Writer
+	literal []byte
+}
+
+func (d *deltaWriter) copyBlock(index int) error {
+	if err := d.flushLiteral(); err != nil {
+		return err
+	}
+	var op [5]byte
+	op[0] = deltaOpCopy
+	binary.BigEndian.PutUint32(op[1:], uint32(index)) //nolint:gosec
+	_, err := d.w.Write(op[:])
+	return err
+}
+
+func (d *deltaWriter) writeByte(c byte) error {
+	d.literal = append(d.literal, c)
+	if len(d.literal) >= deltaMaxLiteral {
+		return d.flushLiteral()
+	}
+	return nil
+}
+
+func (d *deltaWriter) flushLiteral() error {
+	if len(d.literal) == 0 {
+		return nil
+	}
+	var op [5]byte
+	op[0] = deltaOpLiteral
+	binary.BigEndian.PutUint32(op[1:], uint32(len(d.literal))) //nolint:gosec
+	if _, err := d.w.Write(op[:]); err != nil {
+		return err
+	}
+	if _, err := d.w.Write(d.literal); err != nil {
+		return err
+	}
+	d.literal = d.literal[:0]
+	return nil
+}
+
+func (d *deltaWriter) end() error {
+	if err := d.flushLiteral(); err != nil {
+		return err
+	}
+	if err := d.w.WriteByte(deltaOpEnd); err != nil {
+		return err
+	}
+	return d.w.Flush()
+}
+
+// writeDelta 读取新文件 r，对照基准文件签名写出增量指令
+func writeDelta(w io.Writer, r io.Reader, sig *DeltaSignature) error {
+	bs := sig.BlockSize
+	if bs <= 0 {
+		return errors.New("invalid delta block size")
+	}
+	blocks := make(map[uint32][]int, len(sig.Blocks))
+	for i, block := range sig.Blocks {
+		blocks[block.Weak] = append(blocks[block.Weak], i)
+	}
+	match := func(window []byte, weak uint32) (int, bool) {
+		candidates, ok := blocks[weak]
+		if !ok {
+			return 0, false
+		}
+		strong := strongSum(window)
+		for _, i := range candidates {
+			if sig.Blocks[i].Strong == strong {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+
+	br := bufio.NewReaderSize(r, deltaMaxBlockSize)
+	dw := &deltaWriter{
+		w:       bufio.NewWriterSize(w, deltaMaxLiteral),
+		literal: make([]byte, 0, deltaMaxLiteral),
+	}
+
+	window := make([]byte, 0, bs)
+	// fill 读取一个完整的窗口，返回是否已读到文件末尾
+	fill := func() (bool, error) {
+		if cap(window) < bs {
+			window = make([]byte, bs)
+		}
+		window = window[:bs]
+		n, err := io.ReadFull(br, window)
+		window = window[:n]
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	eof, err := fill()
+	if err != nil {
+		return err
+	}
+	sum := newRollingChecksum(window)
+	for len(window) > 0 {
+		if i, ok := match(window, sum.sum()); ok {
+			if err := dw.copyBlock(i); err != nil {
+				return err
+			}
+			if eof {
+				break
+			}
+			if eof, err = fill(); err != nil {
+				return err
+			}
+			sum = newRollingChecksum(window)
+			continue
+		}
+
+		out := window[0]
+		if err := dw.writeByte(out); err != nil {
+			return err
+		}
+		if !eof {
+			c, err := br.ReadByte()
+			if err == nil {
+				sum.roll(out, c)
+				window = append(window[1:], c)
+				continue
+			}
+			if !errors.Is(err, io.EOF) {
+				return err
+			}
+			eof = true
+		}
+		sum.shrink(out)
+		window = window[1:]
+	}
+	return dw.end()
+}
+
+// applyDelta 读取增量指令，使用基准文件还原出新文件写入 w
+// 还原结果的哈希与 expectedHash 不一致时返回错误
+func applyDelta(
+	w io.Writer,
+	r io.Reader,
+	basis *os.File,
+	blockSize int,
+	expectedHash string,
+) error {
+	info, err := basis.Stat()
+	if err != nil {
+		return err
+	}
+	blockCount := (info.Size() + int64(blockSize) - 1) / int64(blockSize)
+
+	hasher := sha256.New()
+	out := io.MultiWriter(w, hasher)
+	br := bufio.NewReader(r)
+	buf := make([]byte, max(blockSize, deltaMaxLiteral))
+	var header [4]byte
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case deltaOpCopy:
+			if _, err := io.ReadFull(br, header[:]); err != nil {
+				return err
+			}
+			index := int64(binary.BigEndian.Uint32(header[:]))
+			if index >= blockCount {
+				return fmt.Errorf("delta block %d out of range", index)
+			}
+			offset := index * int64(blockSize)
+			n := min(int64(blockSize), info.Size()-offset)
+			if _, err := basis.ReadAt(buf[:n], offset); err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+		case deltaOpLiteral:
+			if _, err := io.ReadFull(br, header[:]); err != nil {
+				return err
+			}
+			n := binary.BigEndian.Uint32(header[:])
+			if n > deltaMaxLiteral {
+				return fmt.Errorf("delta literal too large: %d", n)
+			}
+			if _, err := io.ReadFull(br, buf[:n]); err != nil {
+				return err
+			}
+			if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+		case deltaOpEnd:
+			if hash := hex.EncodeToString(hasher.Sum(nil)); hash != expectedHash {
+				return fmt.Errorf("hash mismatch after applying delta: %s", hash)
+			}
+			return nil
+		default:
+			return fmt.Errorf("unknown delta op: %q", op)
+		}
+	}
+}
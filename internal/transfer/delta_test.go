@@ -0,0 +1,115 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func randomBytes(rng *rand.Rand, n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(rng.Uint32())
+	}
+	return p
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	// 最后一块不满一个块大小
+	basis := randomBytes(rng, 10*deltaMinBlockSize+700)
+	insert := randomBytes(rng, 300)
+
+	cases := []struct {
+		name string
+		data []byte
+		// copies 为 true 时增量应远小于新文件
+		copies bool
+	}{
+		{"identical", basis, true},
+		{"insert middle", slices.Concat(basis[:5000], insert, basis[5000:]), true},
+		{"insert start", slices.Concat(insert, basis), true},
+		{"append", slices.Concat(basis, insert), true},
+		{"delete middle", slices.Concat(basis[:3000], basis[9000:]), true},
+		{"delete short last block", basis[:10*deltaMinBlockSize], true},
+		{"truncate inside last block", basis[:len(basis)-100], true},
+		{"replace", randomBytes(rng, len(basis)), false},
+		{"empty", nil, false},
+	}
+
+	path := filepath.Join(t.TempDir(), "basis")
+	if err := os.WriteFile(path, basis, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := computeDeltaSignature(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (len(basis) + sig.BlockSize - 1) / sig.BlockSize; len(sig.Blocks) != want {
+		t.Fatalf("got %d blocks, want %d", len(sig.Blocks), want)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var encoded bytes.Buffer
+			if err := writeDelta(&encoded, bytes.NewReader(tc.data), sig); err != nil {
+				t.Fatalf("writeDelta: %v", err)
+			}
+			if tc.copies && encoded.Len() > len(tc.data)/2 {
+				t.Errorf("delta is %d bytes for %d bytes of data", encoded.Len(), len(tc.data))
+			}
+
+			sum := sha256.Sum256(tc.data)
+			var out bytes.Buffer
+			err := applyDelta(
+				&out,
+				bytes.NewReader(encoded.Bytes()),
+				file,
+				sig.BlockSize,
+				hex.EncodeToString(sum[:]),
+			)
+			if err != nil {
+				t.Fatalf("applyDelta: %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), tc.data) {
+				t.Errorf("got %d bytes, want %d", out.Len(), len(tc.data))
+			}
+		})
+	}
+}
+
+func TestApplyDeltaRejectsHashMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "basis")
+	if err := os.WriteFile(path, []byte("basis"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	encoded := []byte{deltaOpCopy, 0, 0, 0, 0, deltaOpEnd}
+	sum := sha256.Sum256([]byte("other"))
+	err = applyDelta(
+		&bytes.Buffer{},
+		bytes.NewReader(encoded),
+		file,
+		deltaMinBlockSize,
+		hex.EncodeToString(sum[:]),
+	)
+	if err == nil {
+		t.Fatal("expected hash mismatch")
+	}
+}
@@ -0,0 +1,469 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"mesh-drop/internal/discovery"
+	"mesh-drop/internal/security"
+)
+
+// HistoryFormat 历史导出格式
+type HistoryFormat string
+
+const (
+	HistoryFormatCSV   HistoryFormat = "csv"
+	HistoryFormatJSONL HistoryFormat = "jsonl"
+	HistoryFormatHTML  HistoryFormat = "html" // 只用于阅读与打印，不能导入
+)
+
+// exportTimeLayout 导出的时间格式 (UTC，毫秒精度)
+const exportTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// historyEntry 导出的一条历史记录
+// CSV 的列与 JSON 字段同名，顺序与 historyColumns 相同
+type historyEntry struct {
+	ID                string         `json:"id"`
+	Type              TransferType   `json:"type"`
+	ContentType       ContentType    `json:"content_type"`
+	Status            TransferStatus `json:"status"`
+	FileName          string         `json:"file_name"`
+	FileSize          int64          `json:"file_size"`
+	FileHash          string         `json:"file_hash"`
+	SenderID          string         `json:"sender_id"`
+	SenderName        string         `json:"sender_name"`
+	SenderPublicKey   string         `json:"sender_public_key"`
+	SenderFingerprint string         `json:"sender_fingerprint"`
+	TargetID          string         `json:"target_id"`
+	TargetName        string         `json:"target_name"`
+	CreateTime        string         `json:"create_time"`
+	FinishTime        string         `json:"finish_time"`
+	FilePath          string         `json:"file_path"`
+	URL               string         `json:"url"`
+	Text              string         `json:"text"`
+	Error             string         `json:"error"`
+}
+
+var historyColumns = []string{
+	"id",
+	"type",
+	"content_type",
+	"status",
+	"file_name",
+	"file_size",
+	"file_hash",
+	"sender_id",
+	"sender_name",
+	"sender_public_key",
+	"sender_fingerprint",
+	"target_id",
+	"target_name",
+	"create_time",
+	"finish_time",
+	"file_path",
+	"url",
+	"text",
+	"error",
+}
+
+func formatExportTime(ms int64) string {
+	if ms <= 0 {
+		return ""
+	}
+	return time.UnixMilli(ms).UTC().Format(exportTimeLayout)
+}
+
+func parseExportTime(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(exportTimeLayout, value)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixMilli(), nil
+}
+
+func newHistoryEntry(t *Transfer) historyEntry {
+	return historyEntry{
+		ID:                t.ID,
+		Type:              t.Type,
+		ContentType:       t.ContentType,
+		Status:            t.Status,
+		FileName:          t.FileName,
+		FileSize:          t.FileSize,
+		FileHash:          t.FileHash,
+		SenderID:          t.Sender.ID,
+		SenderName:        t.Sender.Name,
+		SenderPublicKey:   t.Sender.PublicKey,
+		SenderFingerprint: security.Fingerprint(t.Sender.PublicKey),
+		TargetID:          t.TargetID,
+		TargetName:        t.TargetName,
+		CreateTime:        formatExportTime(t.CreateTime),
+		FinishTime:        formatExportTime(t.FinishTime),
+		FilePath:          t.FilePath,
+		URL:               t.URL,
+		Text:              t.Text,
+		Error:             t.ErrorMsg,
+	}
+}
+
+func (e historyEntry) row() []string {
+	return []string{
+		e.ID,
+		string(e.Type),
+		string(e.ContentType),
+		string(e.Status),
+		e.FileName,
+		strconv.FormatInt(e.FileSize, 10),
+		e.FileHash,
+		e.SenderID,
+		e.SenderName,
+		e.SenderPublicKey,
+		e.SenderFingerprint,
+		e.TargetID,
+		e.TargetName,
+		e.CreateTime,
+		e.FinishTime,
+		e.FilePath,
+		e.URL,
+		e.Text,
+		e.Error,
+	}
+}
+
+// 导入的记录只接受已知的类型、内容类型与状态
+var (
+	importTypes        = []TransferType{TransferTypeSend, TransferTypeReceive, TransferTypeShare}
+	importContentTypes = []ContentType{
+		ContentTypeFile,
+		ContentTypeText,
+		ContentTypeFolder,
+		ContentTypeClipboard,
+		ContentTypeURL,
+		ContentTypeImage,
+		ContentTypeStream,
+	}
+	importStatuses = []TransferStatus{
+		TransferStatusPending,
+		TransferStatusAccepted,
+		TransferStatusRejected,
+		TransferStatusCompleted,
+		TransferStatusError,
+		TransferStatusCanceled,
+		TransferStatusActive,
+		TransferStatusRetrying,
+		TransferStatusWaiting,
+		TransferStatusScheduled,
+	}
+)
+
+// transfer 将导入的记录转换为任务
+func (e historyEntry) transfer() (*Transfer, error) {
+	if strings.TrimSpace(e.ID) == "" {
+		return nil, errors.New("missing id")
+	}
+	if !slices.Contains(importTypes, e.Type) {
+		return nil, fmt.Errorf("invalid type %q", e.Type)
+	}
+	if !slices.Contains(importContentTypes, e.ContentType) {
+		return nil, fmt.Errorf("invalid content_type %q", e.ContentType)
+	}
+	if !slices.Contains(importStatuses, e.Status) {
+		return nil, fmt.Errorf("invalid status %q", e.Status)
+	}
+	createTime, err := parseExportTime(e.CreateTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid create_time: %w", err)
+	}
+	finishTime, err := parseExportTime(e.FinishTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid finish_time: %w", err)
+	}
+	t := &Transfer{transferData: transferData{
+		ID:          e.ID,
+		CreateTime:  createTime,
+		FinishTime:  finishTime,
+		Type:        e.Type,
+		ContentType: e.ContentType,
+		Status:      e.Status,
+		FileName:    e.FileName,
+		FileSize:    e.FileSize,
+		FileHash:    e.FileHash,
+		Sender: discovery.Peer{
+			ID:        e.SenderID,
+			Name:      e.SenderName,
+			PublicKey: e.SenderPublicKey,
+		},
+		TargetID:   e.TargetID,
+		TargetName: e.TargetName,
+		FilePath:   e.FilePath,
+		URL:        e.URL,
+		Text:       e.Text,
+		ErrorMsg:   e.Error,
+		Imported:   true,
+	}}
+	if t.Status == TransferStatusCompleted {
+		t.Progress = Progress{Current: t.FileSize, Total: t.FileSize}
+	}
+	return t, nil
+}
+
+// ExportHistory 将满足条件的传输记录导出到 path
+// 忽略 query 的分页参数，导出全部满足条件的记录
+func (s *Service) ExportHistory(path string, format HistoryFormat, query TransferQuery) error {
+	query.Offset, query.Limit = 0, 0
+	tasks := s.QueryTransfers(query).Items
+
+	tempPath := path + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	err = writeHistory(w, format, tasks)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+	}
+	return err
+}
+
+// WriteHistory 将满足条件的传输记录按 format 写入 w
+func (s *Service) WriteHistory(w io.Writer, format HistoryFormat, query TransferQuery) error {
+	query.Offset, query.Limit = 0, 0
+	return writeHistory(w, format, s.QueryTransfers(query).Items)
+}
+
+func writeHistory(w io.Writer, format HistoryFormat, tasks []*Transfer) error {
+	switch format {
+	case HistoryFormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(historyColumns); err != nil {
+			return err
+		}
+		for _, t := range tasks {
+			if err := cw.Write(csvEscape(newHistoryEntry(t).row())); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case HistoryFormatJSONL:
+		enc := json.NewEncoder(w)
+		for _, t := range tasks {
+			if err := enc.Encode(newHistoryEntry(t)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case HistoryFormatHTML:
+		entries := make([]historyEntry, 0, len(tasks))
+		for _, t := range tasks {
+			entries = append(entries, newHistoryEntry(t))
+		}
+		return historyReport.Execute(w, map[string]any{
+			"Generated": time.Now().UTC().Format(exportTimeLayout),
+			"Entries":   entries,
+		})
+	default:
+		return fmt.Errorf("unsupported format %q", format)
+	}
+}
+
+var historyReport = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>MeshDrop transfer history</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; margin: 24px; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #ccc; padding: 4px 6px; text-align: left; vertical-align: top; }
+th { background: #f0f0f0; }
+td.mono { font-family: monospace; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>MeshDrop transfer history</h1>
+<p>Generated {{.Generated}}, {{len .Entries}} transfers.</p>
+<table>
+<tr>
+<th>Created</th><th>Finished</th><th>Type</th><th>Status</th><th>Content</th><th>Name</th><th>Size</th>
+<th>Sender</th><th>Fingerprint</th><th>Target</th><th>SHA-256</th>
+</tr>
+{{range .Entries}}<tr>
+<td>{{.CreateTime}}</td>
+<td>{{.FinishTime}}</td>
+<td>{{.Type}}</td>
+<td>{{.Status}}{{if .Error}}<br>{{.Error}}{{end}}</td>
+<td>{{.ContentType}}</td>
+<td>{{if .URL}}{{.URL}}{{else}}{{.FileName}}{{end}}</td>
+<td>{{.FileSize}}</td>
+<td>{{.SenderName}}<br><span class="mono">{{.SenderID}}</span></td>
+<td class="mono">{{.SenderFingerprint}}</td>
+<td>{{.TargetName}}</td>
+<td class="mono">{{.FileHash}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// ImportHistory 导入 CSV 或 JSON Lines 格式的历史，按扩展名判断格式
+// 已存在的 ID 会被跳过，返回新导入的记录数
+func (s *Service) ImportHistory(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	format := HistoryFormatJSONL
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		format = HistoryFormatCSV
+	}
+	return s.ReadHistory(file, format)
+}
+
+// ReadHistory 从 r 导入历史，已存在的 ID 会被跳过，返回新导入的记录数
+func (s *Service) ReadHistory(r io.Reader, format HistoryFormat) (int, error) {
+	var entries []historyEntry
+	switch format {
+	case HistoryFormatCSV:
+		cr := csv.NewReader(r)
+		header, err := cr.Read()
+		if err != nil {
+			return 0, err
+		}
+		index := make(map[string]int, len(header))
+		for i, name := range header {
+			index[strings.TrimSpace(name)] = i
+		}
+		if _, ok := index["id"]; !ok {
+			return 0, errors.New("missing id column")
+		}
+		for line := 2; ; line++ {
+			record, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+			entry, err := csvHistoryEntry(index, record)
+			if err != nil {
+				return 0, fmt.Errorf("line %d: %w", line, err)
+			}
+			entries = append(entries, entry)
+		}
+	case HistoryFormatJSONL:
+		dec := json.NewDecoder(r)
+		for line := 1; ; line++ {
+			var entry historyEntry
+			err := dec.Decode(&entry)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return 0, fmt.Errorf("record %d: %w", line, err)
+			}
+			entries = append(entries, entry)
+		}
+	default:
+		return 0, fmt.Errorf("unsupported format %q", format)
+	}
+
+	// 先全部转换，格式错误时不导入任何记录
+	tasks := make([]*Transfer, 0, len(entries))
+	seen := make(map[string]bool, len(entries))
+	for i, entry := range entries {
+		t, err := entry.transfer()
+		if err != nil {
+			return 0, fmt.Errorf("record %d: %w", i+1, err)
+		}
+		if seen[t.ID] {
+			continue
+		}
+		seen[t.ID] = true
+		if _, exists := s.transfers.Load(t.ID); exists {
+			continue
+		}
+		markInterrupted(t)
+		tasks = append(tasks, t)
+	}
+	s.StoreTransfersToList(tasks)
+	return len(tasks), nil
+}
+
+// csvFormulaPrefixes 电子表格会将以这些字符开头的单元格作为公式执行
+// 以单引号开头的单元格同样需要转义，导入时才能还原
+const csvFormulaPrefixes = "=+-@\t\r'"
+
+// csvEscape 在可能被作为公式的单元格前加单引号
+// 文件名、节点名称、文本与链接都由其他节点提供，导出的文件可能在电子表格中打开
+func csvEscape(row []string) []string {
+	for i, cell := range row {
+		if cell != "" && strings.ContainsRune(csvFormulaPrefixes, rune(cell[0])) {
+			row[i] = "'" + cell
+		}
+	}
+	return row
+}
+
+func csvHistoryEntry(index map[string]int, record []string) (historyEntry, error) {
+	get := func(name string) string {
+		if i, ok := index[name]; ok && i < len(record) {
+			// 还原 csvEscape 添加的单引号
+			return strings.TrimPrefix(record[i], "'")
+		}
+		return ""
+	}
+	var size int64
+	if value := get("file_size"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return historyEntry{}, fmt.Errorf("invalid file_size: %w", err)
+		}
+		size = n
+	}
+	return historyEntry{
+		ID:                get("id"),
+		Type:              TransferType(get("type")),
+		ContentType:       ContentType(get("content_type")),
+		Status:            TransferStatus(get("status")),
+		FileName:          get("file_name"),
+		FileSize:          size,
+		FileHash:          get("file_hash"),
+		SenderID:          get("sender_id"),
+		SenderName:        get("sender_name"),
+		SenderPublicKey:   get("sender_public_key"),
+		SenderFingerprint: get("sender_fingerprint"),
+		TargetID:          get("target_id"),
+		TargetName:        get("target_name"),
+		CreateTime:        get("create_time"),
+		FinishTime:        get("finish_time"),
+		FilePath:          get("file_path"),
+		URL:               get("url"),
+		Text:              get("text"),
+		Error:             get("error"),
+	}, nil
+}
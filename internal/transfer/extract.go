@@ -0,0 +1,536 @@
+package transfer
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"mesh-drop/internal/audit"
+	"mesh-drop/internal/config"
+	"mesh-drop/internal/fsutil"
+)
+
+// paxXattrPrefix 是 tar PAX 记录中扩展属性的前缀
+const paxXattrPrefix = "SCHILY.xattr."
+
+// errUnsafeEntry 表示 tar 条目指向目标目录之外，已被跳过
+var errUnsafeEntry = errors.New("unsafe tar entry")
+
+// stageError 记录文件夹接收失败时所处的阶段
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return fmt.Sprintf("%s: %v", e.stage, e.err)
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// extractFolder 将 tar 流还原为 savePath 下的 task.FileName 文件夹，返回最终路径
+// 新文件夹先解压到同目录下的隐藏暂存目录，完成后再整体移动到最终路径
+// 合并到已有文件夹时直接写入，单个文件通过临时文件原子替换
+func (s *Service) extractFolder(
+	ctx context.Context,
+	savePath string,
+	task *Transfer,
+	r io.Reader,
+) (string, error) {
+	destPath, merge := resolveFolderDest(savePath, task.FileName, task.ConflictPolicy)
+	extractPath := filepath.Join(savePath, stagingDirName(task.ID, task.FileName))
+	if merge {
+		slog.Info("Merging into existing folder", "path", destPath, "policy", task.ConflictPolicy)
+		extractPath = destPath
+		s.partials.add(extractPath, partialKindMerge)
+	} else {
+		s.partials.add(extractPath, partialKindStaging)
+	}
+	committed := false
+	defer func() {
+		if !merge && !committed {
+			_ = os.RemoveAll(extractPath)
+		}
+		s.partials.remove(extractPath)
+	}()
+
+	if err := os.MkdirAll(extractPath, 0o750); err != nil {
+		return "", &stageError{stage: "create_folder", err: err}
+	}
+
+	// 获取绝对路径以防止 Zip Slip (G305)
+	// 必须先转换成绝对路径再判断
+	absExtractPath, err := filepath.Abs(extractPath)
+	if err != nil {
+		return "", &stageError{stage: "resolve_abs_path", err: err}
+	}
+
+	extractor := newFolderExtractor(
+		ctx,
+		absExtractPath,
+		s.config.GetFolderPolicy(),
+		task.ConflictPolicy,
+	)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", &stageError{stage: "read_tar_header", err: err}
+		}
+
+		err = extractor.extract(header, tr)
+		if errors.Is(err, errUnsafeEntry) {
+			audit.Record(audit.Event{
+				Kind:     audit.KindZipSlip,
+				PeerID:   task.Sender.ID,
+				PeerName: task.Sender.Name,
+				Message:  "Folder entry points outside of the destination",
+				Details: map[string]string{
+					"transfer_id": task.ID,
+					"entry":       header.Name,
+					"link":        header.Linkname,
+				},
+			})
+			continue
+		}
+		if err != nil {
+			return "", &stageError{stage: "write_file_content", err: err}
+		}
+	}
+	extractor.finish()
+
+	// 读取结束标记之后的内容，收到的数据量与声明的大小不一致时不移动到最终路径
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return "", &stageError{stage: "read_tar_trailer", err: err}
+	}
+
+	if !merge {
+		// 暂存期间可能出现了同名内容，重新计算最终路径
+		if _, err := os.Lstat(destPath); err == nil {
+			destPath = uniquePath(savePath, task.FileName, true)
+		}
+		if err := os.Rename(extractPath, destPath); err != nil {
+			return "", &stageError{stage: "move_staging_folder", err: err}
+		}
+		committed = true
+		if err := fsutil.SyncDir(savePath); err != nil {
+			slog.Warn("Failed to sync dir", "path", savePath, "error", err)
+		}
+	}
+	return destPath, nil
+}
+
+// folderExtractor 将 tar 流还原到目标目录，并按照 FolderPolicy 还原元数据
+type folderExtractor struct {
+	ctx context.Context
+	// root 是目标目录的绝对路径
+	root   string
+	policy config.FolderPolicy
+	// conflict 是写入已有文件夹时，单个文件的冲突策略
+	conflict config.ConflictPolicy
+
+	// dirs 记录需要在结束时设置修改时间的目录
+	// 目录的修改时间会被写入子文件改变，所以必须最后设置
+	dirs []extractedDir
+
+	// symlinks 延迟到结束时创建，避免后续条目通过符号链接写到目录之外
+	symlinks []*tar.Header
+
+	// touched 记录新增了目录项的目录，结束时落盘
+	touched map[string]struct{}
+
+	// placed 记录已还原文件的实际路径，冲突改名后硬链接按实际路径查找源文件
+	// Key: 条目在目标目录内的路径
+	placed map[string]string
+}
+
+type extractedDir struct {
+	path    string
+	modTime time.Time
+}
+
+func newFolderExtractor(
+	ctx context.Context,
+	root string,
+	policy config.FolderPolicy,
+	conflict config.ConflictPolicy,
+) *folderExtractor {
+	return &folderExtractor{
+		ctx:      ctx,
+		root:     root,
+		policy:   policy,
+		conflict: conflict,
+		placed:   make(map[string]string),
+	}
+}
+
+// resolve 将 tar 内路径转换为目标目录内的绝对路径
+// 路径不在目标目录内时返回 false (Zip Slip, G305)
+func (e *folderExtractor) resolve(name string) (string, bool) {
+	target, err := filepath.Abs(filepath.Join(e.root, filepath.Clean(filepath.FromSlash(name))))
+	if err != nil {
+		return "", false
+	}
+	if !strings.HasPrefix(target, e.root+string(os.PathSeparator)) {
+		return "", false
+	}
+	return target, true
+}
+
+// hasSymlinkParent 检查 target 与 root 之间是否存在符号链接
+func (e *folderExtractor) hasSymlinkParent(target string) bool {
+	for dir := filepath.Dir(target); len(dir) > len(e.root); dir = filepath.Dir(dir) {
+		info, err := os.Lstat(dir)
+		if err != nil {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// fileMode 根据策略计算文件权限
+func (e *folderExtractor) fileMode(header *tar.Header) os.FileMode {
+	// 去掉组和其他用户的写权限，Chmod 不受 umask 影响
+	mode := os.FileMode(header.Mode).Perm()&^0o022 | 0o600 //nolint:gosec
+	if !e.policy.Executable {
+		mode &^= 0o111
+	}
+	return mode
+}
+
+// touch 记录 dir 及其上级目录中新增了目录项
+func (e *folderExtractor) touch(dir string) {
+	if e.touched == nil {
+		e.touched = make(map[string]struct{})
+	}
+	for ; len(dir) >= len(e.root); dir = filepath.Dir(dir) {
+		if _, ok := e.touched[dir]; ok {
+			return
+		}
+		e.touched[dir] = struct{}{}
+	}
+}
+
+// extract 还原单个条目
+// 条目不安全时返回 errUnsafeEntry，由调用方记录并跳过；写入失败时返回错误，整个传输失败
+func (e *folderExtractor) extract(header *tar.Header, r io.Reader) error {
+	target, ok := e.resolve(header.Name)
+	if !ok || e.hasSymlinkParent(target) {
+		slog.Warn(
+			"Zip Slip attempt detected",
+			"header_name",
+			header.Name,
+			"resolved_path",
+			target,
+		)
+		return errUnsafeEntry
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, 0o750); err != nil {
+			return err
+		}
+		e.dirs = append(e.dirs, extractedDir{path: target, modTime: header.ModTime})
+		e.touch(filepath.Dir(target))
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(target), 0o750); err != nil {
+			return err
+		}
+		return e.extractRegular(target, header, r)
+	case tar.TypeLink:
+		source, ok := e.resolve(header.Linkname)
+		if !ok {
+			slog.Warn(
+				"Hard link points outside of folder",
+				"name",
+				header.Name,
+				"link",
+				header.Linkname,
+			)
+			return errUnsafeEntry
+		}
+		return e.extractHardLink(source, target, header)
+	case tar.TypeSymlink:
+		if !e.policy.Symlinks {
+			slog.Debug("Skipping symlink by policy", "name", header.Name)
+			return nil
+		}
+		e.symlinks = append(e.symlinks, header)
+	default:
+		slog.Debug("Skipping unsupported tar entry", "name", header.Name, "type", header.Typeflag)
+	}
+	return nil
+}
+
+// extractRegular 先将内容写入同目录下的临时文件，再按冲突策略移动到最终路径
+func (e *folderExtractor) extractRegular(target string, header *tar.Header, r io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(target), partialPrefix+"*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// 只有 skip 策略需要比较哈希
+	h := sha256.New()
+	var w io.Writer = tmp
+	if e.conflict == config.ConflictPolicySkip {
+		w = io.MultiWriter(tmp, h)
+	}
+	// nolint: gosec
+	if _, err := io.Copy(w, r); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	final, err := e.place(tmp.Name(), target, header.Size, hex.EncodeToString(h.Sum(nil)))
+	if err != nil || final == "" {
+		return err
+	}
+	// CreateTemp 创建的文件权限为 0600，这里按策略设置
+	if err := os.Chmod(final, e.fileMode(header)); err != nil {
+		slog.Debug("Failed to set file mode", "path", final, "error", err)
+	}
+	e.applyMetadata(final, header)
+	return nil
+}
+
+// place 按冲突策略将临时文件移动到 target，返回最终路径，跳过时返回空字符串
+// hash 是临时文件内容的 SHA-256，只有 skip 策略使用
+func (e *folderExtractor) place(tmpPath, target string, size int64, hash string) (string, error) {
+	final := target
+	if info, err := os.Lstat(target); err == nil {
+		// 不替换或比较已有的符号链接，避免经由链接读写目录之外的文件
+		if info.Mode()&os.ModeSymlink != 0 {
+			slog.Warn("Refusing to replace symlink", "path", target)
+			return "", errUnsafeEntry
+		}
+		switch e.conflict {
+		case config.ConflictPolicyOverwrite:
+		case config.ConflictPolicySkip:
+			if sameFile(e.ctx, target, size, hash) {
+				slog.Debug("Skipping identical file", "path", target)
+				e.placed[target] = target
+				return "", nil
+			}
+			final = uniquePath(filepath.Dir(target), filepath.Base(target), false)
+		default:
+			final = uniquePath(filepath.Dir(target), filepath.Base(target), false)
+		}
+	}
+
+	if err := os.Rename(tmpPath, final); err != nil {
+		return "", err
+	}
+	e.placed[target] = final
+	e.touch(filepath.Dir(final))
+	return final, nil
+}
+
+// extractHardLink 还原硬链接，失败或策略关闭时复制为独立文件
+// 与普通文件一样先在同目录下生成临时文件，再按冲突策略移动到最终路径
+func (e *folderExtractor) extractHardLink(source, target string, header *tar.Header) error {
+	// 链接源只能是本次已还原的文件，冲突时可能已被改名
+	placed, ok := e.placed[source]
+	if !ok || e.hasSymlinkParent(placed) {
+		slog.Warn(
+			"Hard link source was not extracted",
+			"name",
+			header.Name,
+			"link",
+			header.Linkname,
+		)
+		return errUnsafeEntry
+	}
+	source = placed
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("hard link source %s is not a regular file", header.Linkname)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), partialPrefix+"*.part")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	_ = tmp.Close()
+	defer os.Remove(tmpPath)
+
+	linked := false
+	if e.policy.HardLinks {
+		// os.Link 要求新路径不存在
+		_ = os.Remove(tmpPath)
+		if err := os.Link(source, tmpPath); err == nil {
+			linked = true
+		} else {
+			slog.Debug(
+				"Failed to create hard link, copying instead",
+				"source",
+				source,
+				"error",
+				err,
+			)
+		}
+	}
+	if !linked {
+		if err := copyFile(e.ctx, source, tmpPath); err != nil {
+			return err
+		}
+	}
+
+	var hash string
+	if e.conflict == config.ConflictPolicySkip {
+		if hash, err = hashFile(e.ctx, tmpPath); err != nil {
+			return err
+		}
+	}
+	final, err := e.place(tmpPath, target, info.Size(), hash)
+	if err != nil || final == "" || linked {
+		return err
+	}
+	if err := os.Chmod(final, info.Mode().Perm()); err != nil {
+		slog.Debug("Failed to set file mode", "path", final, "error", err)
+	}
+	if e.policy.ModTime {
+		_ = os.Chtimes(final, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+// symlinkSafe 检查符号链接目标是否为目录内部的相对路径
+// 目标路径逐段解析，经过已创建的符号链接时按其实际指向继续，
+// 避免 d/s -> .. 与 p -> d/s/.. 这样单独检查都在目录内、组合后却指向目录之外的链接
+func (e *folderExtractor) symlinkSafe(target, linkname string) bool {
+	if linkname == "" || strings.HasPrefix(linkname, "/") || filepath.IsAbs(linkname) ||
+		filepath.VolumeName(linkname) != "" {
+		return false
+	}
+	// 目标目录本身可能位于符号链接下，统一使用解析后的路径比较
+	root, err := filepath.EvalSymlinks(e.root)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(e.root, filepath.Dir(target))
+	if err != nil {
+		return false
+	}
+	inside := func(path string) bool {
+		return path == root || strings.HasPrefix(path, root+string(os.PathSeparator))
+	}
+
+	current := filepath.Join(root, rel)
+	for _, part := range strings.Split(filepath.FromSlash(linkname), string(os.PathSeparator)) {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+		default:
+			current = filepath.Join(current, part)
+			info, err := os.Lstat(current)
+			if err == nil && info.Mode()&os.ModeSymlink != 0 {
+				if current, err = filepath.EvalSymlinks(current); err != nil {
+					return false
+				}
+			}
+		}
+		if !inside(current) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyMetadata 按策略还原修改时间、可执行权限与扩展属性
+func (e *folderExtractor) applyMetadata(target string, header *tar.Header) {
+	if e.policy.Xattrs {
+		for key, value := range header.PAXRecords {
+			name, ok := strings.CutPrefix(key, paxXattrPrefix)
+			if !ok {
+				continue
+			}
+			if err := fsutil.SetXattr(target, name, value); err != nil {
+				slog.Debug("Failed to set xattr", "path", target, "name", name, "error", err)
+			}
+		}
+	}
+	if e.policy.ModTime && !header.ModTime.IsZero() {
+		if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
+			slog.Debug("Failed to set modification time", "path", target, "error", err)
+		}
+	}
+}
+
+// finish 创建延迟的符号链接并设置目录修改时间
+func (e *folderExtractor) finish() {
+	for _, header := range e.symlinks {
+		target, ok := e.resolve(header.Name)
+		if !ok || e.hasSymlinkParent(target) || !e.symlinkSafe(target, header.Linkname) {
+			slog.Warn(
+				"Unsafe symlink skipped",
+				"name",
+				header.Name,
+				"link",
+				header.Linkname,
+			)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o750); err != nil {
+			slog.Error("Failed to create dir", "path", filepath.Dir(target), "error", err)
+			continue
+		}
+		if err := os.Symlink(filepath.FromSlash(header.Linkname), target); err != nil {
+			slog.Error("Failed to create symlink", "path", target, "error", err)
+			continue
+		}
+		e.touch(filepath.Dir(target))
+	}
+
+	// 目录项落盘后才移动到最终路径，避免崩溃后留下含有空文件的文件夹
+	for dir := range e.touched {
+		if err := fsutil.SyncDir(dir); err != nil {
+			slog.Warn("Failed to sync dir", "path", dir, "error", err)
+		}
+	}
+
+	if !e.policy.ModTime {
+		return
+	}
+	// 由深到浅设置目录时间
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		dir := e.dirs[i]
+		if dir.modTime.IsZero() {
+			continue
+		}
+		if err := os.Chtimes(dir.path, dir.modTime, dir.modTime); err != nil {
+			slog.Debug("Failed to set modification time", "path", dir.path, "error", err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"mesh-drop/internal/config"
+)
+
+// ignoreFileNames 是开启 UseIgnoreFiles 时读取的忽略文件
+var ignoreFileNames = []string{".gitignore", ".meshdropignore"}
+
+// ignoredByDefault 是开启 UseIgnoreFiles 时默认忽略的条目，与 git 相同不发送仓库数据
+var ignoredByDefault = []string{".git"}
+
+// folderWalker 按照 FolderFilter 遍历文件夹
+// calculateTarSize 与 streamFolderToTar 共用同一套过滤逻辑，保证进度准确
+type folderWalker struct {
+	root   string
+	filter config.FolderFilter
+
+	include []gitignore.Pattern
+	exclude []gitignore.Pattern
+	// ignored 是从忽略文件中读取的规则，按目录深度递增的顺序追加
+	ignored []gitignore.Pattern
+}
+
+func newFolderWalker(root string, filter config.FolderFilter) *folderWalker {
+	w := &folderWalker{
+		root:   root,
+		filter: filter,
+	}
+	for _, p := range filter.Include {
+		if p = strings.TrimSpace(p); p != "" {
+			w.include = append(w.include, gitignore.ParsePattern(p, nil))
+		}
+	}
+	for _, p := range filter.Exclude {
+		if p = strings.TrimSpace(p); p != "" {
+			w.exclude = append(w.exclude, gitignore.ParsePattern(p, nil))
+		}
+	}
+	if filter.UseIgnoreFiles {
+		for _, p := range ignoredByDefault {
+			w.ignored = append(w.ignored, gitignore.ParsePattern(p, nil))
+		}
+	}
+	return w
+}
+
+// walk 遍历文件夹，fn 只会收到未被过滤的条目
+func (w *folderWalker) walk(ctx context.Context, fn filepath.WalkFunc) error {
+	return filepath.Walk(w.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		relPath, err := filepath.Rel(w.root, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			w.loadIgnoreFiles(path, nil)
+			return fn(path, info, nil)
+		}
+
+		parts := strings.Split(filepath.ToSlash(relPath), "/")
+		if w.excluded(parts, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			w.loadIgnoreFiles(path, parts)
+			// 设置了 Include 时不单独发送目录，接收端会按需创建父目录
+			if len(w.include) > 0 {
+				return nil
+			}
+		} else if len(w.include) > 0 && !matchAny(w.include, parts, false) {
+			return nil
+		}
+
+		return fn(path, info, nil)
+	})
+}
+
+// excluded 判断条目是否被排除，用户规则优先于忽略文件
+func (w *folderWalker) excluded(parts []string, isDir bool) bool {
+	patterns := make([]gitignore.Pattern, 0, len(w.ignored)+len(w.exclude))
+	patterns = append(patterns, w.ignored...)
+	patterns = append(patterns, w.exclude...)
+	return gitignore.NewMatcher(patterns).Match(parts, isDir)
+}
+
+// loadIgnoreFiles 读取目录中的忽略文件，规则只作用于该目录内部
+func (w *folderWalker) loadIgnoreFiles(dir string, domain []string) {
+	if !w.filter.UseIgnoreFiles {
+		return
+	}
+	for _, name := range ignoreFileNames {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			w.ignored = append(w.ignored, gitignore.ParsePattern(line, domain))
+		}
+		if err := scanner.Err(); err != nil {
+			slog.Warn("Failed to read ignore file", "path", file.Name(), "error", err)
+		}
+		_ = file.Close()
+	}
+}
+
+func matchAny(patterns []gitignore.Pattern, parts []string, isDir bool) bool {
+	for _, p := range patterns {
+		if p.Match(parts, isDir) == gitignore.Exclude {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,633 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"mesh-drop/internal/config"
+	"mesh-drop/internal/discovery"
+)
+
+const (
+	// syncDebounce 本地文件停止变化多久后通知对端
+	syncDebounce = 2 * time.Second
+	// syncInterval 定期与对端比对索引的间隔，用于补上错过的通知
+	syncInterval = time.Minute
+)
+
+// syncEntry 是同步索引中的一个文件
+type syncEntry struct {
+	Path    string `json:"path"`     // 相对路径，使用 / 分隔
+	Size    int64  `json:"size"`     // 文件大小
+	ModTime int64  `json:"mod_time"` // 修改时间 (毫秒)
+	Hash    string `json:"hash"`     // sha256
+}
+
+// syncFolder 是正在运行的同步文件夹
+//
+// 双方各自从对端拉取变化的文件：
+// 本地文件变化时通知对端，对端拉取索引并下载有变化的文件。
+// base 记录上次同步完成时每个文件的哈希，用于判断是哪一端修改了文件：
+// 只有本地修改时等待对端拉取，只有对端修改时下载，双方都修改时产生冲突副本。
+// 删除操作不会同步，避免一端误删导致两端数据丢失。
+type syncFolder struct {
+	config.SyncFolder
+
+	// mu 保证同一时间只有一次扫描或拉取
+	mu       sync.Mutex
+	index    map[string]syncEntry // Key: 相对路径，本地索引，同时作为哈希缓存
+	base     map[string]string    // Key: 相对路径，Value: 上次同步时的哈希
+	basePath string
+
+	trigger chan struct{}
+	cancel  context.CancelFunc
+}
+
+func (s *Service) syncBasePath(id string) string {
+	return filepath.Join(s.configDir, "sync", id+".json")
+}
+
+func newSyncFolder(folder config.SyncFolder, basePath string) *syncFolder {
+	f := &syncFolder{
+		SyncFolder: folder,
+		index:      make(map[string]syncEntry),
+		base:       make(map[string]string),
+		basePath:   basePath,
+		trigger:    make(chan struct{}, 1),
+	}
+	data, err := os.ReadFile(f.basePath)
+	if err == nil {
+		if err := json.Unmarshal(data, &f.base); err != nil {
+			slog.Warn("Failed to parse sync state", "id", f.ID, "error", err, "component", "sync")
+		}
+	}
+	return f
+}
+
+func (f *syncFolder) saveBase() {
+	data, err := json.Marshal(f.base)
+	if err != nil {
+		return
+	}
+	_ = os.MkdirAll(filepath.Dir(f.basePath), 0o750)
+	if err := os.WriteFile(f.basePath, data, 0o600); err != nil {
+		slog.Warn("Failed to write sync state", "id", f.ID, "error", err, "component", "sync")
+	}
+}
+
+// requestSync 请求尽快与对端同步
+func (f *syncFolder) requestSync() {
+	select {
+	case f.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// scan 扫描本地文件夹并更新索引，大小与修改时间未变的文件复用已有哈希
+// 需要在持有 mu 时调用
+func (f *syncFolder) scan(ctx context.Context) error {
+	index := make(map[string]syncEntry, len(f.index))
+	err := filepath.WalkDir(f.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if isPartialName(d.Name()) || !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// 文件在扫描过程中被删除
+			return nil
+		}
+		rel, err := filepath.Rel(f.Path, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		entry := syncEntry{
+			Path:    rel,
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixMilli(),
+		}
+		if cached, ok := f.index[rel]; ok &&
+			cached.Size == entry.Size && cached.ModTime == entry.ModTime {
+			entry.Hash = cached.Hash
+		} else {
+			entry.Hash, err = hashFile(ctx, p)
+			if err != nil {
+				if errors.Is(err, context.Canceled) {
+					return err
+				}
+				return nil
+			}
+		}
+		index[rel] = entry
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.index = index
+	return nil
+}
+
+// localPath 将索引中的相对路径转换为本地路径，拒绝指向文件夹外部的路径
+func (f *syncFolder) localPath(rel string) (string, bool) {
+	p := filepath.FromSlash(rel)
+	if !filepath.IsLocal(p) {
+		return "", false
+	}
+	return filepath.Join(f.Path, p), true
+}
+
+// insideRoot 检查解析符号链接后的路径是否仍在同步文件夹内
+func (f *syncFolder) insideRoot(dir string) bool {
+	root, err := filepath.EvalSymlinks(f.Path)
+	if err != nil {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, resolved)
+	return err == nil && (rel == "." || filepath.IsLocal(rel))
+}
+
+// conflictCopyName 返回冲突副本的相对路径
+// 名称只取决于落败版本，两端据此生成相同的文件名，冲突副本随后会被正常同步
+func conflictCopyName(rel string, loserID string, modTime int64) string {
+	dir, name := path.Split(rel)
+	ext := path.Ext(name)
+	if len(loserID) > 8 {
+		loserID = loserID[:8]
+	}
+	return fmt.Sprintf(
+		"%s%s.sync-conflict-%s-%s%s",
+		dir,
+		strings.TrimSuffix(name, ext),
+		time.UnixMilli(modTime).UTC().Format("20060102-150405"),
+		loserID,
+		ext,
+	)
+}
+
+// AddSyncFolder 添加与受信任节点同步的文件夹
+// id 为空时生成新的 ID，对端需要使用相同的 ID 添加自己的本地文件夹
+func (s *Service) AddSyncFolder(id string, peerID string, path string) (config.SyncFolder, error) {
+	if !s.config.IsTrusted(peerID) {
+		return config.SyncFolder{}, errors.New("folder sync is only available for trusted peers")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return config.SyncFolder{}, err
+	}
+	if !info.IsDir() {
+		return config.SyncFolder{}, fmt.Errorf("%s is not a directory", path)
+	}
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	folder := config.SyncFolder{
+		ID:     id,
+		Path:   path,
+		PeerID: peerID,
+	}
+	s.stopSyncFolder(id)
+	s.config.SetSyncFolder(folder)
+	s.startSyncFolder(folder)
+	return folder, nil
+}
+
+// RemoveSyncFolder 停止同步并删除同步文件夹，本地文件不受影响
+func (s *Service) RemoveSyncFolder(id string) {
+	s.stopSyncFolder(id)
+	s.config.RemoveSyncFolder(id)
+	_ = os.Remove(s.syncBasePath(id))
+}
+
+func (s *Service) GetSyncFolders() []config.SyncFolder {
+	return s.config.GetSyncFolders()
+}
+
+// SyncNow 立即与对端同步
+func (s *Service) SyncNow(id string) {
+	if f, ok := s.syncFolders.Load(id); ok {
+		f.(*syncFolder).requestSync()
+	}
+}
+
+func (s *Service) startSyncFolders() {
+	for _, folder := range s.config.GetSyncFolders() {
+		s.startSyncFolder(folder)
+	}
+}
+
+func (s *Service) startSyncFolder(folder config.SyncFolder) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("Failed to create watcher", "error", err, "component", "sync")
+		return
+	}
+	addWatchRecursive(watcher, folder.Path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := newSyncFolder(folder, s.syncBasePath(folder.ID))
+	f.cancel = cancel
+	s.syncFolders.Store(folder.ID, f)
+
+	slog.Info("Folder sync started", "id", folder.ID, "path", folder.Path, "component", "sync")
+	go s.runSyncFolder(ctx, f, watcher)
+	f.requestSync()
+}
+
+func (s *Service) stopSyncFolder(id string) {
+	if f, ok := s.syncFolders.LoadAndDelete(id); ok {
+		f.(*syncFolder).cancel()
+	}
+}
+
+// addWatchRecursive 监听 root 及其所有子目录
+func addWatchRecursive(watcher *fsnotify.Watcher, root string) {
+	_ = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if err := watcher.Add(p); err != nil {
+			slog.Warn("Failed to watch directory", "path", p, "error", err, "component", "sync")
+		}
+		return nil
+	})
+}
+
+func (s *Service) runSyncFolder(ctx context.Context, f *syncFolder, watcher *fsnotify.Watcher) {
+	defer watcher.Close()
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	// changed 在本地文件停止变化 syncDebounce 后触发
+	var changed <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if isPartialName(filepath.Base(event.Name)) {
+				continue
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					addWatchRecursive(watcher, event.Name)
+				}
+			}
+			changed = time.After(syncDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("Watcher error", "id", f.ID, "error", err, "component", "sync")
+		case <-changed:
+			changed = nil
+			s.notifySyncPeer(ctx, f)
+		case <-f.trigger:
+			s.pullSync(ctx, f)
+		case <-ticker.C:
+			s.pullSync(ctx, f)
+		}
+	}
+}
+
+// syncPeer 返回在线且可信的同步对端
+func (s *Service) syncPeer(f *syncFolder) (*discovery.Peer, string, bool) {
+	peer, ok := s.discoveryService.GetPeerByID(f.PeerID)
+	if !ok {
+		return nil, "", false
+	}
+	if !s.config.IsTrusted(peer.ID) || peer.TrustMismatch {
+		slog.Warn("Sync peer is not trusted", "id", f.ID, "peer", f.PeerID, "component", "sync")
+		return nil, "", false
+	}
+	ip, ok := latestRouteIP(peer)
+	if !ok {
+		return nil, "", false
+	}
+	return peer, ip, true
+}
+
+// syncRequest 向同步对端发送带签名的请求
+func (s *Service) syncRequest(
+	ctx context.Context,
+	method string,
+	peer *discovery.Peer,
+	ip string,
+	uri string,
+) (*http.Response, error) {
+	reqUrl := fmt.Sprintf("https://%s:%d%s", ip, peer.Port, uri)
+	req, err := http.NewRequestWithContext(ctx, method, reqUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.signRequest(req); err != nil {
+		return nil, err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// notifySyncPeer 通知对端本地文件已变化
+func (s *Service) notifySyncPeer(ctx context.Context, f *syncFolder) {
+	peer, ip, ok := s.syncPeer(f)
+	if !ok {
+		return
+	}
+	resp, err := s.syncRequest(ctx, http.MethodPost, peer, ip, "/sync/"+f.ID+"/notify")
+	if err != nil {
+		slog.Warn("Failed to notify sync peer", "id", f.ID, "error", err, "component", "sync")
+		return
+	}
+	resp.Body.Close()
+}
+
+// pullSync 拉取对端索引并下载有变化的文件
+func (s *Service) pullSync(ctx context.Context, f *syncFolder) {
+	peer, ip, ok := s.syncPeer(f)
+	if !ok {
+		return
+	}
+
+	resp, err := s.syncRequest(ctx, http.MethodGet, peer, ip, "/sync/"+f.ID+"/index")
+	if err != nil {
+		slog.Warn("Failed to fetch sync index", "id", f.ID, "error", err, "component", "sync")
+		return
+	}
+	var remote []syncEntry
+	err = json.NewDecoder(resp.Body).Decode(&remote)
+	resp.Body.Close()
+	if err != nil {
+		slog.Warn("Failed to parse sync index", "id", f.ID, "error", err, "component", "sync")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.scan(ctx); err != nil {
+		slog.Warn("Failed to scan sync folder", "id", f.ID, "error", err, "component", "sync")
+		return
+	}
+
+	defer f.saveBase()
+	selfID := s.config.GetID()
+	for _, r := range remote {
+		if ctx.Err() != nil {
+			return
+		}
+		local, exists := f.index[r.Path]
+		base := f.base[r.Path]
+
+		var err error
+		switch {
+		case !exists:
+			err = s.downloadSyncFile(ctx, f, peer, ip, r, r.Path)
+		case local.Hash == r.Hash:
+			f.base[r.Path] = r.Hash
+		case local.Hash == base:
+			// 只有对端修改了文件
+			err = s.downloadSyncFile(ctx, f, peer, ip, r, r.Path)
+		case r.Hash == base:
+			// 只有本地修改了文件，等待对端拉取
+		default:
+			err = s.resolveSyncConflict(ctx, f, peer, ip, local, r, selfID)
+		}
+		if err != nil {
+			slog.Warn(
+				"Failed to sync file",
+				"id",
+				f.ID,
+				"path",
+				r.Path,
+				"error",
+				err,
+				"component",
+				"sync",
+			)
+		}
+	}
+}
+
+// resolveSyncConflict 处理两端都修改过的文件
+// 修改时间较新的版本保留原文件名，另一个版本保存为冲突副本
+func (s *Service) resolveSyncConflict(
+	ctx context.Context,
+	f *syncFolder,
+	peer *discovery.Peer,
+	ip string,
+	local, remote syncEntry,
+	selfID string,
+) error {
+	remoteWins := remote.ModTime > local.ModTime ||
+		(remote.ModTime == local.ModTime && remote.Hash > local.Hash)
+
+	if !remoteWins {
+		// 对端版本保存为冲突副本，base 保持不变，对端下载本地版本后即完成同步
+		copyName := conflictCopyName(remote.Path, peer.ID, remote.ModTime)
+		if existing, ok := f.index[copyName]; ok && existing.Hash == remote.Hash {
+			return nil
+		}
+		slog.Info("Sync conflict, keeping local version", "path", remote.Path, "component", "sync")
+		return s.downloadSyncFile(ctx, f, peer, ip, remote, copyName)
+	}
+
+	// 本地版本改名为冲突副本，再下载对端版本
+	copyName := conflictCopyName(local.Path, selfID, local.ModTime)
+	src, ok := f.localPath(local.Path)
+	if !ok {
+		return errUnsafeEntry
+	}
+	dst, ok := f.localPath(copyName)
+	if !ok {
+		return errUnsafeEntry
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	local.Path = copyName
+	f.index[copyName] = local
+	delete(f.index, remote.Path)
+	slog.Info("Sync conflict, keeping remote version", "path", remote.Path, "component", "sync")
+	return s.downloadSyncFile(ctx, f, peer, ip, remote, remote.Path)
+}
+
+// downloadSyncFile 下载对端文件保存到 rel，校验哈希并还原修改时间
+func (s *Service) downloadSyncFile(
+	ctx context.Context,
+	f *syncFolder,
+	peer *discovery.Peer,
+	ip string,
+	entry syncEntry,
+	rel string,
+) error {
+	dest, ok := f.localPath(rel)
+	if !ok {
+		return errUnsafeEntry
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
+		return err
+	}
+	// 防止通过文件夹内的符号链接写到外部
+	if !f.insideRoot(filepath.Dir(dest)) {
+		return errUnsafeEntry
+	}
+
+	uri := fmt.Sprintf("/sync/%s/file?path=%s", f.ID, url.QueryEscape(entry.Path))
+	resp, err := s.syncRequest(ctx, http.MethodGet, peer, ip, uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	part, err := createPartFile(s.partials, dest, f.ID)
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(part, hasher), &ContextReader{ctx: ctx, r: resp.Body})
+	if err != nil {
+		part.Abort()
+		return err
+	}
+	// 下载过程中对端文件可能再次变化，哈希不一致时等待下次同步
+	if hash := hex.EncodeToString(hasher.Sum(nil)); hash != entry.Hash {
+		part.Abort()
+		return fmt.Errorf("hash mismatch: expected %s, got %s", entry.Hash, hash)
+	}
+	if err := part.Commit(); err != nil {
+		return err
+	}
+	modTime := time.UnixMilli(entry.ModTime)
+	if err := os.Chtimes(dest, modTime, modTime); err != nil {
+		return err
+	}
+
+	entry.Path = rel
+	f.index[rel] = entry
+	f.base[rel] = entry.Hash
+	slog.Info("File synced", "id", f.ID, "path", rel, "size", entry.Size, "component", "sync")
+	return nil
+}
+
+// syncFolderFor 返回请求节点可以访问的同步文件夹
+func (s *Service) syncFolderFor(c *gin.Context) (*syncFolder, bool) {
+	peerID := c.GetString(contextKeyPeerID)
+	val, ok := s.syncFolders.Load(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Sync folder not found"})
+		return nil, false
+	}
+	f := val.(*syncFolder)
+	if f.PeerID != peerID || !s.config.IsTrusted(peerID) {
+		slog.Warn(
+			"Rejected sync request from untrusted peer",
+			"id",
+			f.ID,
+			"peer",
+			peerID,
+			"component",
+			"sync",
+		)
+		c.JSON(http.StatusForbidden, gin.H{"message": "Peer is not allowed to sync this folder"})
+		return nil, false
+	}
+	return f, true
+}
+
+func (s *Service) handleSyncIndex(c *gin.Context) {
+	f, ok := s.syncFolderFor(c)
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	err := f.scan(c.Request.Context())
+	index := make([]syncEntry, 0, len(f.index))
+	for _, entry := range f.index {
+		index = append(index, entry)
+	}
+	f.mu.Unlock()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to scan sync folder"})
+		return
+	}
+	c.JSON(http.StatusOK, index)
+}
+
+func (s *Service) handleSyncFile(c *gin.Context) {
+	f, ok := s.syncFolderFor(c)
+	if !ok {
+		return
+	}
+	p, ok := f.localPath(c.Query("path"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid path"})
+		return
+	}
+	// 防止通过文件夹内的符号链接读取外部文件
+	if !f.insideRoot(p) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "File not found"})
+		return
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "File not found"})
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		c.JSON(http.StatusNotFound, gin.H{"message": "File not found"})
+		return
+	}
+	http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), file)
+}
+
+func (s *Service) handleSyncNotify(c *gin.Context) {
+	f, ok := s.syncFolderFor(c)
+	if !ok {
+		return
+	}
+	f.requestSync()
+	c.Status(http.StatusOK)
+}
@@ -1,58 +1,323 @@
 package transfer
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
-
-	"mesh-drop/internal/config"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 )
 
-func (s *Service) SaveHistory() {
-	if !s.config.GetSaveHistory() {
-		return
+// 传输历史
+//
+// 历史以 JSON Lines 追加写入 history.jsonl，每当任务状态变化时追加一行任务快照，
+// 删除任务时追加一行删除记录。加载时按顺序回放，同一任务以最后一行为准。
+// 进程崩溃时最多丢失未写完的最后一行。记录远多于任务数时在加载和退出时重写文件。
+
+// historyCompactSlack 记录数超过任务数两倍再多出此数量时重写文件
+const historyCompactSlack = 64
+
+func (s *Service) historyPath() string {
+	return filepath.Join(s.configDir, "history.jsonl")
+}
+
+// legacyHistoryPath 旧版本在退出时整体写入的历史
+func (s *Service) legacyHistoryPath() string {
+	return filepath.Join(s.configDir, "history.json")
+}
+
+// historyRecord 是历史文件中的一行
+type historyRecord struct {
+	ID       string    `json:"id"`
+	Deleted  bool      `json:"deleted,omitempty"`
+	Transfer *Transfer `json:"transfer,omitempty"`
+}
+
+type historyLog struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	// recorded 每个任务最后写入的状态，状态变化时才追加
+	recorded map[string]string
+	// lines 文件中的记录数
+	lines int
+	// partial 文件以未写完的行结尾，追加前需要先换行
+	partial bool
+}
+
+func newHistoryLog(path string) *historyLog {
+	return &historyLog{
+		path:     path,
+		recorded: make(map[string]string),
 	}
-	configDir := config.GetConfigDir()
-	historyPath := filepath.Join(configDir, "history.json")
-	tempPath := historyPath + ".tmp"
+}
 
-	// 序列化传输列表
-	historyJson, err := json.MarshalIndent(s.GetTransferList(), "", "  ")
+// historyKey 任务需要重新记录的状态
+// 除状态外，接收后命令的结果在任务完成后才写入，也需要记录
+func historyKey(t *Transfer) string {
+	return string(t.Status) + "/" + strconv.Itoa(len(t.HookResults))
+}
+
+// load 回放历史文件，返回按创建时间降序排列的任务
+func (h *historyLog) load() ([]*Transfer, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	file, err := os.Open(h.path)
 	if err != nil {
-		slog.Error("Failed to marshal history", "error", err, "component", "transfer")
-		return
+		return nil, err
+	}
+	defer file.Close()
+
+	byID := make(map[string]*Transfer)
+	lines := 0
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			lines++
+			var record historyRecord
+			// 崩溃时未写完的行无法解析，直接跳过
+			if json.Unmarshal(line, &record) == nil && record.ID != "" {
+				if record.Deleted || record.Transfer == nil {
+					delete(byID, record.ID)
+				} else {
+					byID[record.ID] = record.Transfer
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			h.partial = len(line) > 0
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h.lines = lines
+	clear(h.recorded)
+	tasks := make([]*Transfer, 0, len(byID))
+	for id, t := range byID {
+		h.recorded[id] = historyKey(t)
+		tasks = append(tasks, t)
 	}
+	sortByCreateTime(tasks)
+	return tasks, nil
+}
 
-	// 写入临时文件
-	if err := os.WriteFile(tempPath, historyJson, 0o600); err != nil {
-		slog.Error("Failed to write temp history file", "error", err, "component", "transfer")
+// record 任务状态与上次记录不同时追加，t 为任务的快照
+func (h *historyLog) record(t *Transfer) {
+	// 剪贴板自动同步的记录只保留在剪贴板历史中
+	if t.ClipboardSync {
 		return
 	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := historyKey(t)
+	if h.recorded[t.ID] == key {
+		return
+	}
+	if err := h.append(historyRecord{ID: t.ID, Transfer: t}); err != nil {
+		slog.Error("Failed to append history", "error", err, "component", "transfer")
+		return
+	}
+	h.recorded[t.ID] = key
+}
 
+// remove 追加删除记录
+func (h *historyLog) remove(ids []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, id := range ids {
+		if _, ok := h.recorded[id]; !ok {
+			continue
+		}
+		if err := h.append(historyRecord{ID: id, Deleted: true}); err != nil {
+			slog.Error("Failed to append history", "error", err, "component", "transfer")
+			return
+		}
+		delete(h.recorded, id)
+	}
+}
+
+// append 写入一行，调用方持有 mu
+func (h *historyLog) append(record historyRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if h.file == nil {
+		file, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		h.file = file
+	}
+	if h.partial {
+		data = append([]byte{'\n'}, data...)
+		h.partial = false
+	}
+	if _, err := h.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	h.lines++
+	return nil
+}
+
+// needsCompact 判断记录数是否远多于任务数
+func (h *historyLog) needsCompact() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lines > 2*len(h.recorded)+historyCompactSlack
+}
+
+// compact 以 tasks 的当前状态重写历史文件
+func (h *historyLog) compact(tasks []*Transfer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var buf bytes.Buffer
+	recorded := make(map[string]string, len(tasks))
+	for _, t := range tasks {
+		if t.ClipboardSync {
+			continue
+		}
+		data, err := json.Marshal(historyRecord{ID: t.ID, Transfer: t})
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+		recorded[t.ID] = historyKey(t)
+	}
+
+	tempPath := h.path + ".tmp"
+	if err := os.WriteFile(tempPath, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	if h.file != nil {
+		_ = h.file.Close()
+		h.file = nil
+	}
 	// 原子性重命名
-	if err := os.Rename(tempPath, historyPath); err != nil {
-		slog.Error("Failed to rename temp history file", "error", err, "component", "transfer")
-		// 清理临时文件
+	if err := os.Rename(tempPath, h.path); err != nil {
 		_ = os.Remove(tempPath)
-		return
+		return err
 	}
+	h.recorded = recorded
+	h.lines = len(recorded)
+	h.partial = false
+	return nil
+}
 
-	slog.Info("History saved successfully", "path", historyPath, "component", "transfer")
+func (h *historyLog) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file != nil {
+		_ = h.file.Close()
+		h.file = nil
+	}
 }
 
-func (s *Service) LoadHistory() {
-	configDir := config.GetConfigDir()
-	historyPath := filepath.Join(configDir, "history.json")
-	file, err := os.Open(historyPath)
-	if err != nil {
+// trackTransfer 追加任务的当前状态
+// 加入传输列表、状态变化与接收后命令结束时调用，状态未变化时不写入
+func (s *Service) trackTransfer(task *Transfer) {
+	if s.config.GetSaveHistory() {
+		s.history.record(task.Snapshot())
+	}
+}
+
+// trackChanges 记录任务的当前状态，之后每次状态变化时追加
+func (s *Service) trackChanges(task *Transfer) {
+	task.update(func() { task.onChange = s.trackTransfer })
+	s.trackTransfer(task)
+}
+
+// SaveHistory 以当前传输列表重写历史文件，退出时调用
+// 状态变化已在发生时写入，此处只是去掉多余的记录
+func (s *Service) SaveHistory() {
+	if !s.config.GetSaveHistory() {
 		return
 	}
-	defer file.Close()
-	var history []*Transfer
-	err = json.NewDecoder(file).Decode(&history)
+	if err := s.history.compact(s.GetTransferList()); err != nil {
+		slog.Error("Failed to save history", "error", err, "component", "transfer")
+		return
+	}
+	s.history.close()
+	slog.Info("History saved successfully", "path", s.history.path, "component", "transfer")
+}
+
+func (s *Service) LoadHistory() {
+	history, err := s.history.load()
+	if errors.Is(err, os.ErrNotExist) {
+		history, err = s.migrateLegacyHistory()
+	}
 	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to load history", "error", err, "component", "transfer")
+		}
 		return
 	}
+
+	// 离线队列已恢复的等待任务以队列为准
+	history = slices.DeleteFunc(history, func(t *Transfer) bool {
+		_, exists := s.transfers.Load(t.ID)
+		return exists
+	})
+	// 上次运行未正常退出时，进行中的任务已经中断
+	for _, t := range history {
+		markInterrupted(t)
+	}
 	s.StoreTransfersToList(history)
+
+	if s.history.needsCompact() {
+		if err := s.history.compact(s.GetTransferList()); err != nil {
+			slog.Error("Failed to compact history", "error", err, "component", "transfer")
+		}
+	}
+}
+
+// markInterrupted 将未结束的历史任务标记为已取消或失败
+// 任务尚未加入传输列表，直接修改字段；旧版本的历史没有结束时间，使用创建时间
+func markInterrupted(t *Transfer) {
+	switch t.Status {
+	case TransferStatusPending, TransferStatusWaiting, TransferStatusScheduled:
+		t.Status = TransferStatusCanceled
+	case TransferStatusAccepted, TransferStatusActive, TransferStatusRetrying:
+		t.Status = TransferStatusError
+		t.ErrorMsg = "Interrupted"
+	}
+	if t.FinishTime == 0 {
+		t.FinishTime = t.CreateTime
+	}
+}
+
+// migrateLegacyHistory 读取旧版本的 history.json 并写入新的历史文件
+func (s *Service) migrateLegacyHistory() ([]*Transfer, error) {
+	data, err := os.ReadFile(s.legacyHistoryPath())
+	if err != nil {
+		return nil, err
+	}
+	var history []*Transfer
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, err
+	}
+	history = slices.DeleteFunc(history, func(t *Transfer) bool {
+		return t == nil || strings.TrimSpace(t.ID) == ""
+	})
+	if err := s.history.compact(history); err != nil {
+		return nil, err
+	}
+	_ = os.Remove(s.legacyHistoryPath())
+	slog.Info("Migrated legacy history", "count", len(history), "component", "transfer")
+	return history, nil
 }
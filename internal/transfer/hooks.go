@@ -0,0 +1,205 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"mesh-drop/internal/config"
+)
+
+const (
+	// hookDefaultTimeout 未设置超时时间的命令最多运行的时间
+	hookDefaultTimeout = 60 * time.Second
+	// hookMaxOutput 记录的命令输出上限
+	hookMaxOutput = 64 << 10
+	// hookWaitDelay 命令超时后等待其子进程关闭输出的时间
+	hookWaitDelay = 2 * time.Second
+)
+
+// AddReceiveHook 添加或更新接收后命令，hook.ID 为空时生成新的 ID
+func (s *Service) AddReceiveHook(hook config.ReceiveHook) (config.ReceiveHook, error) {
+	if hook.Command == "" {
+		return config.ReceiveHook{}, errors.New("command is required")
+	}
+	if _, err := filepath.Match(hook.Pattern, ""); err != nil {
+		return config.ReceiveHook{}, err
+	}
+	if hook.Timeout < 0 {
+		return config.ReceiveHook{}, errors.New("timeout must not be negative")
+	}
+	// 只有受信任节点的公钥是固定的，其他节点可以声称任意 ID
+	if hook.PeerID != "" && hook.AllowUntrusted {
+		return config.ReceiveHook{}, errors.New("a hook for a peer only runs for trusted peers")
+	}
+	if hook.ID == "" {
+		hook.ID = uuid.New().String()
+	}
+	s.config.SetReceiveHook(hook)
+	return hook, nil
+}
+
+func (s *Service) RemoveReceiveHook(id string) {
+	s.config.RemoveReceiveHook(id)
+}
+
+func (s *Service) GetReceiveHooks() []config.ReceiveHook {
+	return s.config.GetReceiveHooks()
+}
+
+// hookMatches 判断命令是否适用于接收完成的任务
+// trusted 表示发送端受信任且公钥匹配，默认只有受信任节点可以触发命令
+func hookMatches(hook config.ReceiveHook, task *Transfer, trusted bool) bool {
+	if !trusted && (hook.PeerID != "" || !hook.AllowUntrusted) {
+		return false
+	}
+	if hook.PeerID != "" && hook.PeerID != task.Sender.ID {
+		return false
+	}
+	if len(hook.ContentTypes) > 0 && !slices.Contains(hook.ContentTypes, string(task.ContentType)) {
+		return false
+	}
+	if hook.Pattern != "" {
+		ok, err := filepath.Match(hook.Pattern, task.FileName)
+		return err == nil && ok
+	}
+	return true
+}
+
+// hookEnv 以环境变量提供任务信息
+func hookEnv(task *Transfer) []string {
+	return append(os.Environ(),
+		"MESHDROP_TRANSFER_ID="+task.ID,
+		"MESHDROP_PEER_ID="+task.Sender.ID,
+		"MESHDROP_PEER_NAME="+task.Sender.Name,
+		"MESHDROP_CONTENT_TYPE="+string(task.ContentType),
+		"MESHDROP_FILE_NAME="+task.FileName,
+		"MESHDROP_FILE_PATH="+task.FilePath,
+		"MESHDROP_FILE_SIZE="+strconv.FormatInt(task.FileSize, 10),
+		"MESHDROP_FILE_HASH="+task.FileHash,
+		"MESHDROP_SAVE_PATH="+task.SavePath,
+		"MESHDROP_MIME_TYPE="+task.MimeType,
+		"MESHDROP_URL="+task.URL,
+	)
+}
+
+// runReceiveHooks 依次运行匹配的接收后命令，结果记录在任务中
+func (s *Service) runReceiveHooks(task *Transfer) {
+	var hooks []config.ReceiveHook
+	trusted := s.config.IsTrusted(task.Sender.ID) && !task.Sender.TrustMismatch
+	for _, hook := range s.config.GetReceiveHooks() {
+		if hookMatches(hook, task, trusted) {
+			hooks = append(hooks, hook)
+		}
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	// 命令在后台运行，先记录任务当前的状态
+	env := hookEnv(task)
+	input, err := json.Marshal(task.Snapshot())
+	if err != nil {
+		return
+	}
+	dir := filepath.Dir(task.FilePath)
+	if task.FilePath == "" {
+		dir = task.SavePath
+	}
+
+	go func() {
+		for _, hook := range hooks {
+			result := runHook(hook, env, input, dir)
+			task.update(func() { task.HookResults = append(task.HookResults, result) })
+			s.trackTransfer(task)
+			s.NotifyTransferListUpdate()
+		}
+	}()
+}
+
+// runHook 运行一个命令，超时后结束进程
+func runHook(hook config.ReceiveHook, env []string, input []byte, dir string) HookResult {
+	timeout := hookDefaultTimeout
+	if hook.Timeout > 0 {
+		timeout = time.Duration(hook.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook.Command, hook.Args...) //nolint:gosec
+	cmd.Env = env
+	cmd.Stdin = bytes.NewReader(input)
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		cmd.Dir = dir
+	}
+	output := &limitedBuffer{max: hookMaxOutput}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.WaitDelay = hookWaitDelay
+
+	start := time.Now()
+	err := cmd.Run()
+	result := HookResult{
+		HookID:    hook.ID,
+		Name:      hook.Name,
+		StartTime: start.UnixMilli(),
+		Duration:  time.Since(start).Milliseconds(),
+		ExitCode:  -1,
+		Output:    output.String(),
+	}
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		result.TimedOut = true
+		result.Error = fmt.Sprintf("timed out after %s", timeout)
+	} else if err != nil {
+		result.Error = err.Error()
+	}
+
+	slog.Info(
+		"Receive hook finished",
+		"hook",
+		hook.ID,
+		"exit_code",
+		result.ExitCode,
+		"timed_out",
+		result.TimedOut,
+		"component",
+		"hooks",
+	)
+	return result
+}
+
+// limitedBuffer 只保留前 max 字节，之后的输出被丢弃
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room < len(p) {
+		b.buf.Write(p[:max(room, 0)])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "\n[output truncated]"
+	}
+	return b.buf.String()
+}
@@ -0,0 +1,456 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"mesh-drop/internal/config"
+	"mesh-drop/internal/discovery"
+	"mesh-drop/internal/platform"
+)
+
+// 集成测试在本机回环地址上运行两个传输服务，一个发送，一个接收
+
+const testTimeout = 10 * time.Second
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	gin.DefaultWriter = io.Discard
+	os.Exit(m.Run())
+}
+
+// recordingBus 记录发送的事件
+type recordingBus struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (b *recordingBus) Emit(name string, data ...any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, name)
+}
+
+func (b *recordingBus) On(name string, handler func(data any)) func() {
+	return func() {}
+}
+
+func (b *recordingBus) count(name string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, event := range b.events {
+		if event == name {
+			n++
+		}
+	}
+	return n
+}
+
+// chanNotifier 将通知写入通道
+type chanNotifier chan platform.Notification
+
+func (n chanNotifier) SendNotification(notification platform.Notification) error {
+	n <- notification
+	return nil
+}
+
+type testNode struct {
+	config        *config.Config
+	events        *recordingBus
+	notifications chanNotifier
+	service       *Service
+	peer          discovery.Peer
+	dir           string
+}
+
+// newTestNode 在独立的配置目录中创建并启动传输服务
+// 默认自动接收、不保存历史、失败后不重试
+func newTestNode(t *testing.T, name string) *testNode {
+	t.Helper()
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, "config")
+
+	conf := config.LoadFrom(configDir, config.WindowState{})
+	conf.SetHostName(name)
+	conf.SetSavePath(filepath.Join(dir, "received"))
+	conf.SetAutoAccept(true)
+	conf.SetSaveHistory(false)
+	conf.SetRetryPolicy(config.RetryPolicy{MaxAttempts: 1, InitialDelay: 1, MaxDelay: 1})
+
+	port := freePort(t)
+	node := &testNode{
+		config:        conf,
+		events:        &recordingBus{},
+		notifications: make(chanNotifier, 16),
+		dir:           dir,
+	}
+	discoveryService := discovery.NewService(conf, node.events, port)
+	node.service = NewService(
+		conf,
+		configDir,
+		node.events,
+		node.notifications,
+		nil,
+		port,
+		discoveryService,
+	)
+	node.peer = discoveryService.GetSelf()
+	node.service.StartServer()
+	waitListening(t, port)
+	return node
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// waitListening 等待 HTTPS 服务可以连接
+func waitListening(t *testing.T, port int) {
+	t.Helper()
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true}) //nolint:gosec
+		if err == nil {
+			_ = conn.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("transfer service on %s did not start", addr)
+}
+
+// newTestPair 创建发送端与接收端
+func newTestPair(t *testing.T) (*testNode, *testNode) {
+	sender, receiver := newTestNode(t, "sender"), newTestNode(t, "receiver")
+	// 测试节点之间没有发现服务，接收端只能用信任列表中的公钥验证请求签名
+	receiver.config.AddTrust(sender.peer.ID, sender.peer.PublicKey)
+	return sender, receiver
+}
+
+// askEveryRequest 让接收端询问所有请求，包括来自受信任节点的请求
+func (n *testNode) askEveryRequest(t *testing.T) {
+	t.Helper()
+	n.config.SetAutoAccept(false)
+	rules := []config.AcceptRule{{Trust: config.AcceptTrustAny, Action: config.AcceptActionAsk}}
+	if _, err := n.service.SetAcceptRules(rules); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitDone 等待发送结束
+func waitDone(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("transfer did not finish")
+	}
+}
+
+// waitStatus 等待节点上的任务进入 status
+func (n *testNode) waitStatus(t *testing.T, id string, status TransferStatus) *Transfer {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		task, ok := n.service.GetTransfer(id)
+		if ok && task.Status == status {
+			return task
+		}
+		if time.Now().After(deadline) {
+			if ok {
+				t.Fatalf("task is %s (%s), want %s", task.Status, task.ErrorMsg, status)
+			}
+			t.Fatalf("task %s not found, want %s", id, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitAsk 等待接收端发出传输请求的通知
+func (n *testNode) waitAsk(t *testing.T) string {
+	t.Helper()
+	select {
+	case notification := <-n.notifications:
+		return notification.Data["transfer_id"].(string)
+	case <-time.After(testTimeout):
+		t.Fatal("no transfer request notification")
+		return ""
+	}
+}
+
+func TestTransferText(t *testing.T) {
+	sender, receiver := newTestPair(t)
+
+	task, done := sender.service.sendText(&receiver.peer, "127.0.0.1", "hello mesh")
+	waitDone(t, done)
+
+	sent := sender.waitStatus(t, task.ID, TransferStatusCompleted)
+	if sent.TargetID != receiver.peer.ID {
+		t.Errorf("target %q, want %q", sent.TargetID, receiver.peer.ID)
+	}
+	received := receiver.waitStatus(t, task.ID, TransferStatusCompleted)
+	if received.Text != "hello mesh" {
+		t.Errorf("received text %q", received.Text)
+	}
+	if received.Sender.ID != sender.peer.ID || received.Type != TransferTypeReceive {
+		t.Errorf("received from %q as %s", received.Sender.ID, received.Type)
+	}
+	for _, node := range []*testNode{sender, receiver} {
+		if node.events.count("transfer:refreshList") == 0 {
+			t.Error("no transfer list update event")
+		}
+	}
+}
+
+func TestTransferFile(t *testing.T) {
+	sender, receiver := newTestPair(t)
+
+	content := make([]byte, 512<<10)
+	_, _ = rand.Read(content)
+	path := filepath.Join(sender.dir, "data.bin")
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	task, done := sender.service.sendFile(&receiver.peer, "127.0.0.1", path)
+	waitDone(t, done)
+
+	sender.waitStatus(t, task.ID, TransferStatusCompleted)
+	received := receiver.waitStatus(t, task.ID, TransferStatusCompleted)
+	want := filepath.Join(receiver.config.GetSavePath(), "data.bin")
+	if received.FilePath != want {
+		t.Errorf("saved to %q, want %q", received.FilePath, want)
+	}
+	data, err := os.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Error("received file content differs")
+	}
+	if received.Progress.Current != int64(len(content)) {
+		t.Errorf("progress %d, want %d", received.Progress.Current, len(content))
+	}
+}
+
+func TestTransferFolder(t *testing.T) {
+	sender, receiver := newTestPair(t)
+
+	files := map[string]string{
+		"a.txt":         "first",
+		"sub/b.txt":     "second",
+		"sub/deep/c.md": "third",
+	}
+	root := filepath.Join(sender.dir, "project")
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	task, done := sender.service.sendFolder(
+		&receiver.peer,
+		"127.0.0.1",
+		root,
+		config.FolderFilter{},
+	)
+	waitDone(t, done)
+
+	sender.waitStatus(t, task.ID, TransferStatusCompleted)
+	received := receiver.waitStatus(t, task.ID, TransferStatusCompleted)
+	for name, content := range files {
+		data, err := os.ReadFile(filepath.Join(received.FilePath, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s: got %q, want %q", name, data, content)
+		}
+	}
+}
+
+func TestAskAccepted(t *testing.T) {
+	sender, receiver := newTestPair(t)
+	receiver.askEveryRequest(t)
+
+	task, done := sender.service.sendText(&receiver.peer, "127.0.0.1", "accept me")
+	id := receiver.waitAsk(t)
+	if id != task.ID {
+		t.Fatalf("notification for %q, want %q", id, task.ID)
+	}
+	receiver.waitStatus(t, id, TransferStatusPending)
+	if !receiver.service.ResolvePendingRequest(id, true, "") {
+		t.Fatal("failed to resolve the request")
+	}
+	waitDone(t, done)
+
+	sender.waitStatus(t, id, TransferStatusCompleted)
+	received := receiver.waitStatus(t, id, TransferStatusCompleted)
+	if received.Text != "accept me" {
+		t.Errorf("received text %q", received.Text)
+	}
+	// 已经做出决策的请求不能再次决定
+	if receiver.service.ResolvePendingRequest(id, false, "") {
+		t.Error("resolved a finished request")
+	}
+}
+
+func TestAskRejected(t *testing.T) {
+	sender, receiver := newTestPair(t)
+	receiver.askEveryRequest(t)
+
+	task, done := sender.service.sendText(&receiver.peer, "127.0.0.1", "reject me")
+	id := receiver.waitAsk(t)
+	receiver.service.ResolvePendingRequest(id, false, "")
+	waitDone(t, done)
+
+	sent := sender.waitStatus(t, task.ID, TransferStatusRejected)
+	if sent.ErrorMsg != "Transfer rejected" {
+		t.Errorf("sender error %q", sent.ErrorMsg)
+	}
+	received := receiver.waitStatus(t, task.ID, TransferStatusRejected)
+	if received.Text != "" {
+		t.Errorf("rejected text was received: %q", received.Text)
+	}
+}
+
+func TestSenderCancelsPendingAsk(t *testing.T) {
+	sender, receiver := newTestPair(t)
+	receiver.askEveryRequest(t)
+
+	task, done := sender.service.sendText(&receiver.peer, "127.0.0.1", "never mind")
+	receiver.waitAsk(t)
+	sender.service.CancelTransfer(task.ID)
+	waitDone(t, done)
+
+	sender.waitStatus(t, task.ID, TransferStatusCanceled)
+	receiver.waitStatus(t, task.ID, TransferStatusCanceled)
+	// 发送端已放弃，接收端不能再接受
+	receiver.service.ResolvePendingRequest(task.ID, true, "")
+	receiver.waitStatus(t, task.ID, TransferStatusCanceled)
+}
+
+func TestReceiverCancelsUpload(t *testing.T) {
+	sender, receiver := newTestPair(t)
+
+	// 数据流一直写入，直到接收端取消
+	pr, pw := io.Pipe()
+	t.Cleanup(func() { _ = pr.Close() })
+	go func() {
+		chunk := make([]byte, 32<<10)
+		for {
+			if _, err := pw.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	task, done := sender.service.SendStream(&receiver.peer, "127.0.0.1", "stream.bin", pr)
+	receiver.waitStatus(t, task.ID, TransferStatusActive)
+	receiver.service.CancelTransfer(task.ID)
+	waitDone(t, done)
+
+	received := receiver.waitStatus(t, task.ID, TransferStatusCanceled)
+	if received.ErrorMsg != "User canceled transfer" {
+		t.Errorf("receiver error %q", received.ErrorMsg)
+	}
+	sender.waitStatus(t, task.ID, TransferStatusCanceled)
+	// 取消的数据流不保留文件
+	if _, err := os.Stat(filepath.Join(receiver.config.GetSavePath(), "stream.bin")); err == nil {
+		t.Error("canceled stream was saved")
+	}
+}
+
+func TestReceiverFailsToSave(t *testing.T) {
+	sender, receiver := newTestPair(t)
+	// 保存路径的上级是普通文件，接收端无法创建文件
+	blocker := filepath.Join(receiver.dir, "blocker")
+	if err := os.WriteFile(blocker, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	receiver.config.SetSavePath(filepath.Join(blocker, "received"))
+
+	path := filepath.Join(sender.dir, "note.txt")
+	if err := os.WriteFile(path, []byte("content"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	task, done := sender.service.sendFile(&receiver.peer, "127.0.0.1", path)
+	waitDone(t, done)
+
+	sent := sender.waitStatus(t, task.ID, TransferStatusError)
+	if sent.ErrorMsg != "Receiver failed to create file" {
+		t.Errorf("sender error %q", sent.ErrorMsg)
+	}
+	receiver.waitStatus(t, task.ID, TransferStatusError)
+	if sent.Attempt != 1 {
+		t.Errorf("attempted %d times, want 1", sent.Attempt)
+	}
+}
+
+func TestReceiverUnreachable(t *testing.T) {
+	sender := newTestNode(t, "sender")
+	offline := discovery.Peer{ID: "offline", Name: "offline", Port: freePort(t)}
+
+	task, done := sender.service.sendText(&offline, "127.0.0.1", "hello")
+	waitDone(t, done)
+
+	sent := sender.waitStatus(t, task.ID, TransferStatusError)
+	if sent.ErrorMsg == "" {
+		t.Error("no error message")
+	}
+	if sent.FinishTime == 0 {
+		t.Error("failed task has no finish time")
+	}
+	// 结束后的任务不会被取消
+	sender.service.CancelTransfer(task.ID)
+	sender.waitStatus(t, task.ID, TransferStatusError)
+}
+
+func TestAskWithSpoofedSender(t *testing.T) {
+	sender, receiver := newTestPair(t)
+	attacker := newTestNode(t, "attacker")
+
+	// 冒用受信任节点的 ID，签名无法通过验证
+	task := NewTransfer(
+		"spoofed",
+		sender.peer,
+		WithType(TransferTypeSend),
+		WithContentType(ContentTypeText),
+		WithFileSize(5),
+	)
+	if _, err := attacker.service.ask(t.Context(), &receiver.peer, "127.0.0.1", task); err == nil {
+		t.Error("ask from an unknown peer was accepted")
+	}
+
+	// 签名有效，但请求体中的节点与签名不一致
+	receiver.config.AddTrust(attacker.peer.ID, attacker.peer.PublicKey)
+	if _, err := attacker.service.ask(t.Context(), &receiver.peer, "127.0.0.1", task); err == nil {
+		t.Error("ask with a mismatched sender was accepted")
+	}
+	if _, ok := receiver.service.GetTransfer(task.ID); ok {
+		t.Error("spoofed ask was stored")
+	}
+}
@@ -1,8 +1,10 @@
 package transfer
 
 import (
+	"sync"
 	"time"
 
+	"mesh-drop/internal/config"
 	"mesh-drop/internal/discovery"
 )
 
@@ -16,6 +18,9 @@ const (
 	TransferStatusError     TransferStatus = "error"
 	TransferStatusCanceled  TransferStatus = "canceled"
 	TransferStatusActive    TransferStatus = "active"
+	TransferStatusRetrying  TransferStatus = "retrying"  // 发送失败，等待重试
+	TransferStatusWaiting   TransferStatus = "waiting"   // 在离线队列中，等待节点上线
+	TransferStatusScheduled TransferStatus = "scheduled" // 计划任务，等待计划时间或发送时间段
 )
 
 type TransferType string
@@ -23,6 +28,7 @@ type TransferType string
 const (
 	TransferTypeSend    TransferType = "send"
 	TransferTypeReceive TransferType = "receive"
+	TransferTypeShare   TransferType = "share" // 本机发布的共享，等待其他节点下载
 )
 
 type ContentType string
@@ -31,14 +37,33 @@ const (
 	ContentTypeFile   ContentType = "file"
 	ContentTypeText   ContentType = "text"
 	ContentTypeFolder ContentType = "folder"
+	// ContentTypeClipboard 剪贴板内容，MimeType 区分文本与图片
+	ContentTypeClipboard ContentType = "clipboard"
+	// ContentTypeURL 链接，不需要上传，握手中携带链接与网页标题
+	ContentTypeURL ContentType = "url"
+	// ContentTypeImage 图片，按文件接收，握手中携带缩略图
+	ContentTypeImage ContentType = "image"
+	// ContentTypeStream 长度未知的数据流，如标准输入，FileSize 为 -1
+	ContentTypeStream ContentType = "stream"
 )
 
-// Transfer
+// Transfer 传输任务
+//
+// 任务加入传输列表后会被多个 goroutine 同时访问，字段的读写需要持有 mu：
+// 状态通过 transition 切换，其他字段通过 update 修改，对外只提供 Snapshot 返回的副本。
 type Transfer struct {
+	mu sync.Mutex
+	// onChange 状态变化后在释放 mu 后调用，加入传输列表时设置
+	onChange func(*Transfer)
+	transferData
+}
+
+// transferData 是任务的数据，与锁分开以便 Snapshot 整体复制
+type transferData struct {
 	ID         string         `json:"id"          binding:"required"` // 传输会话 ID
 	CreateTime int64          `json:"create_time"`                    // 创建时间
 	Sender     discovery.Peer `json:"sender"      binding:"required"` // 发送者
-	// FileName 如果 ContentType 为 file，文件名；如果 ContentType 为 folder，文件夹名；如果 ContentType 为 text，空
+	// FileName 如果 ContentType 为 file 或 image，文件名；如果 ContentType 为 folder，文件夹名；如果 ContentType 为 text，空
 	FileName     string         `json:"file_name"`    // 文件名
 	FileSize     int64          `json:"file_size"`    // 文件大小 (字节)
 	SavePath     string         `json:"savePath"`     // 保存路径
@@ -50,21 +75,82 @@ type Transfer struct {
 	ErrorMsg     string         `json:"error_msg"`    // 错误信息
 	Token        string         `json:"token"`        // 用于上传的凭证
 	DecisionChan chan Decision  `json:"-"`            // 用户决策通道
+
+	// FileHash 文件内容的 SHA-256 (hex)，仅在接收端要求时由发送端计算
+	FileHash string `json:"file_hash,omitempty"`
+	// Conflict 接收端目标路径已存在同名文件或文件夹
+	Conflict bool `json:"conflict"`
+	// ConflictPolicy 接收端最终使用的冲突策略
+	ConflictPolicy config.ConflictPolicy `json:"conflict_policy,omitempty"`
+	// Skipped 接收端已存在相同文件，未实际传输
+	Skipped bool `json:"skipped"`
+	// Delta 发送端在 ask 中表示支持增量传输，接收端没有基准文件时置为 false
+	Delta bool `json:"delta"`
+	// Deduplicated 接收端使用本地已有的相同文件生成，未通过网络传输
+	Deduplicated bool `json:"deduplicated"`
+	// FilePath 接收完成后文件或文件夹的最终路径
+	FilePath string `json:"file_path,omitempty"`
+	// SourcePath 离线队列与共享中待发送的本地文件或文件夹路径
+	SourcePath string `json:"source_path,omitempty"`
+	// Attempt 发送端已尝试的次数
+	Attempt int `json:"attempt"`
+	// NextRetryTime 下次重试的时间 (毫秒)，0 表示没有等待中的重试
+	NextRetryTime int64 `json:"next_retry_time"`
+	// TargetID 与 TargetName 是发送任务的接收节点
+	TargetID   string `json:"target_id,omitempty"`
+	TargetName string `json:"target_name,omitempty"`
+	// ExpireTime 等待任务的过期时间 (毫秒)，0 表示永不过期
+	ExpireTime int64 `json:"expire_time,omitempty"`
+	// ScheduledTime 计划任务的开始时间 (毫秒)
+	ScheduledTime int64 `json:"scheduled_time,omitempty"`
+	// MimeType ContentType 为 clipboard 时的内容格式，text/plain 或 image/png
+	MimeType string `json:"mime_type,omitempty"`
+	// ClipboardSync 由剪贴板自动同步发起
+	ClipboardSync bool `json:"clipboard_sync,omitempty"`
+	// URL 与 LinkTitle 是 ContentType 为 url 时的链接与网页标题
+	URL       string `json:"url,omitempty"`
+	LinkTitle string `json:"link_title,omitempty"`
+	// Thumbnail ContentType 为 image 时的缩略图 (JPEG data URL)
+	Thumbnail string `json:"thumbnail,omitempty"`
+	// ImageWidth 与 ImageHeight 是原图尺寸
+	ImageWidth  int `json:"image_width,omitempty"`
+	ImageHeight int `json:"image_height,omitempty"`
+	// HookResults 接收完成后运行的命令的结果
+	HookResults []HookResult `json:"hook_results,omitempty"`
+	// FinishTime 任务结束 (完成、失败、取消或被拒绝) 的时间 (毫秒)
+	FinishTime int64 `json:"finish_time,omitempty"`
+	// Imported 从其他设备或备份导入的历史记录
+	Imported bool `json:"imported,omitempty"`
+	// MatchedRule 与 MatchedRuleName 是决定如何处理该请求的接收规则，为空表示没有规则匹配
+	MatchedRule     string `json:"matched_rule,omitempty"`
+	MatchedRuleName string `json:"matched_rule_name,omitempty"`
+	// Transitions 状态变化的记录，按时间升序
+	Transitions []StatusChange `json:"transitions,omitempty"`
+
+	// deltaBasis 接收端用于增量传输的基准文件
+	deltaBasis string
+	// deltaBlockSize 基准文件签名的块大小
+	deltaBlockSize int
+	// receivedHash 接收端对实际收到的内容计算的哈希
+	receivedHash string
+	// sink 不为空时接收的数据流写入调用方提供的 io.Writer
+	sink *receiveSink
 }
 
 type TransferOption func(*Transfer)
 
 func NewTransfer(id string, sender discovery.Peer, opts ...TransferOption) *Transfer {
-	t := &Transfer{
+	t := &Transfer{transferData: transferData{
 		ID:         id,
 		CreateTime: time.Now().UnixMilli(),
 		Sender:     sender,
 		Status:     TransferStatusPending, // Default status
-	}
+	}}
 
 	for _, opt := range opts {
 		opt(t)
 	}
+	t.Transitions = []StatusChange{{Status: t.Status, Time: t.CreateTime}}
 
 	return t
 }
@@ -87,6 +173,12 @@ func WithSavePath(path string) TransferOption {
 	}
 }
 
+func WithSourcePath(path string) TransferOption {
+	return func(t *Transfer) {
+		t.SourcePath = path
+	}
+}
+
 func WithStatus(status TransferStatus) TransferOption {
 	return func(t *Transfer) {
 		t.Status = status
@@ -111,6 +203,27 @@ func WithText(text string) TransferOption {
 	}
 }
 
+func WithMimeType(mimeType string) TransferOption {
+	return func(t *Transfer) {
+		t.MimeType = mimeType
+	}
+}
+
+func WithURL(link, title string) TransferOption {
+	return func(t *Transfer) {
+		t.URL = link
+		t.LinkTitle = title
+	}
+}
+
+func WithThumbnail(thumb string, width, height int) TransferOption {
+	return func(t *Transfer) {
+		t.Thumbnail = thumb
+		t.ImageWidth = width
+		t.ImageHeight = height
+	}
+}
+
 func WithErrorMsg(msg string) TransferOption {
 	return func(t *Transfer) {
 		t.ErrorMsg = msg
@@ -123,10 +236,43 @@ func WithToken(token string) TransferOption {
 	}
 }
 
+func WithFileHash(hash string) TransferOption {
+	return func(t *Transfer) {
+		t.FileHash = hash
+	}
+}
+
+// isFileContent 判断内容是否按单个文件接收
+func isFileContent(contentType ContentType) bool {
+	return contentType == ContentTypeFile ||
+		contentType == ContentTypeImage ||
+		contentType == ContentTypeStream
+}
+
+// isFinished 判断任务是否已经结束
+func isFinished(status TransferStatus) bool {
+	return status == TransferStatusCompleted ||
+		status == TransferStatusError ||
+		status == TransferStatusCanceled ||
+		status == TransferStatusRejected
+}
+
+// HookResult 一次接收后命令的运行结果
+type HookResult struct {
+	HookID    string `json:"hook_id"`
+	Name      string `json:"name"`
+	StartTime int64  `json:"start_time"` // 毫秒
+	Duration  int64  `json:"duration"`   // 毫秒
+	ExitCode  int    `json:"exit_code"`  // 无法启动或超时时为 -1
+	TimedOut  bool   `json:"timed_out"`
+	Output    string `json:"output"` // 标准输出与标准错误，超出上限的部分被截断
+	Error     string `json:"error,omitempty"`
+}
+
 // Progress 用户前端传输进度
 type Progress struct {
 	Current int64   `json:"current"` // 当前进度
-	Total   int64   `json:"total"`   // 总进度
+	Total   int64   `json:"total"`   // 总进度，-1 表示长度未知
 	Speed   float64 `json:"speed"`   // 速度
 }
 
@@ -135,6 +281,8 @@ type Decision struct {
 	ID       string `json:"id"` // 传输会话 ID
 	Accepted bool   `json:"accepted"`
 	SavePath string `json:"save_path"`
+	// ConflictPolicy 为空时使用节点或全局设置
+	ConflictPolicy config.ConflictPolicy `json:"conflict_policy"`
 }
 
 // TransferAskResponse 握手回应
@@ -143,6 +291,18 @@ type TransferAskResponse struct {
 	Accepted bool   `json:"accepted"`
 	Token    string `json:"token,omitempty"`   // 用于上传的凭证
 	Message  string `json:"message,omitempty"` // 错误信息
+	Skipped  bool   `json:"skipped,omitempty"` // 接收端已存在相同文件，无需上传
+	// Deduplicated 接收端已从本地相同内容的文件生成，无需上传
+	Deduplicated bool `json:"deduplicated,omitempty"`
+	// Delta 不为空时发送端只需上传与基准文件不同的部分
+	Delta *DeltaSignature `json:"delta,omitempty"`
+	// HashRequired 接收端需要文件哈希才能判断是否跳过上传，发送端计算后提交到 /transfer/hash
+	HashRequired bool `json:"hash_required,omitempty"`
+}
+
+// TransferHashRequest 发送端按接收端要求提交的文件哈希
+type TransferHashRequest struct {
+	FileHash string `json:"file_hash"`
 }
 
 // TransferUploadResponse 上传回应
@@ -151,3 +311,25 @@ type TransferUploadResponse struct {
 	Message string         `json:"message"`
 	Status  TransferStatus `json:"status"`
 }
+
+// Share 本机发布的共享内容，其他节点可以按需下载 (拉取模式)
+type Share struct {
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Path        string      `json:"path"`
+	ContentType ContentType `json:"content_type"` // file 或 folder
+	Size        int64       `json:"size"`         // 文件夹为 tar 流大小
+	CreateTime  int64       `json:"create_time"`
+	ExpireTime  int64       `json:"expire_time"` // 过期时间 (毫秒)，0 表示永不过期
+	// AllowedPeers 允许下载的节点 ID，为空表示所有节点
+	AllowedPeers []string `json:"allowed_peers"`
+}
+
+// RemoteShare /shares 返回给其他节点的共享信息，不包含本地路径
+type RemoteShare struct {
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	ContentType ContentType `json:"content_type"`
+	Size        int64       `json:"size"`
+	ExpireTime  int64       `json:"expire_time"`
+}
@@ -0,0 +1,397 @@
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/google/uuid"
+	"mesh-drop/internal/config"
+)
+
+const (
+	// outboxStableDelay 文件停止变化多久后才发送，避免发送写了一半的文件
+	outboxStableDelay = 3 * time.Second
+	// outboxCheckInterval 检查待发送文件的间隔
+	outboxCheckInterval = time.Second
+	// outboxRetryDelay 发送失败后重试的间隔，节点离线时会在重新上线后立即重试
+	outboxRetryDelay = 30 * time.Second
+)
+
+// outboxFile 是监视文件夹中等待发送的文件
+type outboxFile struct {
+	size      int64
+	modTime   time.Time
+	changedAt time.Time // 最近一次发现文件变化的时间
+	nextTry   time.Time // 发送失败后下次重试的时间
+	sending   bool
+}
+
+// outbox 是正在运行的监视文件夹规则
+type outbox struct {
+	config.OutboxRule
+
+	mu    sync.Mutex
+	files map[string]*outboxFile // Key: 文件路径
+	// sent 记录 AfterSend 为 keep 时已发送的文件，避免重复发送
+	// Key: 文件名，Value: 发送时的大小与修改时间
+	sent     map[string]string
+	sentPath string
+
+	cancel context.CancelFunc
+}
+
+func (s *Service) outboxSentPath(id string) string {
+	return filepath.Join(s.configDir, "outbox", id+".json")
+}
+
+func newOutbox(rule config.OutboxRule, sentPath string) *outbox {
+	o := &outbox{
+		OutboxRule: rule,
+		files:      make(map[string]*outboxFile),
+		sent:       make(map[string]string),
+		sentPath:   sentPath,
+	}
+	data, err := os.ReadFile(o.sentPath)
+	if err == nil {
+		if err := json.Unmarshal(data, &o.sent); err != nil {
+			slog.Warn("Failed to parse outbox state", "id", o.ID, "error", err, "component", "outbox")
+		}
+	}
+	return o
+}
+
+func (o *outbox) saveSent() {
+	data, err := json.Marshal(o.sent)
+	if err != nil {
+		return
+	}
+	_ = os.MkdirAll(filepath.Dir(o.sentPath), 0o750)
+	if err := os.WriteFile(o.sentPath, data, 0o600); err != nil {
+		slog.Warn("Failed to write outbox state", "id", o.ID, "error", err, "component", "outbox")
+	}
+}
+
+// matches 判断文件名是否符合规则
+func (o *outbox) matches(name string) bool {
+	if isPartialName(name) {
+		return false
+	}
+	if o.Pattern == "" {
+		return true
+	}
+	ok, err := filepath.Match(o.Pattern, name)
+	return err == nil && ok
+}
+
+// touch 记录文件发生了变化，需要在持有 mu 时调用
+func (o *outbox) touch(path string) {
+	if !o.matches(filepath.Base(path)) {
+		return
+	}
+	if f, ok := o.files[path]; ok {
+		f.changedAt = time.Now()
+		return
+	}
+	o.files[path] = &outboxFile{changedAt: time.Now()}
+}
+
+func sentKey(info os.FileInfo) string {
+	return fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixMilli())
+}
+
+// AddOutboxRule 添加监视文件夹规则，rule.ID 为空时生成新的 ID
+func (s *Service) AddOutboxRule(rule config.OutboxRule) (config.OutboxRule, error) {
+	info, err := os.Stat(rule.Path)
+	if err != nil {
+		return config.OutboxRule{}, err
+	}
+	if !info.IsDir() {
+		return config.OutboxRule{}, fmt.Errorf("%s is not a directory", rule.Path)
+	}
+	if rule.PeerID == "" {
+		return config.OutboxRule{}, errors.New("target peer is required")
+	}
+	publicKey, ok := s.peerKey(rule.PeerID)
+	if !ok {
+		return config.OutboxRule{}, errors.New("target peer is unknown")
+	}
+	rule.PublicKey = publicKey
+	if _, err := filepath.Match(rule.Pattern, ""); err != nil {
+		return config.OutboxRule{}, err
+	}
+	switch rule.AfterSend {
+	case "":
+		rule.AfterSend = config.OutboxActionKeep
+	case config.OutboxActionKeep, config.OutboxActionDelete, config.OutboxActionMove:
+	default:
+		return config.OutboxRule{}, fmt.Errorf("unknown after send action: %s", rule.AfterSend)
+	}
+	if rule.ID == "" {
+		rule.ID = uuid.New().String()
+	}
+
+	s.stopOutbox(rule.ID)
+	s.config.SetOutboxRule(rule)
+	s.startOutbox(rule)
+	return rule, nil
+}
+
+// RemoveOutboxRule 停止并删除监视文件夹规则
+func (s *Service) RemoveOutboxRule(id string) {
+	s.stopOutbox(id)
+	s.config.RemoveOutboxRule(id)
+	_ = os.Remove(s.outboxSentPath(id))
+}
+
+func (s *Service) GetOutboxRules() []config.OutboxRule {
+	return s.config.GetOutboxRules()
+}
+
+func (s *Service) startOutboxes() {
+	for _, rule := range s.config.GetOutboxRules() {
+		// 旧版本的规则没有记录公钥，按信任列表补全，其他节点不再发送
+		if rule.PublicKey == "" {
+			if publicKey, ok := s.config.GetTrusted()[rule.PeerID]; ok {
+				rule.PublicKey = publicKey
+				s.config.SetOutboxRule(rule)
+			}
+		}
+		s.startOutbox(rule)
+	}
+}
+
+func (s *Service) startOutbox(rule config.OutboxRule) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("Failed to create watcher", "error", err, "component", "outbox")
+		return
+	}
+	if err := watcher.Add(rule.Path); err != nil {
+		slog.Error("Failed to watch outbox", "path", rule.Path, "error", err, "component", "outbox")
+		_ = watcher.Close()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	o := newOutbox(rule, s.outboxSentPath(rule.ID))
+	o.cancel = cancel
+	s.outboxes.Store(rule.ID, o)
+
+	// 程序未运行期间放入的文件
+	if entries, err := os.ReadDir(rule.Path); err == nil {
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				o.touch(filepath.Join(rule.Path, entry.Name()))
+			}
+		}
+	}
+
+	slog.Info("Outbox started", "id", rule.ID, "path", rule.Path, "component", "outbox")
+	go s.runOutbox(ctx, o, watcher)
+}
+
+func (s *Service) stopOutbox(id string) {
+	if o, ok := s.outboxes.LoadAndDelete(id); ok {
+		o.(*outbox).cancel()
+	}
+}
+
+func (s *Service) runOutbox(ctx context.Context, o *outbox, watcher *fsnotify.Watcher) {
+	defer watcher.Close()
+	ticker := time.NewTicker(outboxCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) {
+				o.mu.Lock()
+				o.touch(event.Name)
+				o.mu.Unlock()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("Watcher error", "id", o.ID, "error", err, "component", "outbox")
+		case <-ticker.C:
+			s.checkOutbox(ctx, o)
+		}
+	}
+}
+
+// checkOutbox 发送已经停止变化的文件
+func (s *Service) checkOutbox(ctx context.Context, o *outbox) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	for path, f := range o.files {
+		if f.sending {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			delete(o.files, path)
+			continue
+		}
+		if info.Size() != f.size || !info.ModTime().Equal(f.modTime) {
+			f.size = info.Size()
+			f.modTime = info.ModTime()
+			f.changedAt = now
+			continue
+		}
+		if now.Sub(f.changedAt) < outboxStableDelay || now.Before(f.nextTry) {
+			continue
+		}
+		if o.sent[info.Name()] == sentKey(info) {
+			delete(o.files, path)
+			continue
+		}
+
+		// 节点离线时保留文件，重新上线后发送
+		peer, ok := s.discoveryService.GetPeerByID(o.PeerID)
+		if !ok {
+			continue
+		}
+		// 同一 ID 的节点公钥变化时可能是其他设备冒用
+		if peer.PublicKey != o.PublicKey || peer.TrustMismatch {
+			slog.Warn(
+				"Outbox file not sent: peer public key changed",
+				"id",
+				o.ID,
+				"path",
+				path,
+				"component",
+				"outbox",
+			)
+			f.nextTry = now.Add(outboxRetryDelay)
+			continue
+		}
+		ip, ok := latestRouteIP(peer)
+		if !ok {
+			continue
+		}
+
+		task, done := s.sendFile(peer, ip, path)
+		if task == nil {
+			f.nextTry = now.Add(outboxRetryDelay)
+			continue
+		}
+		f.sending = true
+		slog.Info("Outbox sending file", "id", o.ID, "path", path, "component", "outbox")
+		go s.finishOutboxSend(ctx, o, path, info, task, done)
+	}
+}
+
+// finishOutboxSend 等待发送结束并处理源文件
+func (s *Service) finishOutboxSend(
+	ctx context.Context,
+	o *outbox,
+	path string,
+	info os.FileInfo,
+	task *Transfer,
+	done <-chan struct{},
+) {
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f, ok := o.files[path]
+	if !ok {
+		return
+	}
+	f.sending = false
+
+	status, errMsg := task.state()
+	switch status {
+	case TransferStatusCompleted:
+		delete(o.files, path)
+		o.afterSend(path, info)
+	case TransferStatusRejected, TransferStatusCanceled:
+		// 接收端拒绝或用户取消时不再重试，文件再次变化后才会重新发送
+		delete(o.files, path)
+		slog.Info(
+			"Outbox file not sent",
+			"id",
+			o.ID,
+			"path",
+			path,
+			"status",
+			status,
+			"component",
+			"outbox",
+		)
+	default:
+		f.nextTry = time.Now().Add(outboxRetryDelay)
+		if _, online := s.discoveryService.GetPeerByID(o.PeerID); !online {
+			// 节点已离线，重新上线后立即重试
+			f.nextTry = time.Time{}
+		}
+		slog.Warn(
+			"Outbox send failed, will retry",
+			"id",
+			o.ID,
+			"path",
+			path,
+			"status",
+			status,
+			"error",
+			errMsg,
+			"component",
+			"outbox",
+		)
+	}
+}
+
+// afterSend 按规则处理发送成功的源文件
+func (o *outbox) afterSend(path string, info os.FileInfo) {
+	var err error
+	switch o.AfterSend {
+	case config.OutboxActionDelete:
+		err = os.Remove(path)
+	case config.OutboxActionMove:
+		moveTo := o.MoveTo
+		if moveTo == "" {
+			moveTo = filepath.Join(o.Path, "sent")
+		}
+		if err = os.MkdirAll(moveTo, 0o750); err == nil {
+			err = os.Rename(path, uniquePath(moveTo, info.Name(), false))
+		}
+	default:
+		o.sent[info.Name()] = sentKey(info)
+		o.saveSent()
+	}
+	if err != nil {
+		slog.Error(
+			"Failed to handle sent file",
+			"id",
+			o.ID,
+			"path",
+			path,
+			"action",
+			o.AfterSend,
+			"error",
+			err,
+			"component",
+			"outbox",
+		)
+	}
+}
@@ -0,0 +1,241 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// partialPrefix 是所有接收中临时数据的文件名前缀
+const partialPrefix = ".meshdrop-"
+
+type partialKind string
+
+const (
+	partialKindFile    partialKind = "file"    // 单个文件的 .part 临时文件
+	partialKindStaging partialKind = "staging" // 文件夹的暂存目录
+	partialKindMerge   partialKind = "merge"   // 合并写入的已有文件夹，内部可能残留 .part 文件
+)
+
+// partialJournal 记录尚未完成的临时数据
+// 程序崩溃后，启动时根据记录清理残留的临时文件与暂存目录
+type partialJournal struct {
+	mu    sync.Mutex
+	path  string
+	items map[string]partialKind // Key: 路径
+}
+
+func (s *Service) partialJournalPath() string {
+	return filepath.Join(s.configDir, "partials.json")
+}
+
+func newPartialJournal(path string) *partialJournal {
+	j := &partialJournal{
+		path:  path,
+		items: make(map[string]partialKind),
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &j.items); err != nil {
+			slog.Warn("Failed to parse partial journal", "error", err, "component", "transfer")
+		}
+	}
+	return j
+}
+
+func (j *partialJournal) add(path string, kind partialKind) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.items[path] = kind
+	j.save()
+}
+
+func (j *partialJournal) remove(path string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.items, path)
+	j.save()
+}
+
+func (j *partialJournal) save() {
+	data, err := json.Marshal(j.items)
+	if err != nil {
+		return
+	}
+	tempPath := j.path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0o600); err != nil {
+		slog.Warn("Failed to write partial journal", "error", err, "component", "transfer")
+		return
+	}
+	if err := os.Rename(tempPath, j.path); err != nil {
+		_ = os.Remove(tempPath)
+	}
+}
+
+// clean 删除记录中以及 saveDir 顶层残留的临时数据
+// 只能在没有进行中的接收任务时调用
+func (j *partialJournal) clean(saveDir string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for path, kind := range j.items {
+		switch kind {
+		case partialKindMerge:
+			removePartFiles(path)
+		default:
+			if err := os.RemoveAll(path); err != nil {
+				slog.Warn("Failed to remove stale partial data", "path", path, "error", err)
+			}
+		}
+		slog.Info("Removed stale partial data", "path", path, "component", "transfer")
+	}
+	j.items = make(map[string]partialKind)
+	j.save()
+
+	entries, err := os.ReadDir(saveDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if isPartialName(entry.Name()) {
+			_ = os.RemoveAll(filepath.Join(saveDir, entry.Name()))
+			slog.Info("Removed stale partial data", "path", entry.Name(), "component", "transfer")
+		}
+	}
+}
+
+// removePartFiles 删除目录中残留的 .part 临时文件
+func removePartFiles(root string) {
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() && isPartialName(d.Name()) {
+			_ = os.Remove(path)
+		}
+		return nil
+	})
+}
+
+func isPartialName(name string) bool {
+	return strings.HasPrefix(name, partialPrefix) &&
+		(strings.HasSuffix(name, ".part") || strings.HasSuffix(name, ".staging"))
+}
+
+// partialNameMax 临时文件名中保留的原名称的最大字节数
+// 前缀、ID 与后缀共占用 55 字节，文件名长度上限通常为 255 字节
+const partialNameMax = 100
+
+// partFileName 返回接收文件时使用的隐藏临时文件名
+func partFileName(id, name string) string {
+	return fmt.Sprintf("%s%s-%s.part", partialPrefix, id, partialName(name))
+}
+
+// stagingDirName 返回接收文件夹时使用的隐藏暂存目录名
+func stagingDirName(id, name string) string {
+	return fmt.Sprintf("%s%s-%s.staging", partialPrefix, id, partialName(name))
+}
+
+// partialName 原名称过长时截断，并附加哈希区分截断后相同的名称
+// 结果只取决于 name，续传时可以找到同一个临时文件
+func partialName(name string) string {
+	if len(name) <= partialNameMax {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := "~" + hex.EncodeToString(sum[:8])
+	return strings.ToValidUTF8(name[:partialNameMax-len(suffix)], "") + suffix
+}
+
+// partFile 先写入同目录下的隐藏临时文件，Commit 后才重命名到最终路径
+// 其他程序不会看到写了一半的文件，崩溃也不会留下看似完整的截断文件
+type partFile struct {
+	*os.File
+	destPath string
+	journal  *partialJournal
+}
+
+func createPartFile(journal *partialJournal, destPath, id string) (*partFile, error) {
+	partPath := filepath.Join(filepath.Dir(destPath), partFileName(id, filepath.Base(destPath)))
+	// 与 os.Create 相同的权限，最终权限由 umask 决定
+	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o666) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+	journal.add(partPath, partialKindFile)
+	return &partFile{
+		File:     file,
+		destPath: destPath,
+		journal:  journal,
+	}, nil
+}
+
+// openPartFile 打开已有的临时文件用于续传，返回已写入的字节数
+// 临时文件不存在时创建新的空文件
+func openPartFile(journal *partialJournal, destPath, id string) (*partFile, int64, error) {
+	partPath := filepath.Join(filepath.Dir(destPath), partFileName(id, filepath.Base(destPath)))
+	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0o666) //nolint:gosec
+	if err != nil {
+		return nil, 0, err
+	}
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = file.Close()
+		return nil, 0, err
+	}
+	journal.add(partPath, partialKindFile)
+	return &partFile{
+		File:     file,
+		destPath: destPath,
+		journal:  journal,
+	}, offset, nil
+}
+
+// Reset 清空已写入的内容，从头开始写入
+func (p *partFile) Reset() error {
+	if err := p.Truncate(0); err != nil {
+		return err
+	}
+	_, err := p.Seek(0, io.SeekStart)
+	return err
+}
+
+// Commit 落盘并重命名到最终路径
+func (p *partFile) Commit() error {
+	defer p.journal.remove(p.Name())
+	if err := p.Sync(); err != nil {
+		_ = p.Close()
+		_ = os.Remove(p.Name())
+		return err
+	}
+	if err := p.Close(); err != nil {
+		_ = os.Remove(p.Name())
+		return err
+	}
+	if err := os.Rename(p.Name(), p.destPath); err != nil {
+		_ = os.Remove(p.Name())
+		return err
+	}
+	return nil
+}
+
+// Detach 关闭但保留临时文件，用于之后续传
+// 临时文件仍留在记录中，若不再续传会在下次启动时清理
+func (p *partFile) Detach() {
+	_ = p.Close()
+}
+
+// Abort 放弃写入并删除临时文件
+func (p *partFile) Abort() {
+	_ = p.Close()
+	_ = os.Remove(p.Name())
+	p.journal.remove(p.Name())
+}
@@ -0,0 +1,222 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // 注册 gif 解码器
+	"image/jpeg"
+	_ "image/png" // 注册 png 解码器
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// thumbnailMaxDim 缩略图最长边的像素数
+	thumbnailMaxDim = 160
+	// thumbnailMaxPixels 原图像素数上限，避免解码超大图片占用过多内存
+	thumbnailMaxPixels = 50_000_000
+	// thumbnailMaxLen 接收端接受的缩略图 data URL 最大长度
+	thumbnailMaxLen = 64 << 10
+	thumbnailPrefix = "data:image/jpeg;base64,"
+
+	// linkTitleTimeout 获取网页标题的超时时间
+	linkTitleTimeout = 5 * time.Second
+	// linkTitleMaxRead 获取网页标题时最多读取的字节数
+	linkTitleMaxRead = 512 << 10
+	// linkTitleMaxLen 网页标题的最大字符数
+	linkTitleMaxLen = 200
+)
+
+// makeThumbnail 生成图片缩略图，返回 JPEG data URL 以及原图尺寸
+func makeThumbnail(path string) (string, int, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer file.Close()
+
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > thumbnailMaxPixels {
+		return "", 0, 0, fmt.Errorf("unsupported image size %dx%d", cfg.Width, cfg.Height)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", 0, 0, err
+	}
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleDown(src, thumbnailMaxDim), &jpeg.Options{Quality: 75}); err != nil {
+		return "", 0, 0, err
+	}
+	thumb := thumbnailPrefix + base64.StdEncoding.EncodeToString(buf.Bytes())
+	return thumb, cfg.Width, cfg.Height, nil
+}
+
+// scaleDown 按区域平均将图片缩小到最长边不超过 maxDim
+func scaleDown(src image.Image, maxDim int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxDim && h <= maxDim {
+		return src
+	}
+	dw, dh := maxDim, h*maxDim/w
+	if h > w {
+		dw, dh = w*maxDim/h, maxDim
+	}
+	dw, dh = max(dw, 1), max(dh, 1)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := range dh {
+		y0, y1 := b.Min.Y+y*h/dh, b.Min.Y+max((y+1)*h/dh, y*h/dh+1)
+		for x := range dw {
+			x0, x1 := b.Min.X+x*w/dw, b.Min.X+max((x+1)*w/dw, x*w/dw+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)  //nolint:gosec
+			dst.Pix[i+1] = uint8(g / n >> 8)  //nolint:gosec
+			dst.Pix[i+2] = uint8(bl / n >> 8) //nolint:gosec
+			dst.Pix[i+3] = uint8(a / n >> 8)  //nolint:gosec
+		}
+	}
+	return dst
+}
+
+// validThumbnail 检查发送端提供的缩略图，只接受能够解码的较小 JPEG data URL
+func validThumbnail(thumb string) bool {
+	if len(thumb) > thumbnailMaxLen || !strings.HasPrefix(thumb, thumbnailPrefix) {
+		return false
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(thumb, thumbnailPrefix))
+	if err != nil {
+		return false
+	}
+	// 先检查尺寸，避免按伪造的尺寸分配内存
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 ||
+		cfg.Width > thumbnailMaxDim || cfg.Height > thumbnailMaxDim {
+		return false
+	}
+	_, err = jpeg.Decode(bytes.NewReader(data))
+	return err == nil
+}
+
+// checkReceivedImage 收到的图片无法解码或尺寸与请求不一致时按普通文件处理
+func checkReceivedImage(task *Transfer) {
+	file, err := os.Open(task.FilePath)
+	if err == nil {
+		defer file.Close()
+		var cfg image.Config
+		cfg, _, err = image.DecodeConfig(file)
+		if err == nil && (cfg.Width != task.ImageWidth || cfg.Height != task.ImageHeight) {
+			err = fmt.Errorf(
+				"image size %dx%d, declared %dx%d",
+				cfg.Width,
+				cfg.Height,
+				task.ImageWidth,
+				task.ImageHeight,
+			)
+		}
+	}
+	if err == nil {
+		return
+	}
+	slog.Warn(
+		"Received image is not valid, treating it as a file",
+		"id",
+		task.ID,
+		"error",
+		err,
+		"component",
+		"transfer",
+	)
+	task.update(func() {
+		task.ContentType = ContentTypeFile
+		task.Thumbnail = ""
+		task.ImageWidth = 0
+		task.ImageHeight = 0
+	})
+}
+
+// parseLinkURL 解析并检查链接，只允许 http 与 https
+func parseLinkURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("only http and https links are supported")
+	}
+	return u, nil
+}
+
+// fetchLinkTitle 获取网页标题，失败时返回空字符串
+func fetchLinkTitle(ctx context.Context, link string) string {
+	ctx, cancel := context.WithTimeout(ctx, linkTitleTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("Accept", "text/html")
+	// 访问外部网站，不能使用跳过证书验证的 s.httpClient
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusOK || mediaType != "text/html" {
+		return ""
+	}
+
+	z := html.NewTokenizer(io.LimitReader(resp.Body, linkTitleMaxRead))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken:
+			name, _ := z.TagName()
+			if string(name) != "title" {
+				continue
+			}
+			if z.Next() != html.TextToken {
+				return ""
+			}
+			return truncateRunes(strings.Join(strings.Fields(string(z.Text())), " "), linkTitleMaxLen)
+		}
+	}
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n]) + "…"
+}
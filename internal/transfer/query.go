@@ -0,0 +1,89 @@
+package transfer
+
+import (
+	"slices"
+	"strings"
+)
+
+// TransferQuery 传输列表的查询条件，为空的条件匹配所有任务
+type TransferQuery struct {
+	// PeerID 接收任务的发送节点或发送任务的接收节点
+	PeerID       string           `json:"peer_id"`
+	Statuses     []TransferStatus `json:"statuses"`
+	ContentTypes []ContentType    `json:"content_types"`
+	Since        int64            `json:"since"` // 创建时间下限 (毫秒)，包含
+	Until        int64            `json:"until"` // 创建时间上限 (毫秒)，不包含
+	// Search 在文件名、文本、链接与节点名称中搜索，不区分大小写
+	Search string `json:"search"`
+	Offset int    `json:"offset"`
+	Limit  int    `json:"limit"` // 0 表示不限制
+}
+
+// TransferPage 分页查询的结果
+type TransferPage struct {
+	Items []*Transfer `json:"items"`
+	Total int         `json:"total"` // 满足条件的任务总数
+}
+
+// QueryTransfers 按条件查询传输列表，结果按创建时间降序排列
+func (s *Service) QueryTransfers(query TransferQuery) TransferPage {
+	search := strings.ToLower(strings.TrimSpace(query.Search))
+	tasks := s.GetTransferList()
+	tasks = slices.DeleteFunc(tasks, func(t *Transfer) bool {
+		return !query.matches(t, search)
+	})
+	return paginate(tasks, query.Offset, query.Limit)
+}
+
+// GetTransferPage 分页返回传输列表
+func (s *Service) GetTransferPage(offset, limit int) TransferPage {
+	return paginate(s.GetTransferList(), offset, limit)
+}
+
+func paginate(tasks []*Transfer, offset, limit int) TransferPage {
+	page := TransferPage{Items: make([]*Transfer, 0), Total: len(tasks)}
+	offset = max(offset, 0)
+	if offset >= len(tasks) {
+		return page
+	}
+	tasks = tasks[offset:]
+	if limit > 0 && limit < len(tasks) {
+		tasks = tasks[:limit]
+	}
+	page.Items = tasks
+	return page
+}
+
+// matches 判断任务是否满足条件，search 已转换为小写
+func (q TransferQuery) matches(t *Transfer, search string) bool {
+	if q.PeerID != "" {
+		peerID := t.Sender.ID
+		if t.Type == TransferTypeSend {
+			peerID = t.TargetID
+		}
+		if peerID != q.PeerID {
+			return false
+		}
+	}
+	if len(q.Statuses) > 0 && !slices.Contains(q.Statuses, t.Status) {
+		return false
+	}
+	if len(q.ContentTypes) > 0 && !slices.Contains(q.ContentTypes, t.ContentType) {
+		return false
+	}
+	if q.Since > 0 && t.CreateTime < q.Since {
+		return false
+	}
+	if q.Until > 0 && t.CreateTime >= q.Until {
+		return false
+	}
+	if search != "" {
+		fields := []string{t.FileName, t.Text, t.URL, t.LinkTitle, t.Sender.Name, t.TargetName}
+		if !slices.ContainsFunc(fields, func(f string) bool {
+			return strings.Contains(strings.ToLower(f), search)
+		}) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,439 @@
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"mesh-drop/internal/discovery"
+)
+
+const (
+	// QueueExpireCheckInterval 检查离线队列是否过期的间隔
+	QueueExpireCheckInterval = 30 * time.Second
+	// queueRetryDelay 发送失败后，节点再次出现时至少等待多久才重新发送
+	queueRetryDelay = time.Minute
+	// sendWindowCheckInterval 发送计划任务时检查时间段是否已关闭的间隔
+	sendWindowCheckInterval = 30 * time.Second
+)
+
+// QueuedSend 等待节点上线后发送的内容
+type QueuedSend struct {
+	ID          string      `json:"id"`
+	PeerID      string      `json:"peer_id"`
+	PeerName    string      `json:"peer_name"`
+	PublicKey   string      `json:"public_key"` // 加入队列时节点的公钥，公钥不同时不发送
+	ContentType ContentType `json:"content_type"`
+	Path        string      `json:"path,omitempty"` // 文件或文件夹路径
+	Text        string      `json:"text,omitempty"`
+	CreateTime  int64       `json:"create_time"`
+	ExpireTime  int64       `json:"expire_time"` // 过期时间 (毫秒)，0 表示永不过期
+	// StartTime 计划发送时间 (毫秒)，0 表示节点上线后立即发送
+	StartTime int64 `json:"start_time,omitempty"`
+	// UseWindow 只在该节点的发送时间段内发送，时间段关闭时推迟到下一个时间段
+	UseWindow bool `json:"use_window,omitempty"`
+
+	// delivering 正在发送，避免重复触发
+	delivering bool
+	// retryAt 上次发送失败后，早于该时间的心跳不会触发发送
+	retryAt time.Time
+}
+
+// errMsgPeerKeyChanged 节点公钥与加入队列时不同，不发送
+const errMsgPeerKeyChanged = "Peer public key changed"
+
+func (s *Service) queuePath() string {
+	return filepath.Join(s.configDir, "queue.json")
+}
+
+// QueueSend 将文件或文件夹加入离线队列，节点下次出现时自动发送
+// expireSeconds 为 0 表示永不过期，返回加入队列时任务的副本
+func (s *Service) QueueSend(peerID string, path string, expireSeconds int64) (*Transfer, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	item := &QueuedSend{
+		ContentType: ContentTypeFile,
+		Path:        path,
+	}
+	if info.IsDir() {
+		item.ContentType = ContentTypeFolder
+	}
+	return s.enqueue(peerID, item, expireSeconds)
+}
+
+// ScheduleSend 计划在 startTime (毫秒) 之后发送文件或文件夹，0 表示不限开始时间
+// useWindow 为 true 时只在节点的发送时间段内发送，见 config.SendWindow
+// 与离线队列相同，到期时节点的公钥与计划时不同则不发送
+func (s *Service) ScheduleSend(
+	peerID string,
+	path string,
+	startTime int64,
+	useWindow bool,
+	expireSeconds int64,
+) (*Transfer, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	item := &QueuedSend{
+		ContentType: ContentTypeFile,
+		Path:        path,
+		StartTime:   startTime,
+		UseWindow:   useWindow,
+	}
+	if info.IsDir() {
+		item.ContentType = ContentTypeFolder
+	}
+	return s.enqueue(peerID, item, expireSeconds)
+}
+
+// QueueText 将文本加入离线队列
+func (s *Service) QueueText(peerID string, text string, expireSeconds int64) (*Transfer, error) {
+	return s.enqueue(peerID, &QueuedSend{
+		ContentType: ContentTypeText,
+		Text:        text,
+	}, expireSeconds)
+}
+
+func (s *Service) enqueue(peerID string, item *QueuedSend, expireSeconds int64) (*Transfer, error) {
+	if peerID == "" {
+		return nil, errors.New("target peer is required")
+	}
+	publicKey, ok := s.peerKey(peerID)
+	if !ok {
+		return nil, errors.New("target peer is unknown")
+	}
+	item.ID = uuid.New().String()
+	item.PeerID = peerID
+	item.PublicKey = publicKey
+	item.CreateTime = time.Now().UnixMilli()
+	if expireSeconds > 0 {
+		item.ExpireTime = time.Now().Add(time.Duration(expireSeconds) * time.Second).UnixMilli()
+	}
+	if peer, ok := s.discoveryService.GetPeerByID(peerID); ok {
+		item.PeerName = peer.Name
+	}
+
+	s.queueMu.Lock()
+	s.queue[item.ID] = item
+	s.saveQueue()
+	s.queueMu.Unlock()
+
+	task := s.storeQueuedTransfer(item)
+	slog.Info("Send queued", "id", item.ID, "peer", peerID, "component", "transfer")
+
+	// 节点已经在线时立即发送
+	if peer, ok := s.discoveryService.GetPeerByID(peerID); ok {
+		s.deliverQueued(*peer)
+	}
+	return task.Snapshot(), nil
+}
+
+// peerKey 返回节点的公钥，受信任节点使用信任时记录的公钥，其他节点使用发现时的公钥
+func (s *Service) peerKey(peerID string) (string, bool) {
+	if publicKey, ok := s.config.GetTrusted()[peerID]; ok {
+		return publicKey, true
+	}
+	if peer, ok := s.discoveryService.GetPeerByID(peerID); ok && peer.PublicKey != "" {
+		return peer.PublicKey, true
+	}
+	return "", false
+}
+
+// GetQueue 返回离线队列中的所有内容
+func (s *Service) GetQueue() []QueuedSend {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	list := make([]QueuedSend, 0, len(s.queue))
+	for _, item := range s.queue {
+		list = append(list, *item)
+	}
+	return list
+}
+
+// RemoveQueued 从离线队列中删除，返回 false 表示不存在
+func (s *Service) RemoveQueued(id string) bool {
+	return s.dequeue(id, TransferStatusCanceled, "")
+}
+
+func (s *Service) loadQueue() {
+	data, err := os.ReadFile(s.queuePath())
+	if err != nil {
+		return
+	}
+	var items []*QueuedSend
+	if err := json.Unmarshal(data, &items); err != nil {
+		slog.Warn("Failed to parse queue", "error", err, "component", "transfer")
+		return
+	}
+	s.queueMu.Lock()
+	for _, item := range items {
+		// 旧版本的队列没有记录公钥，按信任列表补全，其他节点不再发送
+		if item.PublicKey == "" {
+			item.PublicKey = s.config.GetTrusted()[item.PeerID]
+		}
+		s.queue[item.ID] = item
+	}
+	s.queueMu.Unlock()
+
+	for _, item := range items {
+		s.storeQueuedTransfer(item)
+	}
+	s.expireQueue()
+}
+
+// saveQueue 需要在持有 queueMu 时调用
+func (s *Service) saveQueue() {
+	items := make([]*QueuedSend, 0, len(s.queue))
+	for _, item := range s.queue {
+		items = append(items, item)
+	}
+	data, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(s.queuePath(), data, 0o600); err != nil {
+		slog.Error("Failed to save queue", "error", err, "component", "transfer")
+	}
+}
+
+// storeQueuedTransfer 在传输列表中显示等待节点上线的任务，取消该任务即移出队列
+func (s *Service) storeQueuedTransfer(item *QueuedSend) *Transfer {
+	name := ""
+	var size int64
+	switch item.ContentType {
+	case ContentTypeText:
+		size = int64(len(item.Text))
+	default:
+		name = filepath.Base(item.Path)
+		if info, err := os.Stat(item.Path); err == nil && !info.IsDir() {
+			size = info.Size()
+		}
+	}
+
+	status := TransferStatusWaiting
+	if item.StartTime > 0 || item.UseWindow {
+		status = TransferStatusScheduled
+	}
+	task := NewTransfer(
+		item.ID,
+		s.discoveryService.GetSelf(),
+		WithFileName(name),
+		WithFileSize(size),
+		WithSourcePath(item.Path),
+		WithType(TransferTypeSend),
+		WithContentType(item.ContentType),
+		WithText(item.Text),
+		WithStatus(status),
+	)
+	task.ScheduledTime = item.StartTime
+	task.CreateTime = item.CreateTime
+	task.TargetID = item.PeerID
+	task.TargetName = item.PeerName
+	task.ExpireTime = item.ExpireTime
+	s.cancelMap.Store(item.ID, context.CancelFunc(func() {
+		s.RemoveQueued(item.ID)
+	}))
+	s.StoreTransferToList(task)
+	return task
+}
+
+// dequeue 移出队列，并将对应的等待任务标记为 status
+// status 为空时直接从传输列表中删除等待任务
+func (s *Service) dequeue(id string, status TransferStatus, msg string) bool {
+	s.queueMu.Lock()
+	_, ok := s.queue[id]
+	if ok {
+		delete(s.queue, id)
+		s.saveQueue()
+	}
+	s.queueMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	s.cancelMap.Delete(id)
+	if status == "" {
+		s.DeleteTransfer(id)
+		return true
+	}
+	if task, ok := s.loadTransfer(id); ok {
+		task.transition(status, msg)
+	}
+	s.NotifyTransferListUpdate()
+	return true
+}
+
+// expireQueue 删除已过期的内容
+func (s *Service) expireQueue() {
+	now := time.Now().UnixMilli()
+	var expired []string
+	s.queueMu.Lock()
+	for id, item := range s.queue {
+		if item.ExpireTime > 0 && item.ExpireTime <= now && !item.delivering {
+			expired = append(expired, id)
+		}
+	}
+	s.queueMu.Unlock()
+
+	for _, id := range expired {
+		slog.Info("Queued send expired", "id", id, "component", "transfer")
+		s.dequeue(id, TransferStatusCanceled, "Peer did not come online before expiry")
+	}
+}
+
+func (s *Service) startQueueExpiry() {
+	ticker := time.NewTicker(QueueExpireCheckInterval)
+	for range ticker.C {
+		s.expireQueue()
+	}
+}
+
+// readyToSend 判断是否已到计划时间且处于节点的发送时间段内
+func (s *Service) readyToSend(item *QueuedSend, now time.Time) bool {
+	if item.StartTime > 0 && now.UnixMilli() < item.StartTime {
+		return false
+	}
+	return !item.UseWindow || s.windowOpen(item.PeerID, now)
+}
+
+// windowOpen 判断当前是否处于节点的发送时间段内，未设置时间段时总是允许
+func (s *Service) windowOpen(peerID string, now time.Time) bool {
+	window, ok := s.config.GetSendWindow(peerID)
+	return !ok || window.Contains(now)
+}
+
+// deliverQueued 在节点心跳时调用，发送该节点的所有排队内容
+func (s *Service) deliverQueued(peer discovery.Peer) {
+	if peer.TrustMismatch {
+		return
+	}
+	ip, ok := latestRouteIP(&peer)
+	if !ok {
+		return
+	}
+
+	var items, mismatched []*QueuedSend
+	s.queueMu.Lock()
+	for _, item := range s.queue {
+		if item.PeerID != peer.ID || item.delivering || !time.Now().After(item.retryAt) ||
+			!s.readyToSend(item, time.Now()) {
+			continue
+		}
+		// 同一 ID 的节点公钥变化时可能是其他设备冒用，保留在队列中直到过期
+		if item.PublicKey != peer.PublicKey {
+			item.retryAt = time.Now().Add(queueRetryDelay)
+			mismatched = append(mismatched, item)
+			continue
+		}
+		item.delivering = true
+		items = append(items, item)
+	}
+	s.queueMu.Unlock()
+
+	for _, item := range mismatched {
+		slog.Warn(
+			"Queued send not delivered: peer public key changed",
+			"id",
+			item.ID,
+			"peer",
+			peer.Name,
+			"component",
+			"transfer",
+		)
+		if waiting, ok := s.loadTransfer(item.ID); ok {
+			waiting.update(func() { waiting.ErrorMsg = errMsgPeerKeyChanged })
+		}
+	}
+	if len(mismatched) > 0 {
+		s.NotifyTransferListUpdate()
+	}
+
+	for _, item := range items {
+		go s.deliver(peer, ip, item)
+	}
+}
+
+// deliver 发送排队的内容
+// 成功或被拒绝时移出队列，其他失败保留在队列中等待节点下次出现
+func (s *Service) deliver(peer discovery.Peer, ip string, item *QueuedSend) {
+	slog.Info("Delivering queued send", "id", item.ID, "peer", peer.Name, "component", "transfer")
+	var task *Transfer
+	var done <-chan struct{}
+	switch item.ContentType {
+	case ContentTypeFile:
+		task, done = s.sendFile(&peer, ip, item.Path)
+	case ContentTypeFolder:
+		task, done = s.sendFolder(&peer, ip, item.Path, s.config.GetFolderFilter())
+	case ContentTypeText:
+		task, done = s.sendText(&peer, ip, item.Text)
+	}
+	if task == nil {
+		// 源文件已不存在
+		s.dequeue(item.ID, TransferStatusError, "Failed to read queued content")
+		return
+	}
+
+	if s.waitDelivery(item, task, done) {
+		// 时间段已关闭，删除未完成的发送记录，推迟到下一个时间段
+		slog.Info("Send window closed, deferring", "id", item.ID, "component", "transfer")
+		s.DeleteTransfer(task.ID)
+		s.queueMu.Lock()
+		item.delivering = false
+		s.queueMu.Unlock()
+		if waiting, ok := s.loadTransfer(item.ID); ok {
+			waiting.update(func() { waiting.ErrorMsg = "Deferred until the next send window" })
+		}
+		s.NotifyTransferListUpdate()
+		return
+	}
+	// 用户或接收端主动取消时同样移出队列
+	status, errMsg := task.state()
+	canceled := status == TransferStatusCanceled && errMsg != errMsgReceiverOffline
+	switch {
+	case status == TransferStatusCompleted, status == TransferStatusRejected, canceled:
+		// 发送记录已在传输列表中，删除等待任务
+		s.dequeue(item.ID, "", "")
+	default:
+		// 删除失败的发送记录，保留等待任务
+		s.DeleteTransfer(task.ID)
+		s.queueMu.Lock()
+		item.delivering = false
+		item.retryAt = time.Now().Add(queueRetryDelay)
+		s.queueMu.Unlock()
+		if waiting, ok := s.loadTransfer(item.ID); ok {
+			waiting.update(func() { waiting.ErrorMsg = errMsg })
+		}
+		s.NotifyTransferListUpdate()
+	}
+}
+
+// waitDelivery 等待发送结束，计划任务的时间段关闭时取消发送
+// 返回 true 表示发送因时间段关闭而被推迟
+func (s *Service) waitDelivery(item *QueuedSend, task *Transfer, done <-chan struct{}) bool {
+	if !item.UseWindow {
+		<-done
+		return false
+	}
+	ticker := time.NewTicker(sendWindowCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return false
+		case now := <-ticker.C:
+			if !s.windowOpen(item.PeerID, now) {
+				s.CancelTransfer(task.ID)
+				<-done
+				return task.status() != TransferStatusCompleted
+			}
+		}
+	}
+}
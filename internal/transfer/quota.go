@@ -0,0 +1,168 @@
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"mesh-drop/internal/config"
+	"mesh-drop/internal/discovery"
+	"mesh-drop/internal/fsutil"
+)
+
+// quotaUsage 记录当天已接收的字节数
+type quotaUsage struct {
+	Day  string `json:"day"` // 格式 2006-01-02，按本地时间计算
+	Used int64  `json:"used"`
+}
+
+// quotaTracker 持久化每日接收量，重启后仍然有效
+type quotaTracker struct {
+	mu    sync.Mutex
+	path  string
+	usage quotaUsage
+}
+
+func (s *Service) quotaPath() string {
+	return filepath.Join(s.configDir, "quota.json")
+}
+
+func newQuotaTracker(path string) *quotaTracker {
+	q := &quotaTracker{path: path}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &q.usage); err != nil {
+			slog.Warn("Failed to parse quota usage", "error", err, "component", "transfer")
+		}
+	}
+	return q
+}
+
+// used 返回当天已接收的字节数
+func (q *quotaTracker) used() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.usage.Day != today() {
+		return 0
+	}
+	return q.usage.Used
+}
+
+// add 累加当天已接收的字节数
+func (q *quotaTracker) add(n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.usage.Day != today() {
+		q.usage = quotaUsage{Day: today()}
+	}
+	q.usage.Used += n
+
+	data, err := json.Marshal(q.usage)
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(q.path, data, 0o600); err != nil {
+		slog.Warn("Failed to write quota usage", "error", err, "component", "transfer")
+	}
+}
+
+func today() string {
+	return time.Now().Format(time.DateOnly)
+}
+
+// peerSettingsFor 返回 sender 的单独设置，仅对未出现密钥不匹配的受信任节点生效
+func (s *Service) peerSettingsFor(sender discovery.Peer) (config.PeerSettings, bool) {
+	if !s.config.IsTrusted(sender.ID) || sender.TrustMismatch {
+		return config.PeerSettings{}, false
+	}
+	return s.config.GetPeerSettings(sender.ID)
+}
+
+// maxReceiveSize 返回 sender 的单次接收大小上限，0 表示不限制
+func (s *Service) maxReceiveSize(sender discovery.Peer) int64 {
+	maxSize := s.config.GetMaxReceiveSize()
+	if settings, ok := s.peerSettingsFor(sender); ok && settings.MaxReceiveSize > 0 {
+		maxSize = settings.MaxReceiveSize
+	}
+	return maxSize
+}
+
+// checkReceiveLimits 检查单次大小上限与每日配额
+// 返回拒绝原因，为空表示允许接收
+func (s *Service) checkReceiveLimits(task *Transfer) string {
+	maxSize := s.maxReceiveSize(task.Sender)
+	if maxSize > 0 && task.FileSize > maxSize {
+		return fmt.Sprintf(
+			"Transfer size %s exceeds the receiver's limit of %s",
+			formatBytes(task.FileSize),
+			formatBytes(maxSize),
+		)
+	}
+
+	quota := s.config.GetDailyQuota()
+	if quota > 0 {
+		used := s.quota.used() + s.inFlightReceiveBytes()
+		if used+task.FileSize > quota {
+			return fmt.Sprintf(
+				"Receiver's daily quota exceeded: %s of %s remaining",
+				formatBytes(max(quota-used, 0)),
+				formatBytes(quota),
+			)
+		}
+	}
+	return ""
+}
+
+// checkDiskSpace 检查保存路径所在磁盘的可用空间
+// 返回拒绝原因，为空表示空间足够或无法获取可用空间
+func (s *Service) checkDiskSpace(task *Transfer, savePath string) string {
+	if !isFileContent(task.ContentType) && task.ContentType != ContentTypeFolder {
+		return ""
+	}
+	// 按模板生成的子目录在接受后才创建
+	free, err := fsutil.FreeSpace(existingDir(savePath))
+	if err != nil {
+		slog.Warn("Failed to get free disk space", "path", savePath, "error", err)
+		return ""
+	}
+	if uint64(max(task.FileSize, 0)) > free { //nolint:gosec
+		return fmt.Sprintf(
+			"Not enough disk space on receiver: %s required, %s available",
+			formatBytes(task.FileSize),
+			formatBytes(int64(free)), //nolint:gosec
+		)
+	}
+	return ""
+}
+
+// inFlightReceiveBytes 返回已接受但尚未完成的接收任务大小
+func (s *Service) inFlightReceiveBytes() int64 {
+	var n int64
+	s.transfers.Range(func(key, value any) bool {
+		t := value.(*Transfer).Snapshot()
+		if t.Type == TransferTypeReceive &&
+			(t.Status == TransferStatusAccepted || t.Status == TransferStatusActive) {
+			n += t.FileSize
+		}
+		return true
+	})
+	return n
+}
+
+// formatBytes 将字节数格式化为便于阅读的字符串
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -2,7 +2,9 @@ package transfer
 
 import (
 	"context"
+	"errors"
 	"io"
+	"sync/atomic"
 )
 
 // ContextReader 带有 Context 的 Reader
@@ -19,3 +21,39 @@ func (cr *ContextReader) Read(p []byte) (n int, err error) {
 		return cr.r.Read(p)
 	}
 }
+
+// errSizeLimit 数据流超过接收大小上限
+var errSizeLimit = errors.New("stream exceeds the receiver's size limit")
+
+// errSizeMismatch 收到的数据量与请求中声明的大小不一致
+var errSizeMismatch = errors.New("received size does not match the declared size")
+
+// sizeLimitReader 读取超过 n 字节时返回 err，而不是像 io.LimitReader 那样截断
+// exact 为 true 时，数据在 n 字节之前结束同样返回 err
+type sizeLimitReader struct {
+	r     io.Reader
+	n     int64
+	exact bool
+	err   error
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 || (l.exact && err == io.EOF && l.n > 0) {
+		return n, l.err
+	}
+	return n, err
+}
+
+// countReader 记录已读取的字节数，可以在其他 goroutine 读取时获取
+type countReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
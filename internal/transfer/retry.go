@@ -0,0 +1,161 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"mesh-drop/internal/discovery"
+)
+
+// errMsgReceiverOffline 接收端在请求过程中断开连接 (io.EOF)
+const errMsgReceiverOffline = "Receiver went offline"
+
+// retryPeerPollInterval 等待节点重新上线时查询发现服务的间隔
+const retryPeerPollInterval = time.Second
+
+// setAskError 根据 ask 返回的错误更新任务状态
+func setAskError(task *Transfer, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		task.transition(TransferStatusCanceled, "")
+	case errors.Is(err, io.EOF):
+		// 接收方离线
+		task.transition(TransferStatusCanceled, errMsgReceiverOffline)
+	default:
+		// 如果请求发送失败，更新状态为 Error
+		task.transition(
+			TransferStatusError,
+			fmt.Sprintf("Failed to connect to receiver: %v", err),
+		)
+	}
+}
+
+// shouldRetry 判断一次失败的发送是否值得重试
+// 用户取消、接收端拒绝或主动取消时不重试，网络错误与接收端离线时重试
+func shouldRetry(ctx context.Context, task *Transfer) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	status, msg := task.state()
+	switch status {
+	case TransferStatusCompleted, TransferStatusRejected:
+		return false
+	case TransferStatusCanceled:
+		return msg == errMsgReceiverOffline
+	default:
+		// Error，或传输中途异常结束
+		return true
+	}
+}
+
+// retryDelay 返回第 attempt 次失败后的等待时间
+func (s *Service) retryDelay(attempt int) time.Duration {
+	policy := s.config.GetRetryPolicy()
+	delay := time.Duration(max(policy.InitialDelay, 1)) * time.Second
+	maxDelay := time.Duration(max(policy.MaxDelay, 1)) * time.Second
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+// sendWithRetry 执行一次发送 attempt，失败时按重试策略退避，
+// 并等待节点重新出现在发现服务中后再次发送
+// 每次重试都会重新 ask，接收端可以再次选择增量传输或本地去重
+func (s *Service) sendWithRetry(
+	ctx context.Context,
+	task *Transfer,
+	target *discovery.Peer,
+	targetIP string,
+	attempt func(target *discovery.Peer, targetIP string),
+) {
+	maxAttempts := max(s.config.GetRetryPolicy().MaxAttempts, 1)
+	for {
+		var attempts int
+		task.update(func() {
+			task.Attempt++
+			task.NextRetryTime = 0
+			attempts = task.Attempt
+		})
+		attempt(target, targetIP)
+
+		if attempts >= maxAttempts || !shouldRetry(ctx, task) {
+			return
+		}
+
+		delay := s.retryDelay(attempts)
+		_, errMsg := task.state()
+		// 失败后已被取消或完成时不再重试
+		if !task.transition(TransferStatusRetrying, errMsg) {
+			return
+		}
+		slog.Info(
+			"Send failed, will retry",
+			"id",
+			task.ID,
+			"attempt",
+			attempts,
+			"delay",
+			delay,
+			"error",
+			errMsg,
+			"component",
+			"transfer-client",
+		)
+		task.update(func() { task.NextRetryTime = time.Now().Add(delay).UnixMilli() })
+		s.NotifyTransferListUpdate()
+
+		peer, ip, ok := s.waitForPeer(ctx, target.ID, targetIP, delay)
+		if !ok {
+			// 等待期间用户取消
+			task.transition(TransferStatusCanceled, "")
+			task.update(func() { task.NextRetryTime = 0 })
+			return
+		}
+		target, targetIP = peer, ip
+		task.update(func() { task.Progress = Progress{} })
+		if !task.transition(TransferStatusPending, "") {
+			return
+		}
+		s.NotifyTransferListUpdate()
+	}
+}
+
+// waitForPeer 等待 delay 后，再等待节点出现在发现服务中
+// 原 IP 仍然可达时继续使用，否则使用最近响应的 IP
+func (s *Service) waitForPeer(
+	ctx context.Context,
+	peerID string,
+	lastIP string,
+	delay time.Duration,
+) (*discovery.Peer, string, bool) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, "", false
+	case <-timer.C:
+	}
+
+	ticker := time.NewTicker(retryPeerPollInterval)
+	defer ticker.Stop()
+	for {
+		if peer, ok := s.discoveryService.GetPeerByID(peerID); ok {
+			if _, ok := peer.Routes[lastIP]; ok {
+				return peer, lastIP, true
+			}
+			if ip, ok := latestRouteIP(peer); ok {
+				return peer, ip, true
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, "", false
+		case <-ticker.C:
+		}
+	}
+}
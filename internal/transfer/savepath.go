@@ -0,0 +1,214 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"mesh-drop/internal/discovery"
+)
+
+// 保存目录
+//
+// 接收内容保存到 SavePath 下按模板生成的子目录，受信任节点可以单独设置 SavePath 与模板。
+// 模板以 / 分隔目录，每一级可以包含以下变量：
+//
+//	{peer}       发送节点名称
+//	{peer_id}    发送节点 ID
+//	{type}       内容类型，如 file、folder、image
+//	{yyyy} {mm} {dd} {yyyy-mm} {yyyy-mm-dd}  接收日期
+//
+// 变量的值中的路径分隔符等字符会被替换，展开后的路径总是位于 SavePath 内。
+
+// saveTemplateVars 返回模板变量的值
+func saveTemplateVars(task *Transfer, now time.Time) map[string]string {
+	return map[string]string{
+		"peer":       task.Sender.Name,
+		"peer_id":    task.Sender.ID,
+		"type":       string(task.ContentType),
+		"yyyy":       now.Format("2006"),
+		"mm":         now.Format("01"),
+		"dd":         now.Format("02"),
+		"yyyy-mm":    now.Format("2006-01"),
+		"yyyy-mm-dd": now.Format(time.DateOnly),
+	}
+}
+
+// expandSaveTemplate 展开模板，返回相对于 SavePath 的子目录
+func expandSaveTemplate(template string, task *Transfer, now time.Time) (string, error) {
+	template = strings.TrimSpace(template)
+	if template == "" {
+		return "", nil
+	}
+	if strings.HasPrefix(template, "/") || filepath.IsAbs(template) {
+		return "", errors.New("template must be a relative path")
+	}
+	vars := saveTemplateVars(task, now)
+	var parts []string
+	for segment := range strings.SplitSeq(template, "/") {
+		var b strings.Builder
+		rest := segment
+		for {
+			start := strings.IndexByte(rest, '{')
+			if start < 0 {
+				b.WriteString(rest)
+				break
+			}
+			end := strings.IndexByte(rest[start:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unclosed variable in %q", segment)
+			}
+			name := rest[start+1 : start+end]
+			value, ok := vars[name]
+			if !ok {
+				return "", fmt.Errorf("unknown variable {%s}", name)
+			}
+			b.WriteString(rest[:start])
+			b.WriteString(sanitizePathElement(value))
+			rest = rest[start+end+1:]
+		}
+		part := b.String()
+		if part == "" {
+			continue
+		}
+		if part == "." || part == ".." || strings.ContainsAny(part, `\:`) {
+			return "", fmt.Errorf("invalid directory name %q", part)
+		}
+		parts = append(parts, part)
+	}
+	dir := filepath.Join(parts...)
+	if dir != "" && !filepath.IsLocal(dir) {
+		return "", fmt.Errorf("invalid template %q", template)
+	}
+	return dir, nil
+}
+
+// sanitizePathElement 将变量的值转换为可用作单级目录的名称
+func sanitizePathElement(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, value)
+	// Windows 不允许以空格或点结尾
+	value = strings.TrimRight(strings.TrimSpace(value), ". ")
+	if value == "" {
+		return "unknown"
+	}
+	if windowsReservedName(value) {
+		return "_" + value
+	}
+	return value
+}
+
+// windowsReservedName 判断 name 是否为 Windows 的保留设备名，带扩展名时同样保留，如 "NUL.txt"
+func windowsReservedName(name string) bool {
+	base, _, _ := strings.Cut(name, ".")
+	base = strings.ToUpper(strings.TrimRight(base, " "))
+	switch base {
+	case "CON", "PRN", "AUX", "NUL", "CONIN$", "CONOUT$":
+		return true
+	}
+	if len(base) == 4 && (strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) {
+		return base[3] >= '0' && base[3] <= '9'
+	}
+	// 上标数字 ¹²³ 同样保留
+	if strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT") {
+		switch base[3:] {
+		case "¹", "²", "³":
+			return true
+		}
+	}
+	return false
+}
+
+// validateSaveTemplate 检查模板能否展开
+func validateSaveTemplate(template string) error {
+	task := &Transfer{transferData: transferData{
+		Sender:      discovery.Peer{ID: "id", Name: "peer"},
+		ContentType: ContentTypeFile,
+	}}
+	_, err := expandSaveTemplate(template, task, time.Now())
+	return err
+}
+
+// SetSaveTemplate 校验并设置全局子目录模板
+func (s *Service) SetSaveTemplate(template string) error {
+	if err := validateSaveTemplate(template); err != nil {
+		return err
+	}
+	s.config.SetSaveTemplate(strings.TrimSpace(template))
+	return nil
+}
+
+// SetPeerSavePath 设置受信任节点的保存目录与子目录模板，为空时使用全局设置
+func (s *Service) SetPeerSavePath(peerID, savePath, template string) error {
+	if !s.config.IsTrusted(peerID) {
+		return errors.New("peer is not trusted")
+	}
+	if savePath != "" && !filepath.IsAbs(savePath) {
+		return errors.New("save path must be absolute")
+	}
+	if err := validateSaveTemplate(template); err != nil {
+		return err
+	}
+	settings, _ := s.config.GetPeerSettings(peerID)
+	settings.SavePath = savePath
+	settings.SaveTemplate = strings.TrimSpace(template)
+	s.config.SetPeerSettings(peerID, settings)
+	return nil
+}
+
+// receiveDir 计算任务的默认保存目录
+// 优先级: 受信任节点的单独设置 > 全局设置，模板无效时直接保存到 SavePath
+func (s *Service) receiveDir(task *Transfer) string {
+	base := s.config.GetSavePath()
+	template := s.config.GetSaveTemplate()
+	if settings, ok := s.peerSettingsFor(task.Sender); ok {
+		if settings.SavePath != "" {
+			base = settings.SavePath
+		}
+		if settings.SaveTemplate != "" {
+			template = settings.SaveTemplate
+		}
+	}
+	sub, err := expandSaveTemplate(template, task, time.Now())
+	if err != nil {
+		slog.Warn(
+			"Invalid save template",
+			"template",
+			template,
+			"error",
+			err,
+			"component",
+			"transfer",
+		)
+		return base
+	}
+	return filepath.Join(base, sub)
+}
+
+// validFileName 检查发送端提供的文件名是单级名称，防止写到保存目录之外
+func validFileName(name string) bool {
+	return name != "" && filepath.IsLocal(name) && filepath.Base(name) == name &&
+		!strings.ContainsAny(name, `/\`)
+}
+
+// existingDir 返回 dir 自身或最近的已存在的上级目录，用于在子目录创建前检查磁盘空间
+func existingDir(dir string) string {
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
@@ -1,21 +1,25 @@
 package transfer
 
 import (
-	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"github.com/wailsapp/wails/v3/pkg/services/notifications"
+	"mesh-drop/internal/audit"
+	"mesh-drop/internal/config"
+	"mesh-drop/internal/platform"
 )
 
 // handleAsk 处理接收文件请求
@@ -31,38 +35,133 @@ func (s *Service) handleAsk(c *gin.Context) {
 		return
 	}
 
-	// 检查是否已经存在
-	if _, exists := s.transfers.Load(task.ID); exists {
-		// 如果已经存在，说明是网络重试，直接忽略
+	// 发送端的身份以请求签名为准，请求体中的节点 ID 必须一致
+	if task.Sender.ID != c.GetString(contextKeyPeerID) {
+		c.JSON(http.StatusForbidden, TransferAskResponse{
+			ID:      task.ID,
+			Message: "Sender does not match request signature",
+		})
 		return
 	}
 
+	// 检查是否已经存在
+	if val, exists := s.transfers.Load(task.ID); exists {
+		existing := val.(*Transfer).Snapshot()
+		// 只有同一发送端发来的接收任务才可能是重试，其他 ID 冲突一律拒绝，不替换已有任务
+		if existing.Type != TransferTypeReceive || existing.Sender.ID != task.Sender.ID {
+			c.JSON(http.StatusConflict, TransferAskResponse{
+				ID:      task.ID,
+				Message: "Transfer ID already exists",
+			})
+			return
+		}
+		// 仍在进行中，说明是网络重复请求，直接忽略
+		// 已经结束的任务是发送端的自动重试，重新处理
+		switch existing.Status {
+		case TransferStatusPending, TransferStatusAccepted, TransferStatusActive:
+			return
+		}
+	}
+
 	// 存储请求
 	task.Type = TransferTypeReceive
 	task.Status = TransferStatusPending
+	task.Transitions = []StatusChange{{Status: TransferStatusPending, Time: time.Now().UnixMilli()}}
 	task.DecisionChan = make(chan Decision, 1)
 	s.StoreTransferToList(&task)
 
-	// 从本地获取 peer 检查是否 mismatch
+	// 密钥不匹配只由本地发现服务判断，忽略请求体中的值
 	peer, ok := s.discoveryService.GetPeerByID(task.Sender.ID)
-	if ok {
-		task.Sender.TrustMismatch = peer.TrustMismatch
+	task.update(func() { task.Sender.TrustMismatch = ok && peer.TrustMismatch })
+
+	// 检查大小上限与每日配额
+	if msg := s.checkReceiveLimits(&task); msg != "" {
+		slog.Info("Transfer rejected by limits", "id", task.ID, "reason", msg)
+		rejectAsk(c, &task, msg)
+		return
+	}
+
+	// 检查各内容类型在握手中携带的数据
+	if msg := s.checkContentAsk(&task); msg != "" {
+		slog.Info("Transfer rejected by content check", "id", task.ID, "reason", msg)
+		rejectAsk(c, &task, msg)
+		return
+	}
+
+	// 命令行接收数据流时拒绝其他请求
+	if msg := s.checkSinkAsk(&task); msg != "" {
+		slog.Info("Transfer rejected by stream receiver", "id", task.ID, "reason", msg)
+		rejectAsk(c, &task, msg)
+		return
+	}
+	// 占用 sink 的请求在握手阶段结束时通知调用方，接受后等待上传
+	if task.sink != nil {
+		defer func() {
+			if task.status() == TransferStatusAccepted {
+				task.sink.waitUpload(&task)
+			} else {
+				task.sink.finish(&task)
+			}
+		}()
+	}
+
+	// 按接收规则决定自动接收、拒绝或询问，没有规则匹配时沿用 AutoAccept
+	// 写入 sink 的数据流已由调用方决定接收，不经过规则
+	savePath := s.receiveDir(&task)
+	autoAccept := s.config.GetAutoAccept() ||
+		(s.config.IsTrusted(task.Sender.ID) && !task.Sender.TrustMismatch)
+	task.update(func() {
+		task.MatchedRule = ""
+		task.MatchedRuleName = ""
+	})
+	if task.sink == nil {
+		localAddr, _ := c.Request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		peerID := c.GetString(contextKeyPeerID)
+		if rule, ok := s.matchAcceptRule(&task, peerID, localAddr); ok {
+			task.update(func() {
+				task.MatchedRule = rule.ID
+				task.MatchedRuleName = rule.Name
+			})
+			autoAccept = rule.Action == config.AcceptActionAccept
+			if autoAccept && rule.SavePath != "" {
+				savePath = rule.SavePath
+			}
+			if rule.Action == config.AcceptActionReject {
+				msg := rule.Message
+				if msg == "" {
+					msg = ruleRejectMessage
+				}
+				slog.Info("Transfer rejected by rule", "id", task.ID, "rule", rule.ID)
+				rejectAsk(c, &task, msg)
+				return
+			}
+		}
+	}
+
+	// 检查保存路径下是否已存在同名内容
+	policy := s.conflictPolicyFor(task.Sender)
+	if isFileContent(task.ContentType) || task.ContentType == ContentTypeFolder {
+		_, err := os.Lstat(filepath.Join(savePath, task.FileName))
+		task.update(func() { task.Conflict = err == nil })
 	}
 
-	if s.config.GetAutoAccept() ||
-		(s.config.IsTrusted(task.Sender.ID) && !task.Sender.TrustMismatch) {
+	// 磁盘空间不足时交由用户决定，用户可以选择其他保存路径
+	if autoAccept && s.checkDiskSpace(&task, savePath) != "" {
+		autoAccept = false
+	}
+	// 冲突策略为 ask 且存在冲突时，即使自动接收也需要用户决定
+	askConflict := task.Conflict && policy == config.ConflictPolicyAsk
+	if task.sink != nil || (autoAccept && !askConflict) {
 		task.DecisionChan <- Decision{
 			ID:       task.ID,
 			Accepted: true,
-			SavePath: s.config.GetSavePath(),
+			SavePath: savePath,
 		}
 	} else {
-		// 发送系统通知
-		_ = s.notifier.SendNotification(notifications.NotificationOptions{
-			ID:    uuid.New().String(),
-			Title: "File Transfer Request",
-			Body:  fmt.Sprintf("%s wants to transfer %s", task.Sender.Name, task.FileName),
-		})
+		// 发送系统通知，链接与图片附带标题和缩略图
+		if s.notifier != nil {
+			_ = s.notifier.SendNotification(askNotification(&task))
+		}
 	}
 
 	// 等待用户决策或发送端放弃
@@ -70,42 +169,336 @@ func (s *Service) handleAsk(c *gin.Context) {
 	case decision := <-task.DecisionChan:
 		// 用户决策
 		if decision.Accepted {
-			task.Status = TransferStatusAccepted
-			task.SavePath = decision.SavePath
-			token := uuid.New().String()
-			task.Token = token
-			c.JSON(http.StatusOK, TransferAskResponse{
-				ID:       task.ID,
-				Accepted: decision.Accepted,
-				Token:    task.Token,
-			})
+			// 用户未选择保存路径时按节点设置与模板计算
+			savePath := decision.SavePath
+			if savePath == "" {
+				savePath = s.receiveDir(&task)
+			}
+			task.update(func() { task.SavePath = savePath })
+			// 检查所选保存路径的可用空间
+			if msg := s.checkDiskSpace(&task, savePath); msg != "" {
+				slog.Info("Transfer rejected by disk space", "id", task.ID, "reason", msg)
+				rejectAsk(c, &task, msg)
+				return
+			}
+			// 通过检查后才创建保存路径，被拒绝的请求不会留下空目录
+			if isFileContent(task.ContentType) || task.ContentType == ContentTypeFolder {
+				if err := os.MkdirAll(savePath, 0o750); err != nil {
+					slog.Error("Failed to create save path", "path", savePath, "error", err)
+				}
+			}
+
+			if decision.ConflictPolicy != "" {
+				policy = decision.ConflictPolicy
+			}
+			// 跳过会告诉发送端接收端是否已有相同文件，只对受信任节点使用
+			if policy == config.ConflictPolicySkip && isFileContent(task.ContentType) &&
+				!s.isTrusted(task.Sender) {
+				policy = config.ConflictPolicyRename
+			}
+			task.update(func() { task.ConflictPolicy = policy })
+
+			// 链接不需要上传，接受即完成
+			if task.ContentType == ContentTypeURL {
+				task.complete()
+				s.onReceiveCompleted(&task)
+				c.JSON(http.StatusOK, TransferAskResponse{
+					ID:       task.ID,
+					Accepted: true,
+				})
+				return
+			}
+
+			// 跳过、去重与增量传输需要文件哈希，发送端只在接收端要求时计算
+			if task.FileHash == "" && s.needsHash(&task, savePath) {
+				token := uuid.New().String()
+				task.update(func() { task.Token = token })
+				task.transition(TransferStatusAccepted, "")
+				c.JSON(http.StatusOK, TransferAskResponse{
+					ID:           task.ID,
+					Accepted:     true,
+					Token:        token,
+					HashRequired: true,
+				})
+				return
+			}
+			c.JSON(http.StatusOK, s.prepareUpload(c.Request.Context(), &task, savePath))
 		} else {
-			task.Status = TransferStatusRejected
+			task.transition(TransferStatusRejected, "")
 			c.JSON(http.StatusOK, TransferAskResponse{
 				ID:       task.ID,
 				Accepted: false,
 				Message:  "Transfer rejected",
 			})
+			auditRejectedAsk(c, &task, "Rejected by user")
 		}
 	case <-c.Request.Context().Done():
 		// 发送端放弃
-		task.Status = TransferStatusCanceled
+		task.transition(TransferStatusCanceled, "")
+	}
+}
+
+// needsHash 判断接收端是否需要文件哈希来跳过、去重或增量传输
+func (s *Service) needsHash(task *Transfer, savePath string) bool {
+	if task.sink != nil || !isFileContent(task.ContentType) || task.FileSize <= 0 {
+		return false
+	}
+	if s.dedupModeFor(task.Sender) != config.DedupModeOff {
+		return true
+	}
+	info, err := os.Lstat(filepath.Join(savePath, task.FileName))
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	if task.ConflictPolicy == config.ConflictPolicySkip && info.Size() == task.FileSize {
+		return true
 	}
+	return task.Delta && s.isTrusted(task.Sender) &&
+		info.Size() > 0 && info.Size() <= deltaMaxBasisSize
+}
+
+// prepareUpload 已有相同文件时跳过上传，否则生成上传凭证
+// 写入 sink 的数据流不保存到 savePath，不跳过也不使用增量传输
+func (s *Service) prepareUpload(
+	ctx context.Context,
+	task *Transfer,
+	savePath string,
+) TransferAskResponse {
+	// 已存在相同文件时无需上传
+	if task.sink == nil && isFileContent(task.ContentType) &&
+		task.ConflictPolicy == config.ConflictPolicySkip {
+		_, skip := resolveFileDest(
+			ctx,
+			savePath,
+			task.FileName,
+			task.ConflictPolicy,
+			task.FileSize,
+			task.FileHash,
+		)
+		if skip {
+			task.update(func() { task.Skipped = true })
+			task.complete()
+			return TransferAskResponse{
+				ID:       task.ID,
+				Accepted: true,
+				Skipped:  true,
+			}
+		}
+	}
+
+	// 本地已有相同内容的文件时直接生成
+	if task.sink == nil && isFileContent(task.ContentType) && s.dedupFile(ctx, task, savePath) {
+		return TransferAskResponse{
+			ID:           task.ID,
+			Accepted:     true,
+			Skipped:      true,
+			Deduplicated: true,
+		}
+	}
+
+	// 目标路径已有旧版本时使用增量传输
+	var delta *DeltaSignature
+	if task.Delta && task.sink == nil {
+		delta = s.prepareDelta(ctx, task, savePath)
+	}
+
+	// 提交哈希前已经生成了凭证
+	token := task.Snapshot().Token
+	if token == "" {
+		token = uuid.New().String()
+		task.update(func() { task.Token = token })
+	}
+	task.transition(TransferStatusAccepted, "")
+	return TransferAskResponse{
+		ID:       task.ID,
+		Accepted: true,
+		Token:    token,
+		Delta:    delta,
+	}
+}
+
+// rejectAsk 拒绝传输请求并回复原因
+func rejectAsk(c *gin.Context, task *Transfer, msg string) {
+	task.transition(TransferStatusRejected, msg)
+	c.JSON(http.StatusOK, TransferAskResponse{
+		ID:       task.ID,
+		Accepted: false,
+		Message:  msg,
+	})
+	auditRejectedAsk(c, task, msg)
+}
+
+// auditRejectedAsk 将被拒绝的传输请求写入审计日志
+func auditRejectedAsk(c *gin.Context, task *Transfer, reason string) {
+	details := map[string]string{
+		"transfer_id":  task.ID,
+		"content_type": string(task.ContentType),
+		"file_name":    task.FileName,
+	}
+	if task.MatchedRule != "" {
+		details["rule"] = task.MatchedRule
+	}
+	audit.Record(audit.Event{
+		Kind:     audit.KindAskRejected,
+		PeerID:   task.Sender.ID,
+		PeerName: task.Sender.Name,
+		IP:       c.ClientIP(),
+		Message:  reason,
+		Details:  details,
+	})
+}
+
+// textMaxSize 接收文本的大小上限
+const textMaxSize = 16 << 20
+
+// checkContentAsk 检查请求携带的内容数据，返回不为空时拒绝
+func (s *Service) checkContentAsk(task *Transfer) string {
+	if (isFileContent(task.ContentType) || task.ContentType == ContentTypeFolder) &&
+		!validFileName(task.FileName) {
+		return "Invalid file name"
+	}
+	switch task.ContentType {
+	case ContentTypeText:
+		// 文本在内存中接收
+		if task.FileSize > textMaxSize {
+			return "Text too large"
+		}
+	case ContentTypeClipboard:
+		return s.checkClipboardAsk(task)
+	case ContentTypeURL:
+		if _, err := parseLinkURL(task.URL); err != nil {
+			return "Invalid link"
+		}
+		task.update(func() { task.LinkTitle = truncateRunes(task.LinkTitle, linkTitleMaxLen) })
+	case ContentTypeImage:
+		// 缩略图只用于预览，不合法时忽略
+		if !validThumbnail(task.Thumbnail) {
+			task.update(func() { task.Thumbnail = "" })
+		}
+	}
+	return ""
+}
+
+// askNotification 生成传输请求的系统通知
+func askNotification(task *Transfer) platform.Notification {
+	opts := platform.Notification{
+		ID:    uuid.New().String(),
+		Title: "File Transfer Request",
+		Body:  fmt.Sprintf("%s wants to transfer %s", task.Sender.Name, task.FileName),
+		Data:  map[string]any{"transfer_id": task.ID},
+	}
+	switch task.ContentType {
+	case ContentTypeClipboard:
+		opts.Body = fmt.Sprintf("%s wants to share clipboard content", task.Sender.Name)
+	case ContentTypeURL:
+		title := task.LinkTitle
+		if title == "" {
+			title = task.URL
+		}
+		opts.Body = fmt.Sprintf("%s wants to share a link: %s", task.Sender.Name, title)
+		opts.Subtitle = task.URL
+		opts.Data["url"] = task.URL
+		opts.Data["link_title"] = task.LinkTitle
+	case ContentTypeImage:
+		opts.Body = fmt.Sprintf(
+			"%s wants to send image %s (%dx%d)",
+			task.Sender.Name,
+			task.FileName,
+			task.ImageWidth,
+			task.ImageHeight,
+		)
+		if task.Thumbnail != "" {
+			opts.Data["thumbnail"] = task.Thumbnail
+		}
+	}
+	return opts
 }
 
 // ResolvePendingRequest 外部调用，解决待处理的传输请求
 // 返回 true 表示成功处理，false 表示未找到该 ID 的请求
 func (s *Service) ResolvePendingRequest(id string, accept bool, savePath string) bool {
-	task, ok := s.GetTransfer(id)
-	if !ok {
-		return false
-	}
-	task.DecisionChan <- Decision{
+	return s.ResolvePendingDecision(Decision{
 		ID:       id,
 		Accepted: accept,
 		SavePath: savePath,
+	})
+}
+
+// ResolvePendingDecision 与 ResolvePendingRequest 相同，但可以指定本次的冲突策略
+func (s *Service) ResolvePendingDecision(decision Decision) bool {
+	task, ok := s.loadTransfer(decision.ID)
+	if !ok || task.DecisionChan == nil || task.status() != TransferStatusPending {
+		return false
+	}
+	// 已经做出决策时不再阻塞
+	select {
+	case task.DecisionChan <- decision:
+		return true
+	default:
+		return false
 	}
-	return true
+}
+
+// handleHash 接收端要求时发送端提交文件哈希，回复与 ask 相同
+func (s *Service) handleHash(c *gin.Context) {
+	id := c.Param("id")
+	token := c.Query("token")
+
+	task, ok := s.loadTransfer(id)
+	if !ok || token == "" {
+		c.JSON(http.StatusUnauthorized, TransferAskResponse{
+			ID:      id,
+			Message: "Invalid request: task not found",
+		})
+		return
+	}
+	// 凭证只能由发起请求的节点使用
+	if task.Snapshot().Token != token || task.Sender.ID != c.GetString(contextKeyPeerID) {
+		audit.Record(audit.Event{
+			Kind:     audit.KindTokenMismatch,
+			PeerID:   task.Sender.ID,
+			PeerName: task.Sender.Name,
+			IP:       c.ClientIP(),
+			Message:  "Hash token mismatch",
+			Details:  map[string]string{"transfer_id": task.ID},
+		})
+		c.JSON(http.StatusUnauthorized, TransferAskResponse{
+			ID:      id,
+			Message: "Token mismatch",
+		})
+		return
+	}
+
+	var req TransferHashRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !validFileHash(req.FileHash) {
+		c.JSON(http.StatusBadRequest, TransferAskResponse{
+			ID:      id,
+			Message: "Invalid file hash",
+		})
+		return
+	}
+
+	// 每个任务只接受一次哈希
+	var set bool
+	task.update(func() {
+		if task.Status == TransferStatusAccepted && task.FileHash == "" {
+			task.FileHash = req.FileHash
+			set = true
+		}
+	})
+	if !set {
+		c.JSON(http.StatusForbidden, TransferAskResponse{
+			ID:      id,
+			Message: "Invalid task status",
+		})
+		return
+	}
+
+	savePath := task.Snapshot().SavePath
+	if savePath == "" {
+		savePath = s.receiveDir(task)
+	}
+	c.JSON(http.StatusOK, s.prepareUpload(c.Request.Context(), task, savePath))
 }
 
 // handleUpload 处理接收文件请求
@@ -124,7 +517,7 @@ func (s *Service) handleUpload(c *gin.Context) {
 	}
 
 	// 获取传输任务
-	task, ok := s.GetTransfer(id)
+	task, ok := s.loadTransfer(id)
 	if !ok {
 		c.JSON(http.StatusUnauthorized, TransferUploadResponse{
 			ID:      id,
@@ -140,8 +533,17 @@ func (s *Service) handleUpload(c *gin.Context) {
 		cancel()
 	}()
 
-	// 校验 token
-	if task.Token != token {
+	// 校验 token，读取快照的同时获得接收请求时写入的字段
+	current := task.Snapshot()
+	if current.Token != token || current.Sender.ID != c.GetString(contextKeyPeerID) {
+		audit.Record(audit.Event{
+			Kind:     audit.KindTokenMismatch,
+			PeerID:   task.Sender.ID,
+			PeerName: task.Sender.Name,
+			IP:       c.ClientIP(),
+			Message:  "Upload token mismatch",
+			Details:  map[string]string{"transfer_id": task.ID},
+		})
 		c.JSON(http.StatusUnauthorized, TransferUploadResponse{
 			ID:      id,
 			Message: "Token mismatch",
@@ -150,8 +552,8 @@ func (s *Service) handleUpload(c *gin.Context) {
 		return
 	}
 
-	// 校验状态
-	if task.Status != TransferStatusAccepted {
+	// 校验状态并更新为 active
+	if !task.transitionFrom(TransferStatusAccepted, TransferStatusActive, "") {
 		c.JSON(http.StatusForbidden, TransferUploadResponse{
 			ID:      id,
 			Message: "Invalid task status",
@@ -160,39 +562,52 @@ func (s *Service) handleUpload(c *gin.Context) {
 		return
 	}
 
-	// 更新状态为 active
-	task.Status = TransferStatusActive
-
 	savePath := task.SavePath
 	if savePath == "" {
-		savePath = s.config.GetSavePath()
+		savePath = s.receiveDir(task)
 	}
 
-	ctxReader := &ContextReader{
-		ctx: ctx,
-		r:   c.Request.Body,
+	// 每日额度按实际收到的字节数计算，传输失败时同样计入
+	body := &countReader{r: c.Request.Body}
+	defer func() { s.quota.add(body.n.Load()) }()
+
+	// 增量上传的大小在还原后检查
+	var ctxReader io.Reader = &ContextReader{ctx: ctx, r: body}
+	delta := c.ContentType() == deltaContentType && task.deltaBasis != ""
+	if !delta {
+		ctxReader = s.limitUpload(task, ctxReader)
+	}
+
+	// 命令行接收的数据流写入调用方提供的 io.Writer
+	if task.sink != nil {
+		s.receive(c, task, Writer{w: task.sink.w, filePath: ""}, ctxReader)
+		task.sink.finish(task)
+		return
 	}
 
 	switch task.ContentType {
-	case ContentTypeFile:
-		destPath := filepath.Join(savePath, task.FileName)
-		// 如果文件已存在则在文件名后追加序号
-		_, err := os.Stat(destPath)
-		counter := 1
-		for err == nil {
-			destPath = filepath.Join(
-				savePath,
-				fmt.Sprintf(
-					"%s (%d)%s",
-					strings.TrimSuffix(task.FileName, filepath.Ext(task.FileName)),
-					counter,
-					filepath.Ext(task.FileName),
-				),
-			)
-			counter++
-			_, err = os.Stat(destPath)
+	case ContentTypeFile, ContentTypeImage, ContentTypeStream:
+		destPath, skip := resolveFileDest(
+			ctx,
+			savePath,
+			task.FileName,
+			task.ConflictPolicy,
+			task.FileSize,
+			task.FileHash,
+		)
+		if skip {
+			// 接收端已有相同文件，丢弃上传内容
+			_, _ = io.Copy(io.Discard, ctxReader)
+			task.update(func() { task.Skipped = true })
+			task.complete()
+			c.JSON(http.StatusOK, TransferUploadResponse{
+				ID:      task.ID,
+				Message: "File already exists",
+				Status:  TransferStatusCompleted,
+			})
+			return
 		}
-		file, err := os.Create(destPath)
+		file, err := createPartFile(s.partials, destPath, task.ID)
 		if err != nil {
 			// 接收方无法创建文件，直接报错，任务结束
 			c.JSON(http.StatusInternalServerError, TransferUploadResponse{
@@ -201,18 +616,30 @@ func (s *Service) handleUpload(c *gin.Context) {
 				Status:  TransferStatusError,
 			})
 			slog.Error("Failed to create file", "error", err, "component", "transfer")
-			task.Status = TransferStatusError
-			task.ErrorMsg = fmt.Errorf("receiver failed to create file: %v", err).Error()
+			task.transition(
+				TransferStatusError,
+				fmt.Errorf("receiver failed to create file: %v", err).Error(),
+			)
 			return
 		}
-		defer file.Close()
-		s.receive(c, task, Writer{w: file, filePath: destPath}, ctxReader)
+		writer := Writer{w: file, filePath: destPath, part: file}
+		if delta {
+			s.receiveDelta(c, task, writer, ctxReader)
+			return
+		}
+		s.receive(c, task, writer, ctxReader)
 	case ContentTypeText:
 		var buf bytes.Buffer
 		s.receive(c, task, Writer{w: &buf, filePath: ""}, ctxReader)
-		task.Text = buf.String()
+		task.update(func() { task.Text = buf.String() })
+	case ContentTypeClipboard:
+		var buf bytes.Buffer
+		s.receive(c, task, Writer{w: &buf, filePath: ""}, ctxReader)
+		if task.status() == TransferStatusCompleted {
+			s.onClipboardReceived(task, buf.Bytes())
+		}
 	case ContentTypeFolder:
-		s.receiveFolder(c, savePath, task, ctxReader)
+		s.receiveFolder(ctx, c, savePath, task, ctxReader)
 	}
 }
 
@@ -222,18 +649,22 @@ func (s *Service) receive(c *gin.Context, task *Transfer, writer Writer, ctxRead
 		Reader: ctxReader,
 		total:  task.FileSize,
 		callback: func(current, total int64, speed float64) {
-			task.Progress = Progress{
+			task.setProgress(Progress{
 				Current: current,
 				Total:   total,
 				Speed:   speed,
-			}
-			task.Status = TransferStatusActive
+			})
 			s.NotifyTransferListUpdate()
 		},
 	}
 
-	_, err := io.Copy(writer, reader)
+	// 对实际收到的内容计算哈希，用于本地去重索引
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(writer, hasher), reader)
 	if err != nil {
+		// 删除临时文件
+		writer.Abort()
+
 		// 发送端断线，任务取消
 		if c.Request.Context().Err() != nil {
 			slog.Info(
@@ -243,16 +674,14 @@ func (s *Service) receive(c *gin.Context, task *Transfer, writer Writer, ctxRead
 				"raw_err",
 				err,
 			)
-			task.ErrorMsg = "Sender disconnected"
-			task.Status = TransferStatusCanceled
+			task.transition(TransferStatusCanceled, "Sender disconnected")
 			return
 		}
 
 		// 用户取消传输
 		if errors.Is(err, context.Canceled) {
 			slog.Info("User canceled transfer", "component", "transfer")
-			task.ErrorMsg = "User canceled transfer"
-			task.Status = TransferStatusCanceled
+			task.transition(TransferStatusCanceled, errMsgUserCanceled)
 			// 通知发送端
 			c.JSON(http.StatusOK, TransferUploadResponse{
 				ID:      task.ID,
@@ -262,6 +691,18 @@ func (s *Service) receive(c *gin.Context, task *Transfer, writer Writer, ctxRead
 			return
 		}
 
+		// 发送端上传的内容与声明的大小不一致或超过大小上限
+		if errors.Is(err, errSizeMismatch) || errors.Is(err, errSizeLimit) {
+			slog.Warn("Rejected upload", "id", task.ID, "error", err, "component", "transfer")
+			c.JSON(http.StatusBadRequest, TransferUploadResponse{
+				ID:      task.ID,
+				Message: err.Error(),
+				Status:  TransferStatusError,
+			})
+			task.transition(TransferStatusError, err.Error())
+			return
+		}
+
 		// 接收端写文件失败
 		c.JSON(http.StatusInternalServerError, TransferUploadResponse{
 			ID:      task.ID,
@@ -269,26 +710,44 @@ func (s *Service) receive(c *gin.Context, task *Transfer, writer Writer, ctxRead
 			Status:  TransferStatusError,
 		})
 		slog.Error("Failed to write file", "error", err, "component", "transfer")
-		task.Status = TransferStatusError
-		task.ErrorMsg = fmt.Errorf("failed to write file: %v", err).Error()
+		task.transition(TransferStatusError, fmt.Errorf("failed to write file: %v", err).Error())
+		return
+	}
 
-		// 删除文件
-		if task.ContentType == ContentTypeFile && writer.GetFilePath() != "" {
-			_ = os.Remove(writer.GetFilePath())
-		}
+	// 将临时文件移动到最终路径
+	if err := writer.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, TransferUploadResponse{
+			ID:      task.ID,
+			Message: "Failed to save file",
+			Status:  TransferStatusError,
+		})
+		slog.Error("Failed to commit file", "error", err, "component", "transfer")
+		task.transition(TransferStatusError, fmt.Errorf("failed to save file: %v", err).Error())
 		return
 	}
 
+	// 长度未知的数据流在接收完成后记录实际大小
+	task.update(func() {
+		if task.FileSize < 0 {
+			task.FileSize = n
+		}
+		if writer.part != nil {
+			task.FilePath = writer.GetFilePath()
+			task.receivedHash = hex.EncodeToString(hasher.Sum(nil))
+		}
+	})
 	c.JSON(http.StatusOK, TransferUploadResponse{
 		ID:      task.ID,
 		Message: "File received successfully",
 		Status:  TransferStatusCompleted,
 	})
 	// 传输成功，任务结束
-	task.Status = TransferStatusCompleted
+	task.complete()
+	s.onReceiveCompleted(task)
 }
 
 func (s *Service) receiveFolder(
+	ctx context.Context,
 	c *gin.Context,
 	savePath string,
 	task *Transfer,
@@ -296,39 +755,16 @@ func (s *Service) receiveFolder(
 ) {
 	defer s.NotifyTransferListUpdate()
 
-	// 创建根目录
-	destPath := filepath.Join(savePath, task.FileName)
-	// 如果文件已存在则在文件名后追加序号
-	_, err := os.Stat(destPath)
-	counter := 1
-	for err == nil {
-		destPath = filepath.Join(savePath, fmt.Sprintf("%s (%d)", task.FileName, counter))
-		counter++
-		_, err = os.Stat(destPath)
-	}
-	if err := os.MkdirAll(destPath, 0o750); err != nil {
-		c.JSON(http.StatusInternalServerError, TransferUploadResponse{
-			ID:      task.ID,
-			Message: "Receiver failed to create folder",
-			Status:  TransferStatusError,
-		})
-		slog.Error("Failed to create folder", "error", err, "component", "transfer")
-		task.Status = TransferStatusError
-		task.ErrorMsg = fmt.Errorf("receiver failed to create folder: %v", err).Error()
-		return
-	}
-
 	// 包装 reader，用于计算进度
 	reader := &PassThroughReader{
 		Reader: ctxReader,
 		total:  task.FileSize,
 		callback: func(current, total int64, speed float64) {
-			task.Progress = Progress{
+			task.setProgress(Progress{
 				Current: current,
 				Total:   total,
 				Speed:   speed,
-			}
-			task.Status = TransferStatusActive
+			})
 			s.NotifyTransferListUpdate()
 		},
 	}
@@ -345,16 +781,14 @@ func (s *Service) receiveFolder(
 				"stage",
 				stage,
 			)
-			task.Status = TransferStatusCanceled
-			task.ErrorMsg = "Sender disconnected"
+			task.transition(TransferStatusCanceled, "Sender disconnected")
 			// 发送端已断开，无需也不应再发送 c.JSON
 			return true
 		}
 
 		if errors.Is(err, context.Canceled) {
 			slog.Info("Transfer canceled by user", "id", task.ID, "stage", stage)
-			task.Status = TransferStatusCanceled
-			task.ErrorMsg = "User canceled transfer"
+			task.transition(TransferStatusCanceled, errMsgUserCanceled)
 			// 通知发送端（虽然此时连接可能即将关闭，但尽力通知）
 			c.JSON(http.StatusOK, TransferUploadResponse{
 				ID:      task.ID,
@@ -365,8 +799,7 @@ func (s *Service) receiveFolder(
 		}
 
 		slog.Error("Transfer failed", "error", err, "stage", stage)
-		task.Status = TransferStatusError
-		task.ErrorMsg = fmt.Sprintf("Failed at %s: %v", stage, err)
+		task.transition(TransferStatusError, fmt.Sprintf("Failed at %s: %v", stage, err))
 
 		c.JSON(http.StatusInternalServerError, TransferUploadResponse{
 			ID:      task.ID,
@@ -376,78 +809,99 @@ func (s *Service) receiveFolder(
 		return true
 	}
 
-	// 获取绝对路径以防止 Zip Slip (G305)
-	// 必须先转换成绝对路径再判断
-	absDestPath, err := filepath.Abs(destPath)
+	dest, err := s.extractFolder(ctx, savePath, task, reader)
 	if err != nil {
-		handleError(err, "resolve_abs_path")
+		var stageErr *stageError
+		if errors.As(err, &stageErr) {
+			handleError(stageErr.err, stageErr.stage)
+		} else {
+			handleError(err, "extract_folder")
+		}
 		return
 	}
 
-	tr := tar.NewReader(reader)
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if handleError(err, "read_tar_header") {
-			return
-		}
-
-		target := filepath.Join(destPath, filepath.Clean(header.Name))
-		absTarget, err := filepath.Abs(target)
-		if err != nil {
-			slog.Error("Failed to resolve absolute path", "path", target, "error", err)
-			continue
-		}
+	task.update(func() { task.FilePath = dest })
+	c.JSON(http.StatusOK, TransferUploadResponse{
+		ID:      task.ID,
+		Message: "Folder received successfully",
+	})
+	task.complete()
+	s.onReceiveCompleted(task)
+}
 
-		// 确保路径在目标目录内
-		if !strings.HasPrefix(absTarget, absDestPath+string(os.PathSeparator)) {
-			slog.Warn(
-				"Zip Slip attempt detected",
-				"header_name",
-				header.Name,
-				"resolved_path",
-				absTarget,
-			)
-			continue
-		}
+// prepareDelta 计算目标路径已有文件的签名，没有可用的基准文件时返回 nil
+// 签名会暴露已有文件的内容，只回复给受信任的节点
+func (s *Service) prepareDelta(ctx context.Context, task *Transfer, savePath string) *DeltaSignature {
+	task.update(func() { task.Delta = false })
+	if !isFileContent(task.ContentType) || task.FileHash == "" || !s.isTrusted(task.Sender) {
+		return nil
+	}
+	basis := filepath.Join(savePath, task.FileName)
+	info, err := os.Lstat(basis)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 ||
+		info.Size() > deltaMaxBasisSize {
+		return nil
+	}
+	sig, err := computeDeltaSignature(ctx, basis)
+	if err != nil {
+		slog.Warn("Failed to compute delta signature", "path", basis, "error", err)
+		return nil
+	}
+	task.update(func() {
+		task.Delta = true
+		task.deltaBasis = basis
+		task.deltaBlockSize = sig.BlockSize
+	})
+	slog.Info(
+		"Using delta transfer",
+		"id",
+		task.ID,
+		"basis",
+		basis,
+		"blocks",
+		len(sig.Blocks),
+		"component",
+		"transfer",
+	)
+	return sig
+}
 
-		// 使用安全的绝对路径
-		target = absTarget
+// receiveDelta 使用基准文件还原增量上传的内容
+func (s *Service) receiveDelta(c *gin.Context, task *Transfer, writer Writer, ctxReader io.Reader) {
+	basis, err := os.Open(task.deltaBasis)
+	if err != nil {
+		writer.Abort()
+		c.JSON(http.StatusInternalServerError, TransferUploadResponse{
+			ID:      task.ID,
+			Message: "Receiver failed to open delta basis",
+			Status:  TransferStatusError,
+		})
+		task.transition(
+			TransferStatusError,
+			fmt.Errorf("failed to open delta basis: %v", err).Error(),
+		)
+		return
+	}
+	defer basis.Close()
 
-		switch header.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(target, 0o750); err != nil {
-				slog.Error("Failed to create dir", "path", target, "error", err)
-			}
-		case tar.TypeReg:
-			f, err := os.OpenFile(
-				target,
-				os.O_CREATE|os.O_RDWR,
-				os.FileMode(header.Mode),
-			) //nolint:gosec
-			if err != nil {
-				slog.Error("Failed to create file", "path", target, "error", err)
-				continue
-			}
+	// 还原后的内容经由管道交给 receive，进度按还原后的文件大小计算
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(applyDelta(pw, ctxReader, basis, task.deltaBlockSize, task.FileHash))
+	}()
+	s.receive(c, task, writer, s.limitUpload(task, pr))
+}
 
-			// nolint: gosec
-			if _, err := io.Copy(f, tr); err != nil {
-				_ = f.Close()
-				if handleError(err, "write_file_content") {
-					return
-				}
-			}
-			_ = f.Close()
-		}
+// limitUpload 限制上传内容的大小
+// 大小上限、每日额度与磁盘空间都按请求中声明的大小检查，收到的内容必须与声明的大小一致
+// 长度未知的数据流无法在握手时检查大小上限，接收时超过上限即失败
+func (s *Service) limitUpload(task *Transfer, r io.Reader) io.Reader {
+	if task.FileSize >= 0 {
+		return &sizeLimitReader{r: r, n: task.FileSize, exact: true, err: errSizeMismatch}
 	}
-
-	c.JSON(http.StatusOK, TransferUploadResponse{
-		ID:      task.ID,
-		Message: "Folder received successfully",
-	})
-	task.Progress.Total = task.FileSize
-	task.Progress.Current = task.FileSize
-	task.Status = TransferStatusCompleted
+	if limit := s.maxReceiveSize(task.Sender); limit > 0 {
+		return &sizeLimitReader{r: r, n: limit, err: errSizeLimit}
+	}
+	return r
 }
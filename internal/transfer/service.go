@@ -3,6 +3,7 @@ package transfer
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -11,17 +12,20 @@ import (
 	"sync"
 
 	"github.com/gin-gonic/gin"
-	"github.com/wailsapp/wails/v3/pkg/application"
-	"github.com/wailsapp/wails/v3/pkg/services/notifications"
 	"mesh-drop/internal/config"
 	"mesh-drop/internal/discovery"
+	"mesh-drop/internal/platform"
 	"mesh-drop/internal/security"
 )
 
 type Service struct {
-	config   *config.Config
-	notifier *notifications.NotificationService
-	app      *application.App
+	config *config.Config
+	// configDir 状态文件与证书所在的目录
+	configDir string
+	// events、notifier 与 desktop 在命令行模式下为 nil
+	events   platform.EventBus
+	notifier platform.Notifier
+	desktop  platform.Desktop
 	port     int
 
 	// pendingRequests 存储等待用户确认的通道
@@ -35,12 +39,59 @@ type Service struct {
 	cancelMap sync.Map
 
 	httpClient *http.Client
+
+	// partials 记录接收中的临时文件，用于清理崩溃遗留的数据
+	partials *partialJournal
+
+	// quota 记录每日接收量
+	quota *quotaTracker
+
+	// hashIndex 本地文件的内容哈希索引，用于接收去重
+	hashIndex *hashIndex
+
+	// shares 本机发布的共享
+	// Key: ShareID, Value: *Share
+	shares   map[string]*Share
+	sharesMu sync.RWMutex
+
+	// shareValidators 中断的共享下载的 ETag 或 Last-Modified，续传时用于 If-Range
+	// Key: 临时文件路径, Value: string
+	shareValidators sync.Map
+
+	// queue 等待节点上线后发送的离线队列
+	// Key: QueuedSend.ID
+	queue   map[string]*QueuedSend
+	queueMu sync.Mutex
+
+	// syncFolders 正在运行的同步文件夹
+	// Key: SyncFolderID, Value: *syncFolder
+	syncFolders sync.Map
+
+	// outboxes 正在运行的监视文件夹规则
+	// Key: OutboxRuleID, Value: *outbox
+	outboxes sync.Map
+
+	// clipHistory 最近的剪贴板传输
+	clipHistory *clipboardHistory
+	// clipLast 本机剪贴板最近一次已知内容的哈希，避免自动同步把收到的内容再发送回去
+	clipLast string
+	clipMu   sync.Mutex
+
+	// history 传输历史文件
+	history *historyLog
+
+	// sink 命令行接收数据流时写入的目标
+	sink   *receiveSink
+	sinkMu sync.Mutex
 }
 
+// configDir 是状态文件与证书所在的目录，通常为 config.GetConfigDir()
 func NewService(
 	config *config.Config,
-	app *application.App,
-	notifier *notifications.NotificationService,
+	configDir string,
+	events platform.EventBus,
+	notifier platform.Notifier,
+	desktop platform.Desktop,
 	port int,
 	discoveryService *discovery.Service,
 ) *Service {
@@ -55,14 +106,24 @@ func NewService(
 		Timeout:   0,
 	}
 
-	return &Service{
-		app:              app,
+	s := &Service{
+		events:           events,
 		notifier:         notifier,
+		desktop:          desktop,
 		port:             port,
 		discoveryService: discoveryService,
 		config:           config,
+		configDir:        configDir,
 		httpClient:       httpClient,
+		shares:           make(map[string]*Share),
+		queue:            make(map[string]*QueuedSend),
 	}
+	s.partials = newPartialJournal(s.partialJournalPath())
+	s.quota = newQuotaTracker(s.quotaPath())
+	s.hashIndex = newHashIndex(s.hashIndexPath())
+	s.clipHistory = newClipboardHistory(s.clipboardDir())
+	s.history = newHistoryLog(s.historyPath())
+	return s
 }
 
 func (s *Service) GetPort() int {
@@ -70,17 +131,54 @@ func (s *Service) GetPort() int {
 }
 
 func (s *Service) Start() {
+	// 清理上次运行遗留的临时文件
+	s.partials.clean(s.config.GetSavePath())
+	// 启用去重时在后台为尚未扫描过的保存路径建立哈希索引
+	if mode := s.config.GetDedupMode(); mode != "" && mode != config.DedupModeOff {
+		s.hashIndex.scanOnce(context.Background(), s.config.GetSavePath())
+	}
+
+	// 加载共享并定期清理过期的共享
+	s.loadShares()
+	go s.startShareExpiry()
+
+	// 加载离线队列，节点出现时发送
+	s.loadQueue()
+	go s.startQueueExpiry()
+	s.discoveryService.OnPeerSeen(s.deliverQueued)
+
+	s.startSyncFolders()
+	s.startOutboxes()
+	go s.runClipboardSync()
+
+	s.StartServer()
+}
+
+// StartServer 只启动 HTTPS 服务，命令行接收数据流时使用
+func (s *Service) StartServer() {
 	r := gin.Default()
-	transfer := r.Group("/transfer")
+	transfer := r.Group("/transfer", s.requirePeerAuth)
 	{
 		transfer.POST("/ask", s.handleAsk)
+		transfer.POST("/hash/:id", s.handleHash)
 		transfer.PUT("/upload/:id", s.handleUpload)
 	}
+	shares := r.Group("/shares", s.requirePeerAuth)
+	{
+		shares.GET("", s.handleListShares)
+		shares.GET("/:id", s.handleDownloadShare)
+	}
+
+	folderSync := r.Group("/sync", s.requirePeerAuth)
+	{
+		folderSync.GET("/:id/index", s.handleSyncIndex)
+		folderSync.GET("/:id/file", s.handleSyncFile)
+		folderSync.POST("/:id/notify", s.handleSyncNotify)
+	}
 
 	go func() {
-		configDir := config.GetConfigDir()
-		certPath := filepath.Join(configDir, "server.crt")
-		keyPath := filepath.Join(configDir, "server.key")
+		certPath := filepath.Join(s.configDir, "server.crt")
+		keyPath := filepath.Join(s.configDir, "server.key")
 
 		if err := security.EnsureCertificates(certPath, keyPath); err != nil {
 			slog.Error("Failed to generate certificates", "error", err, "component", "transfer")
@@ -96,25 +194,36 @@ func (s *Service) Start() {
 	}()
 }
 
-func (s *Service) GetTransferSyncMap() *sync.Map {
-	return &s.transfers
-}
-
+// GetTransferList 返回所有任务的快照
 func (s *Service) GetTransferList() []*Transfer {
 	requests := make([]*Transfer, 0)
 	s.transfers.Range(func(key, value any) bool {
 		transfer := value.(*Transfer)
-		requests = append(requests, transfer)
+		requests = append(requests, transfer.Snapshot())
 		return true
 	})
-	// 按照创建时间降序排序，方便前端展示
-	sort.Slice(requests, func(i, j int) bool {
-		return requests[i].CreateTime-requests[j].CreateTime > 0
-	})
+	sortByCreateTime(requests)
 	return requests
 }
 
+// sortByCreateTime 按照创建时间降序排序，方便前端展示
+func sortByCreateTime(tasks []*Transfer) {
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].CreateTime-tasks[j].CreateTime > 0
+	})
+}
+
+// GetTransfer 返回任务的快照
 func (s *Service) GetTransfer(transferID string) (*Transfer, bool) {
+	task, ok := s.loadTransfer(transferID)
+	if !ok {
+		return nil, false
+	}
+	return task.Snapshot(), true
+}
+
+// loadTransfer 返回传输列表中的任务本身，修改需通过 transition 或 update
+func (s *Service) loadTransfer(transferID string) (*Transfer, bool) {
 	val, ok := s.transfers.Load(transferID)
 	if !ok {
 		return nil, false
@@ -122,50 +231,103 @@ func (s *Service) GetTransfer(transferID string) (*Transfer, bool) {
 	return val.(*Transfer), true
 }
 
+// errMsgUserCanceled 用户取消任务时的错误信息
+const errMsgUserCanceled = "User canceled transfer"
+
+// CancelTransfer 取消任务，已经结束的任务保持原来的状态
 func (s *Service) CancelTransfer(transferID string) {
 	if cancel, ok := s.cancelMap.Load(transferID); ok {
 		cancel.(context.CancelFunc)()
 		s.cancelMap.Delete(transferID)
-		t, ok := s.GetTransfer(transferID)
-		if ok {
-			t.Status = TransferStatusCanceled
-			s.StoreTransferToList(t)
+		t, ok := s.loadTransfer(transferID)
+		if ok && t.transition(TransferStatusCanceled, errMsgUserCanceled) {
+			s.NotifyTransferListUpdate()
 		}
 	}
 }
 
+// CancelPending 取消所有尚未被接收端处理的请求，退出时调用
+func (s *Service) CancelPending() {
+	s.transfers.Range(func(key, value any) bool {
+		value.(*Transfer).transitionFrom(TransferStatusPending, TransferStatusCanceled, "")
+		return true
+	})
+}
+
 func (s *Service) StoreTransfersToList(transfers []*Transfer) {
 	for _, transfer := range transfers {
+		s.trackChanges(transfer)
 		s.transfers.Store(transfer.ID, transfer)
 	}
 	s.NotifyTransferListUpdate()
 }
 
 func (s *Service) StoreTransferToList(transfer *Transfer) {
+	s.trackChanges(transfer)
 	s.transfers.Store(transfer.ID, transfer)
 	s.NotifyTransferListUpdate()
 }
 
 func (s *Service) NotifyTransferListUpdate() {
-	s.app.Event.Emit("transfer:refreshList")
+	// 命令行模式下没有界面
+	if s.events == nil {
+		return
+	}
+	s.events.Emit("transfer:refreshList")
 }
 
 // CleanTransferList 清理完成的 transfer
 func (s *Service) CleanFinishedTransferList() {
+	var removed []string
 	s.transfers.Range(func(key, value any) bool {
 		task := value.(*Transfer)
-		if task.Status == TransferStatusCompleted ||
-			task.Status == TransferStatusError ||
-			task.Status == TransferStatusCanceled ||
-			task.Status == TransferStatusRejected {
+		if isFinished(task.status()) {
 			s.transfers.Delete(key)
+			removed = append(removed, task.ID)
 		}
 		return true
 	})
+	s.history.remove(removed)
 	s.NotifyTransferListUpdate()
 }
 
+// onReceiveCompleted 在接收任务成功完成后调用
+func (s *Service) onReceiveCompleted(task *Transfer) {
+	if task.ContentType == ContentTypeImage && task.FilePath != "" {
+		checkReceivedImage(task)
+	}
+	if isFileContent(task.ContentType) && task.receivedHash != "" && task.FilePath != "" {
+		s.hashIndex.add(task.receivedHash, task.FilePath)
+	}
+	s.runReceiveHooks(task)
+}
+
+// isTrusted 判断节点是否受信任且密钥与信任时一致
+func (s *Service) isTrusted(peer discovery.Peer) bool {
+	return s.config.IsTrusted(peer.ID) && !peer.TrustMismatch
+}
+
+// OpenReceivedURL 使用默认浏览器打开收到的链接
+func (s *Service) OpenReceivedURL(transferID string) error {
+	task, ok := s.GetTransfer(transferID)
+	if !ok || task.ContentType != ContentTypeURL || task.Type != TransferTypeReceive {
+		return errors.New("link not found")
+	}
+	if task.Status != TransferStatusCompleted {
+		return errors.New("link has not been accepted")
+	}
+	u, err := parseLinkURL(task.URL)
+	if err != nil {
+		return err
+	}
+	if s.desktop == nil {
+		return errors.New("no browser available")
+	}
+	return s.desktop.OpenURL(u.String())
+}
+
 func (s *Service) DeleteTransfer(transferID string) {
 	s.transfers.Delete(transferID)
+	s.history.remove([]string{transferID})
 	s.NotifyTransferListUpdate()
 }
@@ -0,0 +1,505 @@
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"mesh-drop/internal/discovery"
+)
+
+// ShareExpireCheckInterval 检查共享是否过期的间隔
+const ShareExpireCheckInterval = 30 * time.Second
+
+func (s *Service) sharesPath() string {
+	return filepath.Join(s.configDir, "shares.json")
+}
+
+// PublishShare 发布一个文件或文件夹，允许其他节点按需下载
+// expireSeconds 为 0 表示永不过期，allowedPeers 为空表示所有节点都可以下载
+func (s *Service) PublishShare(
+	path string,
+	expireSeconds int64,
+	allowedPeers []string,
+) (*Share, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	share := &Share{
+		ID:           uuid.New().String(),
+		Name:         filepath.Base(path),
+		Path:         path,
+		ContentType:  ContentTypeFile,
+		Size:         info.Size(),
+		CreateTime:   time.Now().UnixMilli(),
+		AllowedPeers: allowedPeers,
+	}
+	if info.IsDir() {
+		share.ContentType = ContentTypeFolder
+		share.Size, err = calculateTarSize(context.Background(), path, s.config.GetFolderFilter())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if expireSeconds > 0 {
+		share.ExpireTime = time.Now().Add(time.Duration(expireSeconds) * time.Second).UnixMilli()
+	}
+
+	s.sharesMu.Lock()
+	s.shares[share.ID] = share
+	s.saveShares()
+	s.sharesMu.Unlock()
+
+	s.storeShareTransfer(share)
+	slog.Info("Share published", "id", share.ID, "path", path, "component", "transfer")
+	return share, nil
+}
+
+// RevokeShare 撤销共享，返回 false 表示共享不存在
+func (s *Service) RevokeShare(id string) bool {
+	return s.removeShare(id, TransferStatusCanceled)
+}
+
+// GetShares 返回本机发布的所有共享
+func (s *Service) GetShares() []Share {
+	s.sharesMu.RLock()
+	defer s.sharesMu.RUnlock()
+	list := make([]Share, 0, len(s.shares))
+	for _, share := range s.shares {
+		list = append(list, *share)
+	}
+	slices.SortFunc(list, func(a, b Share) int {
+		return int(b.CreateTime - a.CreateTime)
+	})
+	return list
+}
+
+// loadShares 加载持久化的共享，并在传输列表中显示
+func (s *Service) loadShares() {
+	data, err := os.ReadFile(s.sharesPath())
+	if err != nil {
+		return
+	}
+	var shares []*Share
+	if err := json.Unmarshal(data, &shares); err != nil {
+		slog.Warn("Failed to parse shares", "error", err, "component", "transfer")
+		return
+	}
+	s.sharesMu.Lock()
+	for _, share := range shares {
+		s.shares[share.ID] = share
+	}
+	s.sharesMu.Unlock()
+
+	for _, share := range shares {
+		s.storeShareTransfer(share)
+	}
+	s.expireShares()
+}
+
+// saveShares 需要在持有 sharesMu 时调用
+func (s *Service) saveShares() {
+	shares := make([]*Share, 0, len(s.shares))
+	for _, share := range s.shares {
+		shares = append(shares, share)
+	}
+	data, err := json.MarshalIndent(shares, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(s.sharesPath(), data, 0o600); err != nil {
+		slog.Error("Failed to save shares", "error", err, "component", "transfer")
+	}
+}
+
+// storeShareTransfer 在传输列表中显示共享，取消该任务即撤销共享
+func (s *Service) storeShareTransfer(share *Share) {
+	task := NewTransfer(
+		share.ID,
+		s.discoveryService.GetSelf(),
+		WithFileName(share.Name),
+		WithFileSize(share.Size),
+		WithSourcePath(share.Path),
+		WithType(TransferTypeShare),
+		WithContentType(share.ContentType),
+		WithStatus(TransferStatusActive),
+	)
+	task.CreateTime = share.CreateTime
+	s.cancelMap.Store(share.ID, context.CancelFunc(func() {
+		s.RevokeShare(share.ID)
+	}))
+	s.StoreTransferToList(task)
+}
+
+// removeShare 删除共享，并将对应的传输任务标记为 status
+func (s *Service) removeShare(id string, status TransferStatus) bool {
+	s.sharesMu.Lock()
+	_, ok := s.shares[id]
+	if ok {
+		delete(s.shares, id)
+		s.saveShares()
+	}
+	s.sharesMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	s.cancelMap.Delete(id)
+	if task, ok := s.loadTransfer(id); ok {
+		task.transition(status, "")
+	}
+	s.NotifyTransferListUpdate()
+	slog.Info("Share removed", "id", id, "status", status, "component", "transfer")
+	return true
+}
+
+// expireShares 删除已过期的共享
+func (s *Service) expireShares() {
+	now := time.Now().UnixMilli()
+	var expired []string
+	s.sharesMu.RLock()
+	for id, share := range s.shares {
+		if share.ExpireTime > 0 && share.ExpireTime <= now {
+			expired = append(expired, id)
+		}
+	}
+	s.sharesMu.RUnlock()
+
+	for _, id := range expired {
+		s.removeShare(id, TransferStatusCompleted)
+	}
+}
+
+func (s *Service) startShareExpiry() {
+	ticker := time.NewTicker(ShareExpireCheckInterval)
+	for range ticker.C {
+		s.expireShares()
+	}
+}
+
+// shareFor 返回 peerID 可以访问的共享
+func (s *Service) shareFor(id, peerID string) (*Share, bool) {
+	s.sharesMu.RLock()
+	defer s.sharesMu.RUnlock()
+	share, ok := s.shares[id]
+	if !ok || !shareVisibleTo(share, peerID) {
+		return nil, false
+	}
+	return share, true
+}
+
+func shareVisibleTo(share *Share, peerID string) bool {
+	if share.ExpireTime > 0 && share.ExpireTime <= time.Now().UnixMilli() {
+		return false
+	}
+	return len(share.AllowedPeers) == 0 || slices.Contains(share.AllowedPeers, peerID)
+}
+
+// handleListShares 返回请求节点可以下载的共享
+func (s *Service) handleListShares(c *gin.Context) {
+	peerID := c.GetString(contextKeyPeerID)
+
+	s.sharesMu.RLock()
+	list := make([]RemoteShare, 0)
+	for _, share := range s.shares {
+		if !shareVisibleTo(share, peerID) {
+			continue
+		}
+		list = append(list, RemoteShare{
+			ID:          share.ID,
+			Name:        share.Name,
+			ContentType: share.ContentType,
+			Size:        share.Size,
+			ExpireTime:  share.ExpireTime,
+		})
+	}
+	s.sharesMu.RUnlock()
+
+	c.JSON(http.StatusOK, list)
+}
+
+// handleDownloadShare 下载共享内容
+// 文件支持 Range 请求，文件夹以 tar 流发送
+func (s *Service) handleDownloadShare(c *gin.Context) {
+	peerID := c.GetString(contextKeyPeerID)
+	share, ok := s.shareFor(c.Param("id"), peerID)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Share not found"})
+		return
+	}
+	slog.Info(
+		"Share download requested",
+		"id",
+		share.ID,
+		"peer",
+		peerID,
+		"range",
+		c.GetHeader("Range"),
+		"component",
+		"transfer",
+	)
+
+	switch share.ContentType {
+	case ContentTypeFile:
+		file, err := os.Open(share.Path)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to open shared file"})
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to open shared file"})
+			return
+		}
+		// 下载端续传时通过 If-Range 带回 ETag，文件已变化时返回完整内容
+		c.Header("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+		http.ServeContent(c.Writer, c.Request, share.Name, info.ModTime(), file)
+	case ContentTypeFolder:
+		filter := s.config.GetFolderFilter()
+		size, err := calculateTarSize(c.Request.Context(), share.Path, filter)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read shared folder"})
+			return
+		}
+		c.Header("Content-Type", "application/x-tar")
+		c.Header("Content-Length", strconv.FormatInt(size, 10))
+		c.Header("Accept-Ranges", "none")
+		c.Status(http.StatusOK)
+		if err := streamFolderToTar(c.Request.Context(), c.Writer, share.Path, filter); err != nil {
+			slog.Error("Failed to stream shared folder", "id", share.ID, "error", err)
+		}
+	}
+}
+
+// ListRemoteShares 获取目标节点上本机可以下载的共享
+func (s *Service) ListRemoteShares(target *discovery.Peer, targetIP string) ([]RemoteShare, error) {
+	listUrl := fmt.Sprintf("https://%s:%d/shares", targetIP, target.Port)
+	req, err := http.NewRequest(http.MethodGet, listUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.signRequest(req); err != nil {
+		return nil, err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list shares: %s", resp.Status)
+	}
+
+	var list []RemoteShare
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// DownloadShare 从目标节点下载共享到 savePath
+// 文件下载中断后再次下载同一共享时从中断处继续
+func (s *Service) DownloadShare(
+	target *discovery.Peer,
+	targetIP string,
+	share RemoteShare,
+	savePath string,
+) {
+	// 共享名称由对方提供，不能包含路径，否则会写到保存目录之外
+	if !validFileName(share.Name) {
+		slog.Error("Invalid share name", "id", share.ID, "name", share.Name, "component", "transfer")
+		return
+	}
+	if savePath == "" {
+		savePath = s.config.GetSavePath()
+	}
+	taskID := uuid.New().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancelMap.Store(taskID, cancel)
+
+	task := NewTransfer(
+		taskID,
+		*target,
+		WithFileName(share.Name),
+		WithFileSize(share.Size),
+		WithSavePath(savePath),
+		WithType(TransferTypeReceive),
+		WithContentType(share.ContentType),
+		WithStatus(TransferStatusActive),
+	)
+	task.ConflictPolicy = s.conflictPolicyFor(*target)
+	s.StoreTransferToList(task)
+
+	go func() {
+		defer func() {
+			s.cancelMap.Delete(taskID)
+			cancel()
+			s.NotifyTransferListUpdate()
+		}()
+
+		err := s.downloadShare(ctx, target, targetIP, share, savePath, task)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				task.transition(TransferStatusCanceled, "")
+				return
+			}
+			slog.Error("Failed to download share", "id", share.ID, "error", err)
+			task.transition(
+				TransferStatusError,
+				fmt.Sprintf("Failed to download share: %v", err),
+			)
+			return
+		}
+		task.complete()
+		s.onReceiveCompleted(task)
+	}()
+}
+
+func (s *Service) downloadShare(
+	ctx context.Context,
+	target *discovery.Peer,
+	targetIP string,
+	share RemoteShare,
+	savePath string,
+	task *Transfer,
+) error {
+	downloadUrl := fmt.Sprintf("https://%s:%d/shares/%s", targetIP, target.Port, share.ID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadUrl, nil)
+	if err != nil {
+		return err
+	}
+
+	// 文件使用确定的临时文件名，以便中断后续传
+	var part *partFile
+	var offset int64
+	if share.ContentType == ContentTypeFile {
+		destPath, _ := resolveFileDest(ctx, savePath, share.Name, task.ConflictPolicy, share.Size, "")
+		part, offset, err = openPartFile(s.partials, destPath, share.ID)
+		if err != nil {
+			return err
+		}
+		// 只有记录了开始下载时的校验值才续传，对方的文件已变化时返回完整内容
+		if validator, ok := s.shareValidators.Load(part.Name()); ok && offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			req.Header.Set("If-Range", validator.(string))
+		}
+	}
+	// 临时文件保留用于续传时才保留校验值
+	detached := false
+	defer func() {
+		if part != nil && !detached {
+			s.shareValidators.Delete(part.Name())
+		}
+	}()
+
+	if err := s.signRequest(req); err != nil {
+		if part != nil {
+			part.Abort()
+		}
+		return err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		if part != nil {
+			part.Detach()
+			detached = true
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		offset = 0
+		if part != nil {
+			if err := part.Reset(); err != nil {
+				part.Abort()
+				return err
+			}
+			if validator := responseValidator(resp); validator != "" {
+				s.shareValidators.Store(part.Name(), validator)
+			} else {
+				s.shareValidators.Delete(part.Name())
+			}
+		}
+	case http.StatusPartialContent:
+		if part == nil ||
+			!strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			if part != nil {
+				part.Abort()
+			}
+			return fmt.Errorf("unexpected content range: %s", resp.Header.Get("Content-Range"))
+		}
+		slog.Info("Resuming share download", "id", share.ID, "offset", offset)
+	default:
+		if part != nil {
+			part.Abort()
+		}
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	// 每日额度按实际收到的字节数计算，共享的大小由对方提供，收到的内容必须与之一致
+	body := &countReader{r: resp.Body}
+	defer func() { s.quota.add(body.n.Load()) }()
+	limited := &sizeLimitReader{r: body, n: share.Size - offset, exact: true, err: errSizeMismatch}
+
+	reader := &PassThroughReader{
+		Reader:     &ContextReader{ctx: ctx, r: limited},
+		total:      task.FileSize,
+		currentLen: offset,
+		lastLen:    offset,
+		callback: func(current, total int64, speed float64) {
+			task.setProgress(Progress{
+				Current: current,
+				Total:   total,
+				Speed:   speed,
+			})
+			s.NotifyTransferListUpdate()
+		},
+	}
+
+	if share.ContentType == ContentTypeFolder {
+		dest, err := s.extractFolder(ctx, savePath, task, reader)
+		task.update(func() { task.FilePath = dest })
+		return err
+	}
+
+	if _, err := io.Copy(part, reader); err != nil {
+		if errors.Is(err, context.Canceled) {
+			part.Abort()
+		} else {
+			// 网络中断时保留临时文件，再次下载时续传
+			part.Detach()
+			detached = true
+		}
+		return err
+	}
+	if err := part.Commit(); err != nil {
+		return err
+	}
+	task.update(func() { task.FilePath = part.destPath })
+	return nil
+}
+
+// responseValidator 返回用于 If-Range 的校验值，弱 ETag 不能用于 Range 请求
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
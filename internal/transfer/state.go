@@ -0,0 +1,162 @@
+package transfer
+
+import (
+	"slices"
+	"time"
+)
+
+// StatusChange 一次状态变化
+type StatusChange struct {
+	Status TransferStatus `json:"status"`
+	Time   int64          `json:"time"` // 毫秒
+}
+
+// transitions 每个状态允许切换到的状态
+//
+// 完成与被拒绝是最终状态。失败与取消只能进入重试，发送端在重试前会先回到等待重试状态，
+// 因此用户取消或传输完成后，其他 goroutine 迟到的失败或取消不会覆盖任务的结果。
+var transitions = map[TransferStatus][]TransferStatus{
+	TransferStatusPending: {
+		TransferStatusAccepted,
+		TransferStatusActive,
+		TransferStatusCompleted,
+		TransferStatusRejected,
+		TransferStatusCanceled,
+		TransferStatusError,
+		TransferStatusRetrying,
+	},
+	TransferStatusAccepted: {
+		TransferStatusActive,
+		TransferStatusCompleted,
+		TransferStatusCanceled,
+		TransferStatusError,
+	},
+	TransferStatusActive: {
+		TransferStatusCompleted,
+		TransferStatusCanceled,
+		TransferStatusError,
+		TransferStatusRetrying,
+	},
+	TransferStatusRetrying: {
+		TransferStatusPending,
+		TransferStatusCanceled,
+		TransferStatusError,
+	},
+	TransferStatusWaiting: {
+		TransferStatusScheduled,
+		TransferStatusCompleted,
+		TransferStatusRejected,
+		TransferStatusCanceled,
+		TransferStatusError,
+	},
+	TransferStatusScheduled: {
+		TransferStatusWaiting,
+		TransferStatusCompleted,
+		TransferStatusRejected,
+		TransferStatusCanceled,
+		TransferStatusError,
+	},
+	TransferStatusError:    {TransferStatusRetrying},
+	TransferStatusCanceled: {TransferStatusRetrying},
+}
+
+// canTransition 判断任务能否从 from 切换到 to
+func canTransition(from, to TransferStatus) bool {
+	return slices.Contains(transitions[from], to)
+}
+
+// transition 将任务切换到 to，并将错误信息设置为 msg
+// 不允许的切换 (包括切换到当前状态) 不做任何修改并返回 false
+func (t *Transfer) transition(to TransferStatus, msg string) bool {
+	return t.changeState(func() bool {
+		return t.transitionLocked(to, msg)
+	})
+}
+
+// transitionFrom 仅在当前状态为 from 时切换到 to
+func (t *Transfer) transitionFrom(from, to TransferStatus, msg string) bool {
+	return t.changeState(func() bool {
+		return t.Status == from && t.transitionLocked(to, msg)
+	})
+}
+
+// changeState 持有 mu 执行 fn，fn 返回 true 表示状态发生了变化，释放 mu 后通知 onChange
+func (t *Transfer) changeState(fn func() bool) bool {
+	t.mu.Lock()
+	changed := fn()
+	onChange := t.onChange
+	t.mu.Unlock()
+	if changed && onChange != nil {
+		onChange(t)
+	}
+	return changed
+}
+
+// transitionLocked 与 transition 相同，调用方持有 mu
+func (t *Transfer) transitionLocked(to TransferStatus, msg string) bool {
+	if !canTransition(t.Status, to) {
+		return false
+	}
+	now := time.Now().UnixMilli()
+	t.Status = to
+	t.ErrorMsg = msg
+	t.Transitions = append(t.Transitions, StatusChange{Status: to, Time: now})
+	if isFinished(to) {
+		t.FinishTime = now
+	} else {
+		t.FinishTime = 0
+	}
+	return true
+}
+
+// complete 切换到完成状态，并将进度设置为完整
+func (t *Transfer) complete() bool {
+	return t.changeState(func() bool {
+		if !t.transitionLocked(TransferStatusCompleted, "") {
+			return false
+		}
+		t.Progress = Progress{Current: t.FileSize, Total: t.FileSize}
+		return true
+	})
+}
+
+// setProgress 更新进度，任务尚未开始传输时切换到传输中
+func (t *Transfer) setProgress(progress Progress) {
+	t.changeState(func() bool {
+		t.Progress = progress
+		if t.Status == TransferStatusPending || t.Status == TransferStatusAccepted {
+			return t.transitionLocked(TransferStatusActive, "")
+		}
+		return false
+	})
+}
+
+// update 在持有锁时修改状态以外的字段
+func (t *Transfer) update(fn func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fn()
+}
+
+// state 返回当前状态与错误信息
+func (t *Transfer) state() (TransferStatus, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Status, t.ErrorMsg
+}
+
+// status 返回当前状态
+func (t *Transfer) status() TransferStatus {
+	status, _ := t.state()
+	return status
+}
+
+// Snapshot 返回任务当前数据的副本，副本不会随任务变化
+func (t *Transfer) Snapshot() *Transfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	snapshot := &Transfer{transferData: t.transferData}
+	snapshot.HookResults = slices.Clone(t.HookResults)
+	snapshot.Transitions = slices.Clone(t.Transitions)
+	return snapshot
+}
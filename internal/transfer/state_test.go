@@ -0,0 +1,167 @@
+package transfer
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"mesh-drop/internal/discovery"
+)
+
+func newTestTransfer(status TransferStatus) *Transfer {
+	return NewTransfer(
+		"task",
+		discovery.Peer{ID: "peer", Name: "peer"},
+		WithFileSize(100),
+		WithStatus(status),
+	)
+}
+
+func TestTransitionRejectsFinishedStates(t *testing.T) {
+	for _, from := range []TransferStatus{TransferStatusCompleted, TransferStatusRejected} {
+		for to := range transitions {
+			task := newTestTransfer(from)
+			if task.transition(to, "") {
+				t.Errorf("%s -> %s should not be allowed", from, to)
+			}
+			if status := task.status(); status != from {
+				t.Errorf("status changed from %s to %s", from, status)
+			}
+		}
+	}
+}
+
+func TestTransitionRecordsChanges(t *testing.T) {
+	task := newTestTransfer(TransferStatusPending)
+	steps := []TransferStatus{
+		TransferStatusActive,
+		TransferStatusError,
+		TransferStatusRetrying,
+		TransferStatusPending,
+		TransferStatusActive,
+	}
+	for _, to := range steps {
+		if !task.transition(to, "") {
+			t.Fatalf("transition to %s failed", to)
+		}
+	}
+	if task.FinishTime != 0 {
+		t.Errorf("unfinished task has finish time %d", task.FinishTime)
+	}
+	if !task.complete() {
+		t.Fatal("complete failed")
+	}
+
+	snapshot := task.Snapshot()
+	want := append([]TransferStatus{TransferStatusPending}, steps...)
+	want = append(want, TransferStatusCompleted)
+	if len(snapshot.Transitions) != len(want) {
+		t.Fatalf("got %d transitions, want %d", len(snapshot.Transitions), len(want))
+	}
+	for i, change := range snapshot.Transitions {
+		if change.Status != want[i] {
+			t.Errorf("transition %d is %s, want %s", i, change.Status, want[i])
+		}
+		if i > 0 && change.Time < snapshot.Transitions[i-1].Time {
+			t.Errorf("transition %d is earlier than the previous one", i)
+		}
+	}
+	if snapshot.FinishTime == 0 {
+		t.Error("completed task has no finish time")
+	}
+	if snapshot.Progress.Current != snapshot.FileSize {
+		t.Errorf("progress %d, want %d", snapshot.Progress.Current, snapshot.FileSize)
+	}
+}
+
+func TestCancelAfterCompleteKeepsCompleted(t *testing.T) {
+	task := newTestTransfer(TransferStatusActive)
+	if !task.complete() {
+		t.Fatal("complete failed")
+	}
+	if task.transition(TransferStatusCanceled, "") {
+		t.Fatal("canceled a completed task")
+	}
+	if task.transition(TransferStatusError, "late error") {
+		t.Fatal("failed a completed task")
+	}
+	status, msg := task.state()
+	if status != TransferStatusCompleted || msg != "" {
+		t.Fatalf("got %s %q, want completed", status, msg)
+	}
+}
+
+func TestTransitionFrom(t *testing.T) {
+	task := newTestTransfer(TransferStatusActive)
+	if task.transitionFrom(TransferStatusPending, TransferStatusCanceled, "") {
+		t.Fatal("transitioned from a status the task is not in")
+	}
+	if !task.transitionFrom(TransferStatusActive, TransferStatusCanceled, "") {
+		t.Fatal("transition from the current status failed")
+	}
+}
+
+// TestConcurrentFinish 同时完成、取消与失败时只有一个结果生效
+func TestConcurrentFinish(t *testing.T) {
+	for range 100 {
+		task := newTestTransfer(TransferStatusActive)
+		results := make([]bool, 3)
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		finish := []func() bool{
+			task.complete,
+			func() bool { return task.transition(TransferStatusCanceled, "User canceled transfer") },
+			func() bool { return task.transition(TransferStatusError, "failed") },
+		}
+		for i, fn := range finish {
+			wg.Go(func() {
+				<-start
+				results[i] = fn()
+			})
+		}
+		// 同时读取快照与更新进度
+		for range 4 {
+			wg.Go(func() {
+				<-start
+				for range 10 {
+					task.setProgress(Progress{Current: 1, Total: 100})
+					if _, err := json.Marshal(task.Snapshot()); err != nil {
+						t.Error(err)
+					}
+				}
+			})
+		}
+		close(start)
+		wg.Wait()
+
+		succeeded := 0
+		for _, ok := range results {
+			if ok {
+				succeeded++
+			}
+		}
+		if succeeded != 1 {
+			t.Fatalf("%d finishing transitions succeeded, want 1", succeeded)
+		}
+		snapshot := task.Snapshot()
+		last := snapshot.Transitions[len(snapshot.Transitions)-1]
+		if last.Status != snapshot.Status || !isFinished(snapshot.Status) {
+			t.Fatalf("final status %s, last transition %s", snapshot.Status, last.Status)
+		}
+	}
+}
+
+// TestSnapshotIsIndependent 快照不随任务变化
+func TestSnapshotIsIndependent(t *testing.T) {
+	task := newTestTransfer(TransferStatusActive)
+	task.update(func() { task.HookResults = append(task.HookResults, HookResult{Name: "a"}) })
+	snapshot := task.Snapshot()
+
+	task.update(func() { task.HookResults[0].Name = "b" })
+	task.transition(TransferStatusError, "failed")
+
+	if snapshot.Status != TransferStatusActive || snapshot.HookResults[0].Name != "a" {
+		t.Fatalf("snapshot changed: %s %q", snapshot.Status, snapshot.HookResults[0].Name)
+	}
+}
@@ -0,0 +1,178 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"mesh-drop/internal/discovery"
+)
+
+// 流式传输
+//
+// ContentType 为 stream 时长度未知，FileSize 为 -1，上传使用分块编码，
+// 进度的 Total 为 -1 表示无法计算百分比。
+// 接收端设置了 ReceiveSink 时写入调用方提供的 io.Writer，否则按文件保存到 SavePath。
+
+// receiveSink 将收到的流写入调用方提供的 io.Writer
+type receiveSink struct {
+	w      io.Writer
+	accept func(sender discovery.Peer) bool
+	done   chan *Transfer
+
+	mu       sync.Mutex
+	claimed  bool
+	finished bool
+}
+
+// sinkUploadTimeout 接受数据流后等待发送端开始上传的时间，超时后任务失败并释放 sink
+const sinkUploadTimeout = 30 * time.Second
+
+// claim 为第一个符合条件的流占用 sink，返回拒绝原因
+func (k *receiveSink) claim(sender discovery.Peer) string {
+	if !k.accept(sender) {
+		return "Receiver does not accept streams from this peer"
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.claimed {
+		return "Receiver is busy"
+	}
+	k.claimed = true
+	return ""
+}
+
+// finish 通知 ReceiveStream 占用 sink 的任务已经结束，只有第一次调用有效
+func (k *receiveSink) finish(task *Transfer) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.finished {
+		return
+	}
+	k.finished = true
+	k.done <- task
+}
+
+// waitUpload 发送端在 sinkUploadTimeout 内没有开始上传时结束任务
+func (k *receiveSink) waitUpload(task *Transfer) {
+	time.AfterFunc(sinkUploadTimeout, func() {
+		if task.transitionFrom(TransferStatusAccepted, TransferStatusError, "Upload timed out") {
+			k.finish(task)
+		}
+	})
+}
+
+// SendStream 发送长度未知的数据流，如标准输入
+// 数据只能读取一次，因此失败后不会重试
+func (s *Service) SendStream(
+	target *discovery.Peer,
+	targetIP string,
+	name string,
+	r io.Reader,
+) (*Transfer, <-chan struct{}) {
+	taskID := uuid.New().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancelMap.Store(taskID, cancel)
+
+	task := NewTransfer(
+		taskID,
+		s.discoveryService.GetSelf(),
+		WithFileName(name),
+		WithFileSize(-1),
+		WithType(TransferTypeSend),
+		WithContentType(ContentTypeStream),
+	)
+
+	s.StoreTransferToList(task)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// 任务结束后清理 ctx
+		defer func() {
+			s.cancelMap.Delete(taskID)
+			cancel()
+			s.NotifyTransferListUpdate()
+		}()
+
+		askResp, err := s.ask(ctx, target, targetIP, task)
+		if err != nil {
+			setAskError(task, err)
+			return
+		}
+		if askResp.Accepted {
+			s.processTransfer(ctx, askResp, target, targetIP, task, r)
+		} else {
+			// 接收方拒绝
+			task.transition(TransferStatusRejected, askResp.Message)
+		}
+	}()
+	return task, done
+}
+
+// ReceiveStream 等待一个数据流并写入 w，返回结束后的任务
+// accept 为 nil 时只接受未出现密钥不匹配的受信任节点
+// 等待期间其他类型的传输请求都会被拒绝
+func (s *Service) ReceiveStream(
+	ctx context.Context,
+	w io.Writer,
+	accept func(sender discovery.Peer) bool,
+) (*Transfer, error) {
+	if accept == nil {
+		accept = func(sender discovery.Peer) bool {
+			return s.config.IsTrusted(sender.ID) && !sender.TrustMismatch
+		}
+	}
+	sink := &receiveSink{
+		w:      w,
+		accept: accept,
+		done:   make(chan *Transfer, 1),
+	}
+
+	s.sinkMu.Lock()
+	if s.sink != nil {
+		s.sinkMu.Unlock()
+		return nil, errors.New("another stream receiver is active")
+	}
+	s.sink = sink
+	s.sinkMu.Unlock()
+	defer func() {
+		s.sinkMu.Lock()
+		s.sink = nil
+		s.sinkMu.Unlock()
+	}()
+
+	slog.Info("Waiting for stream", "component", "transfer")
+	select {
+	case task := <-sink.done:
+		return task.Snapshot(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *Service) receiveSink() *receiveSink {
+	s.sinkMu.Lock()
+	defer s.sinkMu.Unlock()
+	return s.sink
+}
+
+// checkSinkAsk 设置了 sink 时只接受数据流，返回不为空时拒绝
+func (s *Service) checkSinkAsk(task *Transfer) string {
+	sink := s.receiveSink()
+	if sink == nil {
+		return ""
+	}
+	if task.ContentType != ContentTypeStream {
+		return "Receiver only accepts streams"
+	}
+	if msg := sink.claim(task.Sender); msg != "" {
+		return msg
+	}
+	task.update(func() { task.sink = sink })
+	return ""
+}
@@ -5,6 +5,8 @@ import "io"
 type Writer struct {
 	w        io.Writer
 	filePath string
+	// part 不为空时内容先写入临时文件，Commit 后才出现在 filePath
+	part *partFile
 }
 
 func (w Writer) Write(p []byte) (n int, err error) {
@@ -14,3 +16,18 @@ func (w Writer) Write(p []byte) (n int, err error) {
 func (w Writer) GetFilePath() string {
 	return w.filePath
 }
+
+// Commit 在接收成功后将临时文件移动到最终路径
+func (w Writer) Commit() error {
+	if w.part == nil {
+		return nil
+	}
+	return w.part.Commit()
+}
+
+// Abort 在接收失败后删除临时文件
+func (w Writer) Abort() {
+	if w.part != nil {
+		w.part.Abort()
+	}
+}
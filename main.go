@@ -9,7 +9,9 @@ import (
 	"github.com/wailsapp/wails/v3/pkg/application"
 	"github.com/wailsapp/wails/v3/pkg/events"
 	"github.com/wailsapp/wails/v3/pkg/services/notifications"
+	"mesh-drop/internal/audit"
 	"mesh-drop/internal/config"
+	"mesh-drop/internal/control"
 	"mesh-drop/internal/discovery"
 	"mesh-drop/internal/transfer"
 )
@@ -34,8 +36,10 @@ type App struct {
 	app              *application.App
 	mainWindows      *application.WebviewWindow
 	conf             *config.Config
+	configDir        string
 	discoveryService *discovery.Service
 	transferService  *transfer.Service
+	controlServer    *control.Server
 	notifier         *notifications.NotificationService
 }
 
@@ -82,7 +86,8 @@ func NewApp() *App {
 		slog.Info("No primary screen found, using defaults")
 	}
 
-	conf := config.Load(config.WindowState{
+	configDir := config.GetConfigDir()
+	conf := config.LoadFrom(configDir, config.WindowState{
 		Width:  defaultWidth,
 		Height: defaultHeight,
 	})
@@ -101,6 +106,7 @@ func NewApp() *App {
 		app:         app,
 		mainWindows: win,
 		conf:        conf,
+		configDir:   configDir,
 	}
 }
 
@@ -117,26 +123,70 @@ func (a *App) registerServices() {
 
 	port := 9989
 
+	// 打开审计日志，之后的安全事件都会写入
+	auditLog := openAuditLog(a.conf, a.configDir)
+
+	desktop := wailsPlatform{app: a.app}
+
 	// 初始化发现服务
-	discoveryService := discovery.NewService(a.conf, a.app, port)
+	discoveryService := discovery.NewService(a.conf, desktop, port)
 	discoveryService.Start()
 
 	// 初始化传输服务
-	transferService := transfer.NewService(a.conf, a.app, notifier, port, discoveryService)
+	transferService := transfer.NewService(
+		a.conf,
+		a.configDir,
+		desktop,
+		wailsNotifier{service: notifier},
+		desktop,
+		port,
+		discoveryService,
+	)
 	transferService.Start()
 	// 加载传输历史
 	if a.conf.GetSaveHistory() {
 		transferService.LoadHistory()
 	}
 
+	// 启动本地控制接口
+	controlServer := control.NewServer(
+		a.conf,
+		a.configDir,
+		desktop,
+		discoveryService,
+		transferService,
+	)
+	if err := controlServer.Start(); err != nil {
+		slog.Error("Failed to start control API", "error", err)
+	}
+
 	a.discoveryService = discoveryService
 	a.transferService = transferService
+	a.controlServer = controlServer
 	a.notifier = notifier
 
 	a.app.RegisterService(application.NewService(discoveryService))
 	a.app.RegisterService(application.NewService(transferService))
 	a.app.RegisterService(application.NewService(a.conf))
 	a.app.RegisterService(application.NewService(notifier))
+	if auditLog != nil {
+		a.app.RegisterService(application.NewService(auditLog))
+	}
+}
+
+// openAuditLog 打开配置目录下的审计日志并设置为默认日志，失败时返回 nil
+func openAuditLog(conf *config.Config, configDir string) *audit.Log {
+	auditLog, err := audit.Open(
+		filepath.Join(configDir, audit.FileName),
+		conf.GetPrivateKey(),
+		conf.GetPublicKey(),
+	)
+	if err != nil {
+		slog.Error("Failed to open audit log", "error", err)
+		return nil
+	}
+	audit.SetDefault(auditLog)
+	return auditLog
 }
 
 func (a *App) registerCustomEvents() {
@@ -185,16 +235,11 @@ func (a *App) setupEvents() {
 
 	// 应用关闭事件
 	a.app.OnShutdown(func() {
+		a.controlServer.Stop()
 		// 保存传输历史
 		if a.conf.GetSaveHistory() {
 			// 将 pending 状态的任务改为 canceled
-			a.transferService.GetTransferSyncMap().Range(func(key, value any) bool {
-				t := value.(*transfer.Transfer)
-				if t.Status == transfer.TransferStatusPending {
-					t.Status = transfer.TransferStatusCanceled
-				}
-				return true
-			})
+			a.transferService.CancelPending()
 			// 保存传输历史
 			a.transferService.SaveHistory()
 		}
@@ -235,6 +280,9 @@ func (a *App) Run() {
 }
 
 func main() {
+	if code, ok := runCLI(os.Args[1:]); ok {
+		os.Exit(code)
+	}
 	app := NewApp()
 	app.Run()
 }
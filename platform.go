@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/wailsapp/wails/v3/pkg/application"
+	"github.com/wailsapp/wails/v3/pkg/services/notifications"
+	"mesh-drop/internal/platform"
+)
+
+// wailsPlatform 使用 Wails 实现事件、剪贴板与浏览器
+type wailsPlatform struct {
+	app *application.App
+}
+
+func (p wailsPlatform) Emit(name string, data ...any) {
+	p.app.Event.Emit(name, data...)
+}
+
+func (p wailsPlatform) On(name string, handler func(data any)) func() {
+	return p.app.Event.On(name, func(event *application.CustomEvent) {
+		handler(event.Data)
+	})
+}
+
+func (p wailsPlatform) ClipboardText() (string, bool) {
+	return p.app.Clipboard.Text()
+}
+
+func (p wailsPlatform) SetClipboardText(text string) bool {
+	return p.app.Clipboard.SetText(text)
+}
+
+func (p wailsPlatform) OpenURL(url string) error {
+	return p.app.Browser.OpenURL(url)
+}
+
+// wailsNotifier 使用 Wails 的通知服务发送系统通知
+type wailsNotifier struct {
+	service *notifications.NotificationService
+}
+
+func (n wailsNotifier) SendNotification(notification platform.Notification) error {
+	return n.service.SendNotification(notifications.NotificationOptions{
+		ID:       notification.ID,
+		Title:    notification.Title,
+		Subtitle: notification.Subtitle,
+		Body:     notification.Body,
+		Data:     notification.Data,
+	})
+}